@@ -88,523 +88,6042 @@ type User struct {
 	UserUUID         uuid.UUID
 	RsaSk            userlib.PKEDecKey
 	DsSk             userlib.DSSignKey
-	SharedFiles      map[string][]byte
+	SharedFiles      map[string]SharedFile
 	ListOfOwnedFiles map[string]bool // the list of filenames where the user is the original owner of the file
+	// for each sender, the hex nonces of the sharing records already
+	// accepted that are still in the sender's window, with their IssuedAt
+	UsedNonces map[string]map[string]int64
+	// how many sharing records the user has issued
+	Issued int64
+	// for owned files, the access nodes handed out to recipients and groups
+	Grants map[string][]AccessGrant
+	// the highest version seen of each directory, keyed by its location
+	SeenVersions map[string]uint64
+	// the size of the chunks the user's new files are split into, zero
+	// for defaultChunkSize
+	ChunkSize int
+	// how many earlier versions the files the user creates keep
+	KeepVersions int
+	// how the files the user creates are padded
+	Padding Padding
+	// how the files the user creates are compressed
+	Compression Compression
+	// the labels of the user's snapshots
+	Snapshots map[string]bool
+	// whether the files the user creates are deduplicated
+	Dedup bool
 	// Note for JSON to marshal/unmarshal, the fields need to
 	// be public (start with a capital letter)
-}
 
-type UserEntry struct {
-	CipherText []byte
-	Sigma      []byte
+	// where the session gets the time from, if it was given one
+	clock func() int64
+	// the run the session's current operation records what it does in
+	active *run
 }
 
-type FileEntry struct {
-	CipherText       [][]byte // each file entry is a list of encrypted files
-	Sigma            []byte
-	SigmaSharedUsers []byte
+// SharedFile is what a user keeps for each file it can reach, under the
+// user's own name for it: the keys that open it and how the user came to
+// hold them.
+type SharedFile struct {
+	Root        []byte    // the file's key root, held directly by the owner only
+	Node        uuid.UUID // everyone else reads the root from the access node they were given
+	NodeKeys    []byte    // nodeMacKey || nodeEncKey
+	Slot        uuid.UUID // for group members, where the group owner posts a rotated node
+	Permissions uint8
+	Custody     []string      // usernames the file passed through, owner first and this user last
+	Chain       []signedGrant // the signed hops from the owner to this user
+	Dir         bool          // the name is a directory rather than a file
 }
 
-// This creates a user.  It will only be called once for a user
-// (unless the keystore and datastore are cleared during testing purposes)
-
-// It should store a copy of the userdata, suitably encrypted, in the
-// datastore and should store the user's public key in the keystore.
-
-// The datastore may corrupt or completely erase the stored
-// information, but nobody outside should be able to get at the stored
-// User data: the name used in the datastore should not be guessable
-// without also knowing the password and username.
-
-// You are not allowed to use any global storage other than the
-// keystore and the datastore functions in the userlib library.
-
-// You can assume the user has a STRONG password
+func (entry *SharedFile) encode(e *encoder) {
+	e.writeBytes(entry.Root)
+	e.writeUUID(entry.Node)
+	e.writeBytes(entry.NodeKeys)
+	e.writeUUID(entry.Slot)
+	e.writeUint(uint64(entry.Permissions), 1)
+	e.writeStrings(entry.Custody)
+	writeSignedGrants(e, entry.Chain)
+	e.writeBool(entry.Dir)
+}
 
-/*InitUser
-- Derive sourceKey = Argon2Key(password, username, 16)
-- k1 = HMACEval(sourceKey, username)
-- k2 = HMACEval(sourceKey, 1 + username)
-- Generate public/private keys using PKEKeyGen() and DSKeyGen()
+func (entry *SharedFile) decode(d *decoder) {
+	entry.Root = d.readBytes()
+	entry.Node = d.readUUID()
+	entry.NodeKeys = d.readBytes()
+	entry.Slot = d.readUUID()
+	entry.Permissions = uint8(d.readUint(1))
+	entry.Custody = d.readStrings()
+	entry.Chain = readSignedGrants(d)
+	entry.Dir = d.readBool()
+}
 
-- userUUID = bytesToUUID(HMACEval(k1, username))
-- Determine if this UUID is already in the dataStore, if so, return
+// FileEntry is the header of a file. The data itself is in chunks stored
+// apart from it, so a reader can fetch only the ones it needs; the header
+// is a sealed record, so its tag covers the list of chunks and each chunk's
+// own tag, and nothing in it is readable without the file's keys.
+type FileEntry struct {
+	Chunks           []chunkRef
+	ChunkSize        int                       // the most a chunk holds, and what all but the last hold unless Dedup is set
+	Size             int                       // plaintext length of the whole file
+	Modified         int64                     // unix time of the last store or append, from the session's clock
+	Version          int                       // number of the current contents, counting every change
+	Keep             int                       // how many earlier versions are kept, chosen by whoever created the file
+	History          []versionRef              // earlier contents still kept, oldest first
+	Pins             map[uuid.UUID][]uuid.UUID // chunks held for each snapshot that includes the file
+	Retired          bool                      // the file is gone, and the header is only kept for its Pins
+	Padding          Padding                   // how the chunks and header are padded, fixed when the file is created
+	Compression      Compression               // how the chunks are compressed, fixed when the file is created
+	Dedup            bool                      // chunks are cut and named by their contents, fixed when the file is created
+	SigmaSharedUsers []byte
 
-- Create new User struct
-- Populate User with RSA_sk, DS_sk, and map[sharedfileUUID] = k6||k7
-- This map[sharedfileUUID, your_version_of_filename] = k6||k7 will be a list of all files for which you have access to but are not an owner
-- Pad User
-- userEntry = HMACEval(k1, SymEnc(k2, IV, userdata)), SymEnc(k2, IV, userdata)
-- datastore[userUUID] = userEntry
+	// the chunks and version records written since the header was last
+	// stored, which nothing points at until it is
+	written []chunkRef
+	// what the session writing to the file deduplicates chunks with, if it
+	// does
+	dedup *deduper
+	// the deduplicated chunks the current contents listed when the header
+	// was opened, which it already counts a use of
+	held map[uuid.UUID]chunkRef
+	// uses of deduplicated chunks taken since then by new version records
+	// and snapshot pins, counted when the header is stored
+	pending []chunkRef
+	// the run the chunks written are recorded in, if anyone is writing
+	run *run
+}
 
-- keystore[username||"enc"] = RSA_pk
-- keystore[username||"sig"] = DS_pk
+// versionRef is where an earlier version of a file is kept. Each version
+// is a record of its own, sealed like a chunk, so the header grows by one
+// of these per version however many chunks the file has.
+type versionRef struct {
+	Version int
+	Record  chunkRef
+}
 
-- return userdata (is this safe) */
-func InitUser(username string, password string) (userdataptr *User, err error) {
-	var userdata User
-	userdataptr = &userdata
+// fileVersion is a snapshot of the chunk index as it was before a change.
+// Chunks are never rewritten in place, so the chunks a version lists stay
+// as they were for as long as the version is kept. The header's tag
+// covers the history along with the rest of it.
+type fileVersion struct {
+	Chunks    []chunkRef
+	ChunkSize int
+	Size      int
+	Modified  int64
+}
 
-	sourceKey := userlib.Argon2Key([]byte(password), []byte(username), 16)
-	hmacKey, symKey := generateKeysForDataStore(username, sourceKey, []byte(username), []byte(username+"1"))
+// chunkRef is where one chunk of a file is and what it must look like.
+type chunkRef struct {
+	Location uuid.UUID
+	Size     int    // plaintext length of the chunk
+	Sigma    []byte // the tag of the chunk's sealed record
+	Key      []byte // for a deduplicated chunk, the keys it's sealed with, which come from its contents
+}
 
-	// check if username already exists
-	filename, _ := userlib.HMACEval(hmacKey, []byte(username))
-	userUUID := bytesToUUID(filename)
-	if _, ok := userlib.KeystoreGet(username + "enc"); ok {
-		// if a user with the same username exists, return an error
-		return nil, errors.New("Username already exists")
+func (filedata *FileEntry) encode(e *encoder) {
+	writeChunks(e, filedata.Chunks)
+	e.writeInt(int64(filedata.ChunkSize))
+	e.writeInt(int64(filedata.Size))
+	e.writeInt(filedata.Modified)
+	e.writeInt(int64(filedata.Version))
+	e.writeInt(int64(filedata.Keep))
+	e.writeCount(len(filedata.History))
+	for _, ref := range filedata.History {
+		writeVersionRef(e, ref)
 	}
+	ids := make([]uuid.UUID, 0, len(filedata.Pins))
+	for id := range filedata.Pins {
+		ids = append(ids, id)
+	}
+	sortSlice(len(ids), func(i, j int) bool { return uuidLess(ids[i], ids[j]) },
+		func(i, j int) { ids[i], ids[j] = ids[j], ids[i] })
+	e.writeCount(len(ids))
+	for _, id := range ids {
+		e.writeUUID(id)
+		e.writeCount(len(filedata.Pins[id]))
+		for _, location := range filedata.Pins[id] {
+			e.writeUUID(location)
+		}
+	}
+	e.writeBool(filedata.Retired)
+	e.writeUint(uint64(filedata.Padding), 1)
+	e.writeBytes(filedata.SigmaSharedUsers)
+	e.writeUint(uint64(filedata.Compression), 1)
+	e.writeBool(filedata.Dedup)
+}
 
-	// generate RSA encryption keys
-	rsaPk, rsaSk, _ := userlib.PKEKeyGen()
-	userlib.KeystoreSet(username+"enc", rsaPk)
-
-	// generate RSA signature keys
-	dsSk, dsPk, _ := userlib.DSKeyGen()
-	userlib.KeystoreSet(username+"sig", dsPk)
+// keyedHeaderSchema is the header schema chunk references gained their
+// keys in, and headers the Dedup flag.
+const keyedHeaderSchema = 4
 
-	// initialize User struct
-	userdataptr.Username = username
-	userdataptr.SourceKey = sourceKey
-	userdataptr.HmacKey = hmacKey
-	userdataptr.SymKey = symKey
-	userdataptr.UserUUID = userUUID
-	userdataptr.RsaSk = rsaSk
-	userdataptr.DsSk = dsSk
-	userdataptr.SharedFiles = make(map[string][]byte)
-	userdataptr.ListOfOwnedFiles = make(map[string]bool)
+func (filedata *FileEntry) decode(d *decoder) {
+	keyed := d.schema >= keyedHeaderSchema
+	filedata.Chunks = readChunks(d, keyed)
+	filedata.ChunkSize = int(d.readInt())
+	filedata.Size = int(d.readInt())
+	filedata.Modified = d.readInt()
+	filedata.Version = int(d.readInt())
+	filedata.Keep = int(d.readInt())
+	for i, n := 0, d.readCount(); i < n; i++ {
+		filedata.History = append(filedata.History, readVersionRef(d, keyed))
+	}
+	var previous uuid.UUID
+	for i, n := 0, d.readCount(); i < n; i++ {
+		id := d.readUUID()
+		if i > 0 && !uuidLess(previous, id) {
+			d.fail()
+		}
+		if filedata.Pins == nil {
+			filedata.Pins = make(map[uuid.UUID][]uuid.UUID)
+		}
+		previous = id
+		var locations []uuid.UUID
+		for j, m := 0, d.readCount(); j < m; j++ {
+			locations = append(locations, d.readUUID())
+		}
+		filedata.Pins[id] = locations
+	}
+	filedata.Retired = d.readBool()
+	filedata.Padding = Padding(d.readUint(1))
+	filedata.SigmaSharedUsers = d.readBytes()
+	filedata.Compression = Compression(d.readUint(1))
+	if keyed {
+		filedata.Dedup = d.readBool()
+	}
+}
 
-	userdataMarshal, _ := json.Marshal(userdata)
+func writeVersionRef(e *encoder, ref versionRef) {
+	e.writeInt(int64(ref.Version))
+	writeChunk(e, ref.Record)
+}
 
-	// encrypt and store userdata in the datastore
-	var encryptedData UserEntry
-	iv := userlib.RandomBytes(16)
-	encryptedData.CipherText = userlib.SymEnc(userdataptr.SymKey, iv, padString(userdataMarshal)) // cipherText = iv || c
-	encryptedData.Sigma, _ = userlib.HMACEval(userdataptr.HmacKey, encryptedData.CipherText)
+func readVersionRef(d *decoder, keyed bool) (ref versionRef) {
+	ref.Version = int(d.readInt())
+	ref.Record = readChunk(d, keyed)
+	return ref
+}
 
-	data, _ := json.Marshal(encryptedData)
+func (version *fileVersion) encode(e *encoder) {
+	writeChunks(e, version.Chunks)
+	e.writeInt(int64(version.ChunkSize))
+	e.writeInt(int64(version.Size))
+	e.writeInt(version.Modified)
+}
 
-	fileUUID := bytesToUUID([]byte(filename))
-	userlib.DatastoreSet(fileUUID, data)
+// keyedVersionSchema is the version record schema chunk references gained
+// their keys in.
+const keyedVersionSchema = 3
 
-	return &userdata, nil
+func (version *fileVersion) decode(d *decoder) {
+	version.Chunks = readChunks(d, d.schema >= keyedVersionSchema)
+	version.ChunkSize = int(d.readInt())
+	version.Size = int(d.readInt())
+	version.Modified = d.readInt()
 }
 
-func generateKeysForDataStore(username string, sourceKey []byte, hmacKeySalt []byte, encKeySalt []byte) ([]byte, []byte) {
-	hmacKey, _ := userlib.HMACEval(sourceKey, []byte(hmacKeySalt))
-	encKey, _ := userlib.HMACEval(sourceKey, []byte(encKeySalt))
-	return hmacKey[0:16], encKey[0:16]
+func writeChunk(e *encoder, ref chunkRef) {
+	e.writeUUID(ref.Location)
+	e.writeInt(int64(ref.Size))
+	e.writeBytes(ref.Sigma)
+	e.writeBytes(ref.Key)
 }
 
-func generateFileKeysForDataStore(filename string, username string, sourceKey []byte) ([]byte, []byte, []byte, []byte) {
-	fileEncKey, _ := userlib.HMACEval(sourceKey, []byte(filename+username+"enc"))
-	fileMacKey, _ := userlib.HMACEval(sourceKey, []byte(filename+username+"sig"))
-	sharedfileEncKey, _ := userlib.HMACEval(sourceKey, []byte(filename+username+"shareenc"))
-	sharedfileMacKey, _ := userlib.HMACEval(sourceKey, []byte(filename+username+"sharesig"))
-
-	return fileEncKey[0:16], fileMacKey[0:16], sharedfileEncKey[0:16], sharedfileMacKey[0:16]
+// readChunk reads what writeChunk wrote, or, unless keyed, what it wrote
+// before chunk references had keys.
+func readChunk(d *decoder, keyed bool) (ref chunkRef) {
+	ref.Location = d.readUUID()
+	ref.Size = int(d.readInt())
+	ref.Sigma = d.readBytes()
+	if keyed {
+		ref.Key = d.readBytes()
+	}
+	return ref
 }
 
-// pad with 0 and the last byte contains how many bytes of padding needed
-// padding reference : https://sourcegraph.com/github.com/apexskier/cryptoPadding/-/blob/ansix923.go#L17
-func padString(str []byte) []byte {
-	var padBytes int
-	if len(str)%userlib.AESBlockSize == 0 {
-		padBytes = userlib.AESBlockSize
-	} else {
-		padBytes = userlib.AESBlockSize - (len(str) % userlib.AESBlockSize)
+func writeChunks(e *encoder, chunks []chunkRef) {
+	e.writeCount(len(chunks))
+	for _, ref := range chunks {
+		writeChunk(e, ref)
 	}
-	padText := []byte(strings.Repeat(string([]byte{byte(0)}), padBytes-1))
-	str = append(str, append(padText, byte(padBytes))...)
-	return str
 }
 
-// TODO: add error checking
-func unpadString(str []byte) []byte {
-	padBytes := int(str[len(str)-1])
-	return str[0 : len(str)-padBytes]
+func readChunks(d *decoder, keyed bool) []chunkRef {
+	var chunks []chunkRef
+	for i, n := 0, d.readCount(); i < n; i++ {
+		chunks = append(chunks, readChunk(d, keyed))
+	}
+	return chunks
 }
 
-// This fetches the user information from the Datastore.  It should
-// fail with an error if the user/password is invalid, or if the user
-// data was corrupted, or if the user can't be found.
+// defaultChunkSize is the size of the chunks new files are split into for
+// a user who hasn't chosen one with SetChunkSize.
+const defaultChunkSize = 64 * 1024
 
-/*GetUser
-- Derive sourceKey = Argon2Key(password, username, 16)
-- k1 = HMACEval(sourceKey, username)
-- k2 = HMACEval(sourceKey, 1 + username)
-- userUUID = bytesToUUID(HMACEval(k1, username))
+// defaultKeepVersions is how many earlier versions the files a user
+// creates keep, if they haven't chosen how many with SetKeepVersions. Once
+// there are more, the oldest are dropped along with any chunks nothing
+// else still uses.
+const defaultKeepVersions = 16
 
-- Check if userUUID is in the datastore. If not, return error
-- a userUUID won't exist if the username or password is wrong
-- get the userEntry at userUUID
-- Take HMACEval(k1, SymEnc(k2, IV, userdata)) and verify this with userEntry
-- If not equal, return error
-*/
-func GetUser(username string, password string) (userdataptr *User, err error) {
-	var userdata User
-	userdataptr = &userdata
-	sourceKey := userlib.Argon2Key([]byte(password), []byte(username), 16)
-	hmacKey, symKey := generateKeysForDataStore(username, sourceKey, []byte(username), []byte(username+"1"))
-	filename, _ := userlib.HMACEval(hmacKey[0:16], []byte(username))
-	userUUID := bytesToUUID(filename)
-	marshalData, ok := userlib.DatastoreGet(userUUID)
-	_, usernameOk := userlib.KeystoreGet(username + "enc")
-	if !ok || !usernameOk {
-		return nil, errors.New("The username doesn't exist or wrong password")
+// maxKeepVersions is the most SetKeepVersions allows.
+const maxKeepVersions = 256
+
+// Padding is how much of a file's length its stored objects give away.
+// A user picks one with SetPadding and it applies to the files they create
+// from then on; everyone writing to a file pads it the way it was created.
+//
+// Padding hides the exact length, not everything. The number of chunk
+// objects still gives the size to within a chunk, PadPowersOfTwo still
+// gives it to within a factor of two below that, and anyone watching the
+// datastore sees how often a file is written, so appends are hidden in the
+// stored sizes but not in the timing of writes or the version records
+// they leave. A padded header has room for as many versions as the file
+// keeps, so the versions it does hold don't show, but it grows with the
+// snapshot pins it keeps. User entries, access nodes, groups, snapshots
+// and sharing records aren't padded.
+type Padding uint8
+
+const (
+	// PadNone stores every chunk and header at its exact length.
+	PadNone Padding = iota
+	// PadPowersOfTwo rounds each chunk up to a power of two, at most the
+	// file's chunk size, and each header up to a power of two.
+	PadPowersOfTwo
+	// PadFullChunks stores every chunk at the file's full chunk size, and
+	// rounds each header up to a multiple of headerTier.
+	PadFullChunks
+)
+
+// headerTier is the step PadFullChunks rounds headers up to.
+const headerTier = 4096
+
+// chunkSize is how long a chunk holding n bytes is stored as.
+func (padding Padding) chunkSize(n int, chunkSize int) int {
+	switch padding {
+	case PadPowersOfTwo:
+		size := 1
+		for size < n {
+			size *= 2
+		}
+		if size > chunkSize && n <= chunkSize {
+			size = chunkSize
+		}
+		return size
+	case PadFullChunks:
+		if n < chunkSize {
+			return chunkSize
+		}
 	}
-	var data UserEntry
-	json.Unmarshal(marshalData, &data)
+	return n
+}
 
-	signature, _ := userlib.HMACEval(hmacKey, data.CipherText)
-	if !userlib.HMACEqual(signature, data.Sigma) {
-		return nil, errors.New("data corrupted")
+// headerSize is how long a header of n bytes is stored as.
+func (padding Padding) headerSize(n int) int {
+	switch padding {
+	case PadPowersOfTwo:
+		size := 256
+		for size < n {
+			size *= 2
+		}
+		return size
+	case PadFullChunks:
+		return (n + headerTier - 1) / headerTier * headerTier
 	}
-	decryptedData := userlib.SymDec(symKey, data.CipherText)
-	userdataMarshal := unpadString(decryptedData)
-	json.Unmarshal(userdataMarshal, userdataptr)
-	return userdataptr, nil
+	return n
 }
 
-// This stores a file in the datastore.
+// padTo returns data followed by zeros up to size.
+func padTo(data []byte, size int) []byte {
+	padded := make([]byte, size)
+	copy(padded, data)
+	return padded
+}
+
+// Compression is how a file's chunks are compressed before they are
+// sealed. A user picks one with SetCompression for the files they create
+// from then on, and a file keeps the one it was created with, in its
+// header, so everyone who writes to it agrees.
 //
-// The name of the file should NOT be revealed to the datastore!
-// edge case, storing a file that's already stored
+// Compressing before encrypting makes the stored length of a chunk depend
+// on what is in it. Anyone who can get their own text written into a file
+// next to a secret, and watch the datastore, can learn about the secret
+// from how well the two compress together. That's why it's off unless a
+// user turns it on. PadFullChunks hides compressed lengths, but then
+// compression saves no space either.
+type Compression uint8
 
-/*StoreFile
-- Obtain username from userdata
-- Derive sourceKey = Argon2Key(password, username, 16)  (how can the user find the password in the implementation?)
-- k3 = HMACEval(sourceKey, filename + username + "enc")
-- k4 = HMACEval(sourceKey, filename + username + "sig")
-- k6 = HMACEval(sourceKey, filename + username + "shareEnc")
-- k7 = HMACEval(sourceKey, filename + username + "shareSig")
-- fileUUID = bytesToUUID(HMAC(k3, filename))
-- sharedfileUUID = bytesToUUID(HMAC(k6, k7))
+const (
+	// CompressNone stores chunks as they are.
+	CompressNone Compression = iota
+	// CompressLZ compresses each chunk on its own with LZ77, and stores
+	// it as it is if that doesn't make it smaller.
+	CompressLZ
+)
 
-- Check if fileUUID or sharedfileUUID already exists in datastore. If so, return (*or replace old file contents)
+// A chunk of a compressed file starts with a byte saying whether the rest
+// was compressed.
+const (
+	chunkStored byte = iota
+	chunkCompressed
+)
 
-- create fileData struct
-- populate fileData with signature, ciphertext, and list_of_shared_people
-- ciphertext = SymEnc(k3, IV, list(data))
-- list_of_shared_people = list(userUUID of owner)  (when you first store a file, you are the only person who can access)
-- signature = HMACEval(k4, ciphertext)
+// packChunk is what is sealed for a chunk of a file compressed with c.
+func (c Compression) packChunk(data []byte) []byte {
+	if c == CompressNone {
+		return data
+	}
+	if compressed := compressLZ(data); len(compressed) < len(data) {
+		return append([]byte{chunkCompressed}, compressed...)
+	}
+	return append([]byte{chunkStored}, data...)
+}
 
-- store datastore[fileUUID] = HMACEval(k4, SymEnc(k3, IV, fileData))
-*/
-func (userdata *User) StoreFile(filename string, data []byte) {
-	sourceKey := userdata.SourceKey
-	fileMacKey, fileEncKey := generateKeysForDataStore(userdata.Username, sourceKey, []byte(filename+userdata.Username+"sig"), []byte(filename+userdata.Username+"enc"))
-	sharedfileMacKey, _ := generateKeysForDataStore(userdata.Username, sourceKey, []byte(filename+userdata.Username+"sharesig"), []byte(filename+userdata.Username+"shareenc"))
+// unpackChunk undoes packChunk for a chunk of size bytes. What follows the
+// chunk is padding and is ignored.
+func (c Compression) unpackChunk(packed []byte, size int) ([]byte, error) {
+	if c == CompressNone {
+		return packed, nil
+	}
+	if len(packed) == 0 {
+		return nil, errors.New("file data corrupted")
+	}
+	switch packed[0] {
+	case chunkStored:
+		return packed[1:], nil
+	case chunkCompressed:
+		return expandLZ(packed[1:], size)
+	}
+	return nil, errors.New("file data corrupted")
+}
 
-	// sharedFile keys should be taken from userdata struct if exists
-	if _, ok := userdata.SharedFiles[filename]; ok {
-		sharedfileMacKey = userdata.SharedFiles[filename][0:16]
+// compressLZ writes data as a list of sequences, each some literal bytes
+// followed by a copy of earlier output. A sequence starts with a byte
+// holding the literal count in its high four bits and the copy length,
+// less minMatch, in its low four; either that doesn't fit goes on in
+// further bytes of 255 and a final one under it. The literals come next,
+// then the distance back to copy from in two bytes. The last sequence
+// is literals only, and a reader knows it's last from the size of the
+// chunk.
+func compressLZ(data []byte) []byte {
+	var out []byte
+	var table [1 << lzHashBits]int // last position+1 each hash was seen at
+	anchor := 0
+	for i := 0; i+minMatch <= len(data); {
+		h := lzHash(data[i:])
+		candidate := table[h] - 1
+		table[h] = i + 1
+		if candidate < 0 || i-candidate > maxOffset || string(data[candidate:candidate+minMatch]) != string(data[i:i+minMatch]) {
+			i++
+			continue
+		}
+		length := minMatch
+		for i+length < len(data) && data[candidate+length] == data[i+length] {
+			length++
+		}
+		out = appendSequence(out, data[anchor:i], length-minMatch)
+		out = append(out, byte((i-candidate)>>8), byte(i-candidate))
+		if length-minMatch >= 15 {
+			out = appendLength(out, length-minMatch-15)
+		}
+		i += length
+		anchor = i
 	}
+	return appendSequence(out, data[anchor:], 0)
+}
 
-	// creating the fileUUID to see if it exists in the datastore already
-	hashedFilename, _ := userlib.HMACEval(fileMacKey, []byte(filename))
-	fileUUID := bytesToUUID(hashedFilename)
+const (
+	minMatch   = 4
+	maxOffset  = 1<<16 - 1
+	lzHashBits = 14
+)
 
-	// creating the sharedfileUUID to see if it exists in the datastore already
-	encryptedSharedFilename, _ := userlib.HMACEval(sharedfileMacKey, []byte("magic_string"))
-	sharedfileUUID := bytesToUUID(encryptedSharedFilename)
+func lzHash(b []byte) int {
+	v := uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	return int(v * 2654435761 >> (32 - lzHashBits))
+}
 
-	if _, ok := userlib.DatastoreGet(fileUUID); ok {
-		errors.New("file already exists. you are the only owner")
-		return
+// appendSequence writes the token and literals of a sequence. The caller
+// writes the copy that goes with them, if there is one.
+func appendSequence(out []byte, literals []byte, match int) []byte {
+	token := byte(0)
+	if len(literals) >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(len(literals)) << 4
 	}
-
-	if _, ok := userlib.DatastoreGet(sharedfileUUID); ok {
-		errors.New("file already exists. you are not the only owner")
-		return
+	if match >= 15 {
+		token |= 15
+	} else {
+		token |= byte(match)
 	}
+	out = append(out, token)
+	if len(literals) >= 15 {
+		out = appendLength(out, len(literals)-15)
+	}
+	return append(out, literals...)
+}
 
-	// filling in the FileEntry
-	storeData(fileEncKey, data, fileMacKey, hashedFilename, userdata.Username)
-	userdata.ListOfOwnedFiles[filename] = true
+func appendLength(out []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		out = append(out, 255)
+	}
+	return append(out, byte(n))
+}
 
-	return
+// expandLZ undoes compressLZ for a chunk of size bytes. Nothing it reads
+// can make it write past size or copy from outside what it has written.
+func expandLZ(data []byte, size int) ([]byte, error) {
+	out := make([]byte, 0, size)
+	corrupted := errors.New("file data corrupted")
+	for len(out) < size {
+		if len(data) == 0 {
+			return nil, corrupted
+		}
+		token := data[0]
+		data = data[1:]
+		literals := int(token >> 4)
+		if literals == 15 {
+			var extra int
+			if extra, data = readLength(data, size); extra < 0 {
+				return nil, corrupted
+			}
+			literals += extra
+		}
+		if literals > len(data) || len(out)+literals > size {
+			return nil, corrupted
+		}
+		out = append(out, data[:literals]...)
+		data = data[literals:]
+		if len(out) == size {
+			break
+		}
+		if len(data) < 2 {
+			return nil, corrupted
+		}
+		offset := int(data[0])<<8 | int(data[1])
+		data = data[2:]
+		length := int(token&15) + minMatch
+		if token&15 == 15 {
+			var extra int
+			if extra, data = readLength(data, size); extra < 0 {
+				return nil, corrupted
+			}
+			length += extra
+		}
+		if offset == 0 || offset > len(out) || len(out)+length > size {
+			return nil, corrupted
+		}
+		for start := len(out) - offset; length > 0; length-- {
+			out = append(out, out[start])
+			start++
+		}
+	}
+	return out, nil
 }
 
-func storeData(fileEncKey []byte, data []byte, fileMacKey []byte, hashedFilename []byte, username string) {
-	var encryptedData FileEntry
-	fileUUID := bytesToUUID(hashedFilename)
-	iv := userlib.RandomBytes(16)
-	encryptedData.CipherText = append(encryptedData.CipherText, userlib.SymEnc(fileEncKey, iv, padString(data)))
-	// list of encrypted filedata
-	ciphertextMarshal, _ := json.Marshal(encryptedData.CipherText)
-	// marshalling so I can pass this into sigma
-	encryptedData.Sigma, _ = userlib.HMACEval(fileMacKey, []byte(ciphertextMarshal))
-	encryptedDataMarshal, _ := json.Marshal(encryptedData)
-	userlib.DatastoreSet(fileUUID, encryptedDataMarshal)
+// readLength reads what appendLength wrote, or returns -1 if the data ends
+// first or the length is more than limit.
+func readLength(data []byte, limit int) (int, []byte) {
+	n := 0
+	for len(data) > 0 && n <= limit {
+		b := data[0]
+		data = data[1:]
+		n += int(b)
+		if b < 255 {
+			return n, data
+		}
+	}
+	return -1, data
 }
 
-// This adds on to an existing file.
+// Deduplication stores a chunk that is in several of a user's files, or
+// several times in one, only once. A deduplicated file is cut into chunks
+// where its contents say rather than every ChunkSize bytes, so an edit
+// only changes the chunks around it, and each chunk is named and sealed
+// with keys derived from its contents under the writer's own keys. The
+// same chunk written twice by one user lands in the same place, but
+// nobody without the user's keys can work out where a chunk they guess
+// would be, so the datastore can't use that to confirm what a file holds.
 //
-// Append should be efficient, you shouldn't rewrite or reencrypt the
-// existing file, but only whatever additional information and
-// metadata you need.
-
-/*AppendFile
-- Find fileUUID for filename in datastore (return error if not found)
-- Validate fileEntry for integrity
-- Add the new encrypted data to the list of ciphertexts and recompute the HMAC signature
-*/
-func (userdata *User) AppendFile(filename string, data []byte) (err error) {
-	// generating all the necessary keys. If we store them in userdata later, we can just fetch them from userdata
-	fileEncKey, fileMacKey, sharedfileEncKey, sharedfileMacKey := generateFileKeysForDataStore(filename, userdata.Username, userdata.SourceKey)
+// What it still gives away is how the user's files overlap: the datastore
+// sees which of them share chunks, and that a write stored nothing new.
+// Anyone a file is shared with knows where its chunks are, so they can
+// tell whether those chunks stay around after they are gone from the file,
+// and with it whether the user has them in other files too. That's why it's
+// off unless a user turns it on with SetDedup, for the files they create
+// from then on. Each writer cuts and names chunks with their own keys, so
+// chunks are only shared between what the same user writes, and only
+// between files that pad and compress them alike.
+//
+// A deduplicated chunk has a count of its uses, sealed under keys derived
+// from the chunk's, so anyone who can read the chunk can keep its count,
+// whoever wrote it. A file's current contents, each version record and
+// each snapshot pin count as one use however many times they list the
+// chunk, and the chunk is deleted with the last one.
+type deduper struct {
+	nameKey []byte      // names a chunk by its contents
+	keyKey  []byte      // derives a chunk's keys from its contents
+	gear    [256]uint64 // the rolling hash that places chunk boundaries
+}
 
-	if _, ok := userdata.SharedFiles[filename]; ok {
-		sharedfileMacKey = userdata.SharedFiles[filename][0:16]
-		sharedfileEncKey = userdata.SharedFiles[filename][16:32]
-		// creating the sharedfileUUID to see if it exists in the datastore already
-		encryptedSharedFilename, _ := userlib.HMACEval(sharedfileMacKey, []byte("magic_string"))
-		sharedfileUUID := bytesToUUID(encryptedSharedFilename)
-		sharedfileMarshal, sharedfileOk := userlib.DatastoreGet(sharedfileUUID)
-		if sharedfileOk {
-			err := appendData(sharedfileMacKey, sharedfileEncKey, sharedfileMarshal, data, sharedfileUUID)
-			return err
+// deduper derives what the user deduplicates with from their source key,
+// so every session of theirs cuts and names chunks the same way.
+func (userdata *User) deduper() *deduper {
+	var dedup deduper
+	keys, _ := userlib.HMACEval(userdata.SourceKey, []byte(userdata.Username+"dedup"))
+	dedup.nameKey, dedup.keyKey = keys[0:16], keys[16:32]
+	for i := 0; i < len(dedup.gear); i += 8 {
+		block, _ := userlib.HMACEval(keys[32:48], []byte{byte(i)})
+		for j := 0; j < 8; j++ {
+			for _, b := range block[8*j : 8*j+8] {
+				dedup.gear[i+j] = dedup.gear[i+j]<<8 | uint64(b)
+			}
 		}
 	}
-
-	// creating the fileUUID to see if it exists in the datastore already
-	encryptedFilename, _ := userlib.HMACEval(fileMacKey, []byte(filename))
-	fileUUID := bytesToUUID(encryptedFilename)
-	fileMarshal, fileOk := userlib.DatastoreGet(fileUUID)
-	if !fileOk {
-		return errors.New("Can't append, file requested not in datastore")
-	}
-
-	// depending on if the file we want to append to is shared or not, we use different keys
-	err = appendData(fileMacKey, fileEncKey, fileMarshal, data, fileUUID)
-	return err
+	return &dedup
 }
 
-func appendData(macKeytoUse []byte, encKeytoUse []byte, fileMarshalToUse []byte, data []byte, fileUUID uuid.UUID) error {
-	var filedata FileEntry
-	json.Unmarshal(fileMarshalToUse, &filedata)
+// ref is where a chunk of a deduplicated file goes and the keys it's
+// sealed with, both from its contents and from how the file pads and
+// compresses its chunks and the size it pads them against. A chunk is
+// only shared by files that would store it at the same length, so one
+// that pads can't end up pointing at a chunk stored at its exact length.
+func (dedup *deduper) ref(data []byte, padding Padding, compression Compression, chunkSize int) chunkRef {
+	named := []byte{byte(padding), byte(compression), byte(chunkSize >> 24), byte(chunkSize >> 16), byte(chunkSize >> 8), byte(chunkSize)}
+	named = append(named, data...)
+	name, _ := userlib.HMACEval(dedup.nameKey, named)
+	key, _ := userlib.HMACEval(dedup.keyKey, named)
+	return chunkRef{Location: bytesToUUID(name), Size: len(data), Key: key[0:32]}
+}
 
-	// checking integrity of ciphertext
-	cipherTextMarshal, _ := json.Marshal(filedata.CipherText)
-	signature, _ := userlib.HMACEval(macKeytoUse, cipherTextMarshal)
-	if !userlib.HMACEqual(signature, filedata.Sigma) {
-		return errors.New("file data corrupted") // should we remove these entries from the datastore if they are corrupted?
+// cut is where the first chunk of data ends. Past a quarter of the chunk
+// size, that's the first place the rolling hash of the bytes before it has
+// its top bits clear, which comes about once in another quarter, or the
+// chunk size if that comes first. The hash only covers the 64 bytes before
+// a place, so the boundaries soon after an edit fall where they did before.
+func (dedup *deduper) cut(data []byte, chunkSize int) int {
+	least := chunkSize / 4
+	if least < 1 {
+		least = 1
 	}
+	bits := uint(0)
+	for 2<<bits <= least {
+		bits++
+	}
+	start := least - 64
+	if start < 0 {
+		start = 0
+	}
+	var hash uint64
+	for i := start; i < len(data) && i < chunkSize; i++ {
+		hash = hash<<1 + dedup.gear[data[i]]
+		if i+1 >= least && hash>>(64-bits) == 0 {
+			return i + 1
+		}
+	}
+	if len(data) < chunkSize {
+		return len(data)
+	}
+	return chunkSize
+}
 
-	// encrypt data and append new encrypted data to the cyphertext list
-	iv := userlib.RandomBytes(16)
-	filedata.CipherText = append(filedata.CipherText, userlib.SymEnc(encKeytoUse, iv, padString(data)))
-	ciphertextMarshal, _ := json.Marshal(filedata.CipherText)                    // marshalling so I can pass this into sigma
-	filedata.Sigma, _ = userlib.HMACEval(macKeytoUse, []byte(ciphertextMarshal)) // update sigma on the filedata
+// chunkCount is how many uses a deduplicated chunk has.
+type chunkCount struct {
+	Count uint64
+}
 
-	encryptedDataMarshal, _ := json.Marshal(filedata)
-	userlib.DatastoreSet(fileUUID, encryptedDataMarshal)
-	return nil
+func (count *chunkCount) encode(e *encoder) {
+	e.writeUint(count.Count, 8)
 }
 
-// This loads a file from the Datastore.
-//
-// It should give an error if the file is corrupted in any way.
+func (count *chunkCount) decode(d *decoder) {
+	count.Count = d.readUint(8)
+}
 
-/*LoadFile
-- calculate fileUUID from filename
-- return error if fileUUID not in datastore
-- we use different keys depending on if we're loading a shared or not-shared file
-- check integrity of file
-- decrypt
-*/
-func (userdata *User) LoadFile(filename string) (data []byte, err error) {
-	// generating all the necessary keys. If we store them in userdata later, we can just fetch them from userdata
-	fileEncKey, fileMacKey, sharedfileEncKey, sharedfileMacKey := generateFileKeysForDataStore(filename, userdata.Username, userdata.SourceKey)
+// countLocation is where a deduplicated chunk's count is kept and the keys
+// it's sealed with.
+func countLocation(ref chunkRef) (uuid.UUID, []byte, []byte) {
+	derived, _ := userlib.HMACEval(ref.Key[0:16], append([]byte(recordCount), ref.Location[:]...))
+	return bytesToUUID(derived[32:48]), derived[0:16], derived[16:32]
+}
 
-	if _, ok := userdata.SharedFiles[filename]; ok {
-		sharedfileMacKey = userdata.SharedFiles[filename][0:16]
-		sharedfileEncKey = userdata.SharedFiles[filename][16:32]
-		// creating the sharedfileUUID to see if it exists in the datastore already
-		encryptedSharedFilename, _ := userlib.HMACEval(sharedfileMacKey, []byte("magic_string"))
-		sharedfileUUID := bytesToUUID(encryptedSharedFilename)
-		sharedfileMarshal, sharedfileOk := userlib.DatastoreGet(sharedfileUUID)
-		if sharedfileOk {
-			decryptedFileData, err := loadData(sharedfileMacKey, sharedfileEncKey, sharedfileMarshal)
-			return decryptedFileData, err
-		}
+// loadCount reads a deduplicated chunk's count. It isn't there until
+// something has used the chunk.
+func loadCount(ref chunkRef) (uint64, bool) {
+	location, macKey, encKey := countLocation(ref)
+	entryMarshal, ok := userlib.DatastoreGet(location)
+	if !ok {
+		return 0, false
 	}
-
-	// creating the fileUUID to see if it exists in the datastore already
-	encryptedFilename, _ := userlib.HMACEval(fileMacKey, []byte(filename))
-	fileUUID := bytesToUUID(encryptedFilename)
-	fileMarshal, fileOk := userlib.DatastoreGet(fileUUID)
-	if !fileOk {
-		return nil, errors.New("Your requested file isn't in the DataStore")
+	countMarshal, err := openEntry(macKey, encKey, recordCount, location, entryMarshal)
+	var count chunkCount
+	if err != nil || decodeObject(recordCount, countMarshal, &count) != nil {
+		return 0, false
 	}
+	return count.Count, true
+}
 
-	decryptedFileData, err := loadData(fileMacKey, fileEncKey, fileMarshal)
-	return decryptedFileData, err
+func storeCount(ref chunkRef, n uint64) {
+	location, macKey, encKey := countLocation(ref)
+	countMarshal := encodeObject(recordCount, &chunkCount{n})
+	userlib.DatastoreSet(location, sealEntry(macKey, encKey, recordCount, location, countMarshal))
 }
 
-func loadData(macKeytoUse []byte, encKeytoUse []byte, fileMarshalToUse []byte) (data []byte, err error) {
-	var filedata FileEntry
-	json.Unmarshal(fileMarshalToUse, &filedata)
+// holdChunk counts one more use of a deduplicated chunk.
+func holdChunk(ref chunkRef) {
+	n, _ := loadCount(ref)
+	storeCount(ref, n+1)
+}
 
-	// checking integrity of ciphertext
-	cipherTextMarshal, _ := json.Marshal(filedata.CipherText)
-	signature, _ := userlib.HMACEval(macKeytoUse, cipherTextMarshal)
-	if !userlib.HMACEqual(signature, filedata.Sigma) {
-		return nil, errors.New("file data corrupted") // TODO: should we remove these entries from the datastore if they are corrupted?
+// releaseChunk counts one use fewer of a chunk, and deletes it if that was
+// the last. A chunk that isn't deduplicated belongs to a single file and
+// has no count, so it's deleted straight away. A deduplicated one is only
+// deleted on a count that says so; one whose count is gone or tampered
+// with is left where it is rather than risk deleting it from under
+// another file.
+func releaseChunk(ref chunkRef) {
+	if ref.Key == nil {
+		userlib.DatastoreDelete(ref.Location)
+		return
+	}
+	n, ok := loadCount(ref)
+	if !ok {
+		return
+	}
+	if n > 1 {
+		storeCount(ref, n-1)
+		return
 	}
+	location, _, _ := countLocation(ref)
+	userlib.DatastoreDelete(ref.Location)
+	userlib.DatastoreDelete(location)
+}
 
-	// decrypts each element in the list, and creates a new concatenated filedata to return
-	var decryptedFileData []byte
-	for _, slice := range filedata.CipherText {
-		decryptedSlice := userlib.SymDec(encKeytoUse, slice)
-		decryptedFileData = append(decryptedFileData, decryptedSlice...)
-		decryptedFileData = unpadString(decryptedFileData)
+// keyedChunks is the deduplicated chunks in a chunk list, once each.
+func keyedChunks(chunks []chunkRef) map[uuid.UUID]chunkRef {
+	keyed := make(map[uuid.UUID]chunkRef)
+	for _, ref := range chunks {
+		if ref.Key != nil {
+			keyed[ref.Location] = ref
+		}
 	}
-	return decryptedFileData, nil
+	return keyed
 }
 
-// You may want to define what you actually want to pass as a
-// sharingRecord to serialized/deserialize in the data store.
-type sharingRecord struct {
-	CipherText []byte
-	Sigma      []byte
+// snapshot stores the current contents as a version record and adds it to
+// the history. It's called before every change, which is what lets a
+// change replace chunk references without deleting anything itself. The
+// record is a use of the deduplicated chunks it lists.
+func (filedata *FileEntry) snapshot(fileEncKey []byte, fileMacKey []byte) {
+	record := encodeObject(objectVersion, &fileVersion{filedata.Chunks, filedata.ChunkSize, filedata.Size, filedata.Modified})
+	filedata.History = append(filedata.History, versionRef{filedata.Version, filedata.storeRecord(fileEncKey, fileMacKey, record)})
+	filedata.Version++
+	for _, ref := range keyedChunks(filedata.Chunks) {
+		filedata.pending = append(filedata.pending, ref)
+	}
 }
 
-// This creates a sharing record, which is a key pointing to something
-// in the datastore to share with the recipient.
+// loadVersion fetches a version record and checks it against the header's
+// reference to it.
+func (filedata *FileEntry) loadVersion(fileEncKey []byte, fileMacKey []byte, ref versionRef) (fileVersion, error) {
+	var version fileVersion
+	record, err := filedata.loadChunk(fileEncKey, fileMacKey, ref.Record)
+	if err != nil {
+		return version, err
+	}
+	if decodeObject(objectVersion, record, &version) != nil {
+		return version, errors.New("file data corrupted")
+	}
+	return version, nil
+}
 
-// This enables the recipient to access the encrypted file as well
-// for reading/appending.
+// check makes sure a version's chunk list adds up.
+func (version *fileVersion) check() error {
+	if !validChunks(version.Chunks, version.ChunkSize, version.Size) {
+		return errors.New("file data corrupted")
+	}
+	return nil
+}
 
-// Note that neither the recipient NOR the datastore should gain any
+// drop is called for a chunk the file stops pointing at. One written by
+// the change being made is deleted straight away, since nothing else has
+// seen it; any other still belongs to the version snapshot took, and goes
+// when prune drops that. A deduplicated chunk may be listed again, so one
+// nothing uses is only found once the header is stored.
+func (filedata *FileEntry) drop(ref chunkRef) {
+	if ref.Key != nil {
+		return
+	}
+	for i, written := range filedata.written {
+		if written.Location == ref.Location {
+			userlib.DatastoreDelete(ref.Location)
+			filedata.written = append(filedata.written[:i], filedata.written[i+1:]...)
+			return
+		}
+	}
+}
+
+// pinnedChunks is every chunk a snapshot still holds. Those belong to the
+// snapshot as much as to the file, so only DeleteSnapshot deletes them.
+func (filedata *FileEntry) pinnedChunks() map[uuid.UUID]bool {
+	pinned := make(map[uuid.UUID]bool)
+	for _, locations := range filedata.Pins {
+		for _, location := range locations {
+			pinned[location] = true
+		}
+	}
+	return pinned
+}
+
+// liveChunks is every chunk the header still points at, from the current
+// contents, a kept version or a snapshot.
+func (filedata *FileEntry) liveChunks(fileEncKey []byte, fileMacKey []byte) (map[uuid.UUID]bool, error) {
+	live := filedata.pinnedChunks()
+	for _, ref := range filedata.Chunks {
+		live[ref.Location] = true
+	}
+	for _, ref := range filedata.History {
+		version, err := filedata.loadVersion(fileEncKey, fileMacKey, ref)
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range version.Chunks {
+			live[chunk.Location] = true
+		}
+	}
+	return live, nil
+}
+
+// prune drops the versions past what the file keeps and returns what is
+// no longer used by anything, their records and the chunks only they
+// listed, for the caller to release once the new header is stored. A
+// change never reuses a chunk it replaced, so a chunk missing from the
+// next version is in no later one either; one a snapshot holds is left for
+// DeleteSnapshot. Deduplicated chunks can be listed again, so each record
+// releases its use of them instead.
+func (filedata *FileEntry) prune(fileEncKey []byte, fileMacKey []byte) []chunkRef {
+	if len(filedata.History) <= filedata.Keep {
+		return nil
+	}
+	dropped := filedata.History[:len(filedata.History)-filedata.Keep]
+	filedata.History = append([]versionRef{}, filedata.History[len(dropped):]...)
+	pinned := filedata.pinnedChunks()
+	var orphans []chunkRef
+	for i, ref := range dropped {
+		orphans = append(orphans, ref.Record)
+		// a record that won't open can't say which chunks were its own,
+		// so they're left rather than risk deleting a kept one
+		version, err := filedata.loadVersion(fileEncKey, fileMacKey, ref)
+		if err != nil {
+			continue
+		}
+		for _, chunk := range keyedChunks(version.Chunks) {
+			orphans = append(orphans, chunk)
+		}
+		var nextRef *versionRef
+		if i+1 < len(dropped) {
+			nextRef = &dropped[i+1]
+		} else if len(filedata.History) > 0 {
+			nextRef = &filedata.History[0]
+		}
+		next := filedata.Chunks
+		if nextRef != nil {
+			nextVersion, err := filedata.loadVersion(fileEncKey, fileMacKey, *nextRef)
+			if err != nil {
+				continue
+			}
+			next = nextVersion.Chunks
+		}
+		kept := make(map[uuid.UUID]bool)
+		for _, chunk := range next {
+			kept[chunk.Location] = true
+		}
+		for _, chunk := range version.Chunks {
+			if chunk.Key == nil && !kept[chunk.Location] && !pinned[chunk.Location] {
+				orphans = append(orphans, chunk)
+			}
+		}
+	}
+	return orphans
+}
+
+// appendChunks adds data to the end of a file. A last chunk that only ends
+// where the data ran out, one partly filled or any in a deduplicated file,
+// is cut again along with what's appended.
+func (filedata *FileEntry) appendChunks(fileEncKey []byte, fileMacKey []byte, data []byte) error {
+	if last := len(filedata.Chunks) - 1; last >= 0 && len(data) > 0 &&
+		(filedata.Dedup || filedata.Chunks[last].Size < filedata.ChunkSize) {
+		lastData, err := filedata.loadChunk(fileEncKey, fileMacKey, filedata.Chunks[last])
+		if err != nil {
+			return err
+		}
+		filedata.drop(filedata.Chunks[last])
+		filedata.Chunks = filedata.Chunks[:last]
+		filedata.Size -= len(lastData)
+		data = append(lastData, data...)
+	}
+	filedata.cutChunks(fileEncKey, fileMacKey, data, true)
+	return nil
+}
+
+// cutChunks stores data as new chunks at the end of the file and returns
+// what it left over. Unless final is set, a piece that only ends because
+// data does is left over for the caller to add more to.
+func (filedata *FileEntry) cutChunks(fileEncKey []byte, fileMacKey []byte, data []byte, final bool) []byte {
+	for len(data) > 0 {
+		n := len(data)
+		if filedata.Dedup && filedata.dedup != nil {
+			n = filedata.dedup.cut(data, filedata.ChunkSize)
+		} else if n > filedata.ChunkSize {
+			n = filedata.ChunkSize
+		}
+		if !final && n == len(data) && n < filedata.ChunkSize {
+			break
+		}
+		filedata.Chunks = append(filedata.Chunks, filedata.storeChunk(fileEncKey, fileMacKey, data[:n]))
+		filedata.Size += n
+		data = data[n:]
+	}
+	return data
+}
+
+// chunkAt is the index of the chunk holding byte offset of the file and
+// where that chunk starts, or the number of chunks and the size for the end
+// of the file.
+func (filedata *FileEntry) chunkAt(offset int) (int, int) {
+	if !filedata.Dedup {
+		// chunks are all the same size, so it's found directly
+		i := offset / filedata.ChunkSize
+		return i, i * filedata.ChunkSize
+	}
+	start := 0
+	for i, ref := range filedata.Chunks {
+		if offset < start+ref.Size {
+			return i, start
+		}
+		start += ref.Size
+	}
+	return len(filedata.Chunks), start
+}
+
+// writeAs readies a header for a user to write to. A deduplicated file is
+// cut and named with the writer's own keys, and the chunks written are
+// recorded in the writer's run.
+func (filedata *FileEntry) writeAs(userdata *User, handle fileHandle) {
+	filedata.run = userdata.activeRun()
+	filedata.run.touch(handle)
+	if filedata.Dedup {
+		filedata.dedup = userdata.deduper()
+	}
+}
+
+// maxFileSize is the furthest WriteAt will grow a file, so that a bad
+// offset is refused rather than filled with zeros.
+const maxFileSize = 1 << 30
+
+// growZeros fills a file with zeros up to size. The zeros are added a
+// chunk at a time, so a large gap is never held whole.
+func (filedata *FileEntry) growZeros(fileEncKey []byte, fileMacKey []byte, size int) error {
+	zeros := make([]byte, filedata.ChunkSize)
+	for filedata.Size < size {
+		n := filedata.ChunkSize - filedata.Size%filedata.ChunkSize
+		if n > size-filedata.Size {
+			n = size - filedata.Size
+		}
+		if err := filedata.appendChunks(fileEncKey, fileMacKey, zeros[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discard deletes the chunks written for a change that failed before its
+// header was stored. Nothing points at them, and the file is left as it
+// was. A deduplicated chunk is only deleted if nothing else has counted a
+// use of it since.
+func (filedata *FileEntry) discard() {
+	for _, ref := range filedata.written {
+		if ref.Key == nil || !chunkUsed(ref) {
+			userlib.DatastoreDelete(ref.Location)
+		}
+	}
+	filedata.written = nil
+}
+
+// chunkUsed is whether a deduplicated chunk has a use counted.
+func chunkUsed(ref chunkRef) bool {
+	_, ok := loadCount(ref)
+	return ok
+}
+
+// storeChunk seals one chunk of the file, compressed and padded the way
+// the file is. In a deduplicated file written by someone deduplicating,
+// the chunk goes where its contents say, and if it's already there with
+// those contents it's left as it is.
+func (filedata *FileEntry) storeChunk(fileEncKey []byte, fileMacKey []byte, data []byte) chunkRef {
+	if !filedata.Dedup || filedata.dedup == nil {
+		return filedata.storeRecord(fileEncKey, fileMacKey, data)
+	}
+	ref := filedata.dedup.ref(data, filedata.Padding, filedata.Compression, filedata.ChunkSize)
+	if record, ok := userlib.DatastoreGet(ref.Location); ok {
+		if stored, err := filedata.openChunk(fileEncKey, fileMacKey, ref, record); err == nil && string(stored) == string(data) {
+			ref.Sigma = recordTag(record)
+			return ref
+		}
+	}
+	filedata.run.noteDeduped(ref)
+	// files that compress and files that don't can share a chunk, so it
+	// always says whether it's compressed
+	packed := filedata.Compression.packChunk(data)
+	if filedata.Compression == CompressNone {
+		packed = append([]byte{chunkStored}, data...)
+	}
+	return filedata.sealChunk(ref.Key[16:32], ref.Key[0:16], ref, packed)
+}
+
+// storeRecord seals data at a fresh location under the file's own keys,
+// compressed and padded the way the file is. That's every chunk of a file
+// that isn't deduplicated, and every version record, which nothing else
+// could share. It goes where the run writing the file says.
+func (filedata *FileEntry) storeRecord(fileEncKey []byte, fileMacKey []byte, data []byte) chunkRef {
+	ref := chunkRef{Location: filedata.run.chunkLocation(), Size: len(data)}
+	return filedata.sealChunk(fileEncKey, fileMacKey, ref, filedata.Compression.packChunk(data))
+}
+
+// sealChunk pads what packChunk made of a chunk and writes it where ref
+// says.
+func (filedata *FileEntry) sealChunk(fileEncKey []byte, fileMacKey []byte, ref chunkRef, packed []byte) chunkRef {
+	// a chunk that says whether it's compressed is one byte longer
+	limit := filedata.ChunkSize
+	if filedata.Compression != CompressNone || ref.Key != nil {
+		limit++
+	}
+	padded := padTo(packed, filedata.Padding.chunkSize(len(packed), limit))
+	record := sealRecord(fileMacKey, fileEncKey, recordAD(recordChunk, ref.Location[:]), padded)
+	ref.Sigma = recordTag(record)
+	userlib.DatastoreSet(ref.Location, record)
+	filedata.written = append(filedata.written, ref)
+	return ref
+}
+
+// loadChunk fetches one chunk of the file, checks it against the header's
+// record of it and undoes any compression.
+func (filedata *FileEntry) loadChunk(fileEncKey []byte, fileMacKey []byte, ref chunkRef) ([]byte, error) {
+	record, ok := userlib.DatastoreGet(ref.Location)
+	if !ok || !userlib.HMACEqual(recordTag(record), ref.Sigma) {
+		return nil, errors.New("file data corrupted")
+	}
+	return filedata.openChunk(fileEncKey, fileMacKey, ref, record)
+}
+
+// openChunk decrypts the record of a chunk and undoes any compression. A
+// deduplicated chunk is sealed with its own keys rather than the file's.
+func (filedata *FileEntry) openChunk(fileEncKey []byte, fileMacKey []byte, ref chunkRef, record []byte) ([]byte, error) {
+	compression := filedata.Compression
+	if ref.Key != nil {
+		fileMacKey, fileEncKey, compression = ref.Key[0:16], ref.Key[16:32], CompressLZ
+	}
+	data, err := openRecord(fileMacKey, fileEncKey, recordAD(recordChunk, ref.Location[:]), record)
+	if err != nil {
+		return nil, errors.New("file data corrupted")
+	}
+	if data, err = compression.unpackChunk(data, ref.Size); err != nil || len(data) < ref.Size {
+		return nil, errors.New("file data corrupted")
+	}
+	return data[:ref.Size], nil
+}
+
+// deleteData removes a file's header and, if the header checks out, all
+// of its chunks and version records, and the chunks only those versions
+// list. Chunks a snapshot holds are left for the snapshot, along with a
+// retired header recording the pins, so DeleteSnapshot can tell when the
+// last one is released. Deduplicated chunks lose the uses the contents and
+// each version counted.
+func deleteData(fileMacKey []byte, fileEncKey []byte, fileUUID uuid.UUID) {
+	if fileMarshal, ok := userlib.DatastoreGet(fileUUID); ok {
+		if filedata, err := openHeader(fileMacKey, fileEncKey, fileUUID, fileMarshal); err == nil {
+			pinned := filedata.pinnedChunks()
+			for _, ref := range filedata.Chunks {
+				if ref.Key == nil && !pinned[ref.Location] {
+					userlib.DatastoreDelete(ref.Location)
+				}
+			}
+			for _, ref := range filedata.held {
+				releaseChunk(ref)
+			}
+			for _, ref := range filedata.History {
+				if version, err := filedata.loadVersion(fileEncKey, fileMacKey, ref); err == nil {
+					for _, chunk := range version.Chunks {
+						if chunk.Key == nil && !pinned[chunk.Location] {
+							userlib.DatastoreDelete(chunk.Location)
+						}
+					}
+					for _, chunk := range keyedChunks(version.Chunks) {
+						releaseChunk(chunk)
+					}
+				}
+				userlib.DatastoreDelete(ref.Record.Location)
+			}
+			if len(pinned) > 0 {
+				// a retired header is smaller than the one it replaces, so
+				// it always fits
+				retired := FileEntry{ChunkSize: filedata.ChunkSize, Padding: filedata.Padding, Compression: filedata.Compression, Pins: filedata.Pins, Retired: true}
+				storeFileEntry(fileMacKey, fileEncKey, fileUUID, &retired)
+				return
+			}
+		}
+	}
+	userlib.DatastoreDelete(fileUUID)
+}
+
+// openFileEntry opens the header of a file that still exists.
+func openFileEntry(macKey []byte, encKey []byte, fileUUID uuid.UUID, fileMarshal []byte) (filedata FileEntry, err error) {
+	if filedata, err = openHeader(macKey, encKey, fileUUID, fileMarshal); err != nil {
+		return filedata, err
+	}
+	if filedata.Retired {
+		return filedata, errors.New("Your requested file isn't in the DataStore")
+	}
+	return filedata, nil
+}
+
+// openHeader opens the sealed record of a FileEntry and checks that what
+// it says about the chunks adds up.
+func openHeader(macKey []byte, encKey []byte, fileUUID uuid.UUID, fileMarshal []byte) (filedata FileEntry, err error) {
+	headerMarshal, err := openRecord(macKey, encKey, recordAD(recordHeader, fileUUID[:]), fileMarshal)
+	if err != nil {
+		return filedata, errors.New("file data corrupted") // TODO: should we remove these entries from the datastore if they are corrupted?
+	}
+	// a padded header ends in zeros: after the envelope, which says how
+	// long it is, or after JSON, which never ends in one
+	if len(headerMarshal) > 0 && headerMarshal[0] != binaryMarker {
+		headerMarshal = []byte(strings.TrimRight(string(headerMarshal), "\x00"))
+	}
+	object, padding := readStoredObject(headerMarshal)
+	if strings.Trim(string(padding), "\x00") != "" {
+		return filedata, errors.New("file data corrupted")
+	}
+	if err := migrateObject(recordHeader, object, &filedata); err != nil {
+		return filedata, errors.New("file data corrupted")
+	}
+	filedata.held = keyedChunks(filedata.Chunks)
+	return filedata, nil
+}
+
+// check makes sure what a header says about the chunks adds up, and that
+// the versions it keeps are in order and each has a record to load.
+func (filedata *FileEntry) check() error {
+	if filedata.Padding > PadFullChunks || filedata.Compression > CompressLZ || filedata.Version < 0 || filedata.Keep < 0 || filedata.Keep > maxKeepVersions ||
+		!validChunks(filedata.Chunks, filedata.ChunkSize, filedata.Size) {
+		return errors.New("file data corrupted")
+	}
+	// only a deduplicated file's chunks are laid out by their contents
+	for _, ref := range filedata.Chunks {
+		if ref.Key != nil && !filedata.Dedup {
+			return errors.New("file data corrupted")
+		}
+	}
+	previous := -1
+	for _, ref := range filedata.History {
+		if ref.Version <= previous || ref.Version >= filedata.Version ||
+			ref.Record.Size <= 0 || len(ref.Record.Sigma) != userlib.HashSize || ref.Record.Key != nil {
+			return errors.New("file data corrupted")
+		}
+		previous = ref.Version
+	}
+	return nil
+}
+
+// validChunks checks that a chunk list is laid out the way appendChunks
+// writes it: every chunk full but the last, except that a deduplicated one
+// ends where its contents say, adding up to size.
+func validChunks(chunks []chunkRef, chunkSize int, size int) bool {
+	if chunkSize <= 0 || chunkSize > maxChunkSize {
+		return false
+	}
+	total := 0
+	for i, ref := range chunks {
+		if ref.Size <= 0 || ref.Size > chunkSize || (ref.Key == nil && i < len(chunks)-1 && ref.Size != chunkSize) ||
+			len(ref.Sigma) != userlib.HashSize || !(ref.Key == nil || len(ref.Key) == 32) {
+			return false
+		}
+		total += ref.Size
+	}
+	return total == size
+}
+
+// This creates a user.  It will only be called once for a user
+// (unless the keystore and datastore are cleared during testing purposes)
+
+// It should store a copy of the userdata, suitably encrypted, in the
+// datastore and should store the user's public key in the keystore.
+
+// The datastore may corrupt or completely erase the stored
+// information, but nobody outside should be able to get at the stored
+// User data: the name used in the datastore should not be guessable
+// without also knowing the password and username.
+
+// You are not allowed to use any global storage other than the
+// keystore and the datastore functions in the userlib library.
+
+// You can assume the user has a STRONG password
+
+/*InitUser
+- Derive sourceKey = Argon2Key(password, username, 16)
+- k1 = HMACEval(sourceKey, username)
+- k2 = HMACEval(sourceKey, 1 + username)
+- Generate public/private keys using PKEKeyGen() and DSKeyGen()
+
+- userUUID = bytesToUUID(HMACEval(k1, username))
+- Determine if this UUID is already in the dataStore, if so, return
+
+- Create new User struct
+- Populate User with RSA_sk, DS_sk, and map[sharedfileUUID] = k6||k7
+- This map[sharedfileUUID, your_version_of_filename] = k6||k7 will be a list of all files for which you have access to but are not an owner
+- userEntry = sealRecord(k1, k2, recordAD("user", userUUID), userdata)
+- datastore[userUUID] = userEntry
+
+- keystore[username||"enc"] = RSA_pk
+- keystore[username||"sig"] = DS_pk
+
+- return userdata (is this safe) */
+func InitUser(username string, password string) (userdataptr *User, err error) {
+	var userdata User
+	userdataptr = &userdata
+
+	sourceKey := userlib.Argon2Key([]byte(password), []byte(username), 16)
+	hmacKey, symKey := generateKeysForDataStore(username, sourceKey, []byte(username), []byte(username+"1"))
+
+	// check if username already exists
+	filename, _ := userlib.HMACEval(hmacKey, []byte(username))
+	userUUID := bytesToUUID(filename)
+	if _, ok := userlib.KeystoreGet(username + "enc"); ok {
+		// if a user with the same username exists, return an error
+		return nil, errors.New("Username already exists")
+	}
+
+	// generate RSA encryption keys
+	rsaPk, rsaSk, _ := userlib.PKEKeyGen()
+	userlib.KeystoreSet(username+"enc", rsaPk)
+
+	// generate RSA signature keys
+	dsSk, dsPk, _ := userlib.DSKeyGen()
+	userlib.KeystoreSet(username+"sig", dsPk)
+
+	// initialize User struct
+	userdataptr.Username = username
+	userdataptr.SourceKey = sourceKey
+	userdataptr.HmacKey = hmacKey
+	userdataptr.SymKey = symKey
+	userdataptr.UserUUID = userUUID
+	userdataptr.RsaSk = rsaSk
+	userdataptr.DsSk = dsSk
+	userdataptr.SharedFiles = make(map[string]SharedFile)
+	userdataptr.ListOfOwnedFiles = make(map[string]bool)
+	userdataptr.UsedNonces = make(map[string]map[string]int64)
+	userdataptr.Grants = make(map[string][]AccessGrant)
+	userdataptr.SeenVersions = make(map[string]uint64)
+	userdataptr.KeepVersions = defaultKeepVersions
+	userdataptr.Snapshots = make(map[string]bool)
+
+	// encrypt and store userdata in the datastore
+	userdataptr.storeUser()
+
+	return &userdata, nil
+}
+
+// storeUser encrypts the user struct and writes it to userUUID, so that
+// the next GetUser sees whatever this session changed.
+func (userdata *User) storeUser() {
+	userdataMarshal := encodeObject(recordUser, userdata)
+	ad := recordAD(recordUser, userdata.UserUUID[:])
+	userlib.DatastoreSet(userdata.UserUUID, sealRecord(userdata.HmacKey, userdata.SymKey, ad, userdataMarshal))
+}
+
+func generateKeysForDataStore(username string, sourceKey []byte, hmacKeySalt []byte, encKeySalt []byte) ([]byte, []byte) {
+	hmacKey, _ := userlib.HMACEval(sourceKey, []byte(hmacKeySalt))
+	encKey, _ := userlib.HMACEval(sourceKey, []byte(encKeySalt))
+	return hmacKey[0:16], encKey[0:16]
+}
+
+// recordVersion is the layout of every sealed record. It's part of the
+// associated data, so a record can't be read under a layout it wasn't
+// written in.
+const recordVersion = 1
+
+// The kinds of object a record can hold. The kind is part of the
+// associated data, so a record of one kind can't be passed off as another.
+const (
+	recordUser     = "user"
+	recordChunk    = "chunk"
+	recordHeader   = "header"
+	recordNode     = "node"
+	recordGroup    = "group"
+	recordSnapshot = "snapshot"
+	recordEnvelope = "envelope"
+	recordCount    = "count"
+	recordJournal  = "journal"
+	recordDeduped  = "deduped"
+)
+
+// recordAD is the associated data a record is sealed with: the layout
+// version, the kind of object and what identifies it, usually the UUID it
+// is stored at.
+func recordAD(kind string, id []byte) []byte {
+	ad := []byte{recordVersion, byte(len(kind))}
+	ad = append(ad, kind...)
+	return append(ad, id...)
+}
+
+// sealRecord encrypts and authenticates plaintext in a single record,
+// IV || ciphertext || HMAC(macKey, len(ad) || ad || IV || ciphertext).
+// SymEnc over zero blocks gives a keystream that the plaintext is XORed
+// with, so nothing needs padding and the ciphertext is exactly as long as
+// the plaintext.
+func sealRecord(macKey []byte, encKey []byte, ad []byte, plaintext []byte) []byte {
+	iv := userlib.RandomBytes(userlib.AESBlockSize)
+	record := append([]byte{}, iv...)
+	record = append(record, xorKeystream(encKey, iv, plaintext)...)
+	tag, _ := userlib.HMACEval(macKey, recordSigned(ad, record))
+	return append(record, tag...)
+}
+
+// openRecord checks a record's tag against ad and decrypts it. The tag is
+// checked before anything is decrypted, and a record too short to hold an
+// IV and a tag is an error rather than a panic.
+func openRecord(macKey []byte, encKey []byte, ad []byte, record []byte) ([]byte, error) {
+	if len(record) < userlib.AESBlockSize+userlib.HashSize || len(record) > maxObjectSize {
+		return nil, errors.New("data corrupted")
+	}
+	body, tag := record[:len(record)-userlib.HashSize], record[len(record)-userlib.HashSize:]
+	signature, _ := userlib.HMACEval(macKey, recordSigned(ad, body))
+	if !userlib.HMACEqual(signature, tag) {
+		return nil, errors.New("data corrupted")
+	}
+	return xorKeystream(encKey, body[:userlib.AESBlockSize], body[userlib.AESBlockSize:]), nil
+}
+
+// recordTag is the tag a sealed record ends with.
+func recordTag(record []byte) []byte {
+	if len(record) < userlib.HashSize {
+		return nil
+	}
+	return record[len(record)-userlib.HashSize:]
+}
+
+func recordSigned(ad []byte, body []byte) []byte {
+	signed := []byte{byte(len(ad) >> 24), byte(len(ad) >> 16), byte(len(ad) >> 8), byte(len(ad))}
+	signed = append(signed, ad...)
+	return append(signed, body...)
+}
+
+// maxObjectSize bounds anything read back from the datastore or handed
+// over as a sharing record, so a forged object can't make us allocate or
+// decode without limit. A header that would seal to more is refused
+// rather than stored.
+const maxObjectSize = 64 << 20
+
+// maxChunkSize is the largest chunk size SetChunkSize allows: a full chunk
+// still seals to a record of at most maxObjectSize.
+const maxChunkSize = maxObjectSize - userlib.AESBlockSize - userlib.HashSize
+
+// checked is implemented by the stored types decoding can vet beyond
+// their shape, so that code using a decoded object can slice its keys and
+// trust its sizes without checking them again.
+type checked interface {
+	check() error
+}
+
+// decodeJSON is json.Unmarshal for bytes we didn't just produce ourselves.
+// It refuses oversized input, fields the type doesn't have and anything
+// after the value, then has the value check itself.
+func decodeJSON(data []byte, v interface{}) error {
+	if len(data) > maxObjectSize {
+		return errors.New("object too large")
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(data[decoder.InputOffset():])) != "" {
+		return errors.New("trailing data after object")
+	}
+	if c, ok := v.(checked); ok {
+		return c.check()
+	}
+	return nil
+}
+
+// storedObject is the envelope every object we persist or sign is written
+// in: what kind of object it is, the schema its body follows, and the body.
+// It always sits inside a sealed record or under a signature, so the
+// schema a reader migrates from is one the writer vouched for.
+type storedObject struct {
+	Kind   string
+	Schema int
+	Object json.RawMessage
+}
+
+// An envelope in the binary encoding starts with a zero byte, which JSON
+// never does, so one can be told from an envelope or bare object written
+// in JSON.
+const binaryMarker = 0
+
+// The kinds of object that are kept inside another one or signed rather
+// than sealed as records of their own. Those that are records use their
+// record kind.
+const (
+	objectDirectory = "directory"
+	objectGrant     = "grant"
+	objectPayload   = "sharing"
+	objectShare     = "share"
+	objectTransfer  = "transfer"
+	objectVersion   = "version"
+)
+
+// migration turns the body of an object written in one schema into the
+// next.
+type migration func(body []byte) ([]byte, error)
+
+// firstBinarySchema is the schema objects were first written in binary.
+// Schema 0 is the bare JSON written before objects had an envelope and
+// schema 1 is JSON in one; either decodes straight into the current layout
+// of a type, fields it didn't have yet left at their zero values.
+const firstBinarySchema = 2
+
+// migrations lists, for each kind of object, the steps that bring a binary
+// body up to date: migrations[kind][n] turns schema firstBinarySchema+n
+// into the one after it. A change to the layout of a kind appends a step
+// here; older objects are upgraded as they are read and written back in
+// the new schema the next time they are stored.
+var migrations = map[string][]migration{
+	recordUser:     {appendByte(byte(CompressNone)), appendByte(0)},
+	recordHeader:   {appendByte(byte(CompressNone)), relayout(keyedHeaderSchema-1, func() binaryObject { return &FileEntry{} })},
+	recordSnapshot: {relayout(keyedSnapshotSchema-1, func() binaryObject { return &snapshot{} })},
+	objectVersion:  {relayout(keyedVersionSchema-1, func() binaryObject { return &fileVersion{} })},
+}
+
+// currentSchema is the schema objects of a kind are written in now.
+func currentSchema(kind string) int {
+	return firstBinarySchema + len(migrations[kind])
+}
+
+// appendByte is the step for a layout that gained a one-byte field at the
+// end, which older objects get with the value given.
+func appendByte(value byte) migration {
+	return func(body []byte) ([]byte, error) {
+		return append(body[:len(body):len(body)], value), nil
+	}
+}
+
+// relayout is the step for a layout that changed other than at the end.
+// The type's decode method reads the old layout, going by the schema it's
+// given, and the object is written again in the new one.
+func relayout(schema int, object func() binaryObject) migration {
+	return func(body []byte) ([]byte, error) {
+		v := object()
+		d := decoder{data: body, schema: schema}
+		v.decode(&d)
+		if err := d.finish(); err != nil {
+			return nil, err
+		}
+		var e encoder
+		v.encode(&e)
+		return e.buf, nil
+	}
+}
+
+// encodeObject writes v in the envelope for its kind, in the current
+// schema.
+func encodeObject(kind string, v binaryObject) []byte {
+	var body encoder
+	v.encode(&body)
+	var e encoder
+	e.writeUint(binaryMarker, 1)
+	e.writeString(kind)
+	e.writeUint(uint64(currentSchema(kind)), 4)
+	e.writeBytes(body.buf)
+	return e.buf
+}
+
+// readStoredObject reads the envelope at the start of data, in whichever
+// encoding it was written, and returns it with whatever follows it.
+func readStoredObject(data []byte) (object storedObject, rest []byte) {
+	if len(data) == 0 || data[0] != binaryMarker {
+		if err := decodeJSON(data, &object); err != nil || object.Kind == "" {
+			// written before objects had an envelope
+			object = storedObject{"", 0, data}
+		}
+		return object, nil
+	}
+	d := decoder{data: data[1:]}
+	object.Kind = d.readString()
+	object.Schema = int(d.readUint(4))
+	object.Object = d.readBytes()
+	if d.err != nil {
+		return storedObject{}, nil
+	}
+	return object, d.data
+}
+
+// decodeObject opens the envelope of an object of the given kind, runs
+// whatever migrations its schema needs and decodes the result into v. Only
+// call it on bytes that have already been authenticated.
+func decodeObject(kind string, data []byte, v binaryObject) error {
+	object, rest := readStoredObject(data)
+	if len(rest) > 0 {
+		return errors.New("trailing data after object")
+	}
+	return migrateObject(kind, object, v)
+}
+
+func migrateObject(kind string, object storedObject, v binaryObject) error {
+	if object.Kind == "" && object.Schema == 0 {
+		object.Kind = kind
+	}
+	if object.Kind != kind || object.Object == nil {
+		return errors.New("object is of the wrong kind")
+	}
+	if object.Schema < 0 || object.Schema > currentSchema(kind) {
+		return errors.New("object was written by a newer version")
+	}
+	if object.Schema < firstBinarySchema {
+		// the JSON was authenticated with its envelope and may hold fields
+		// later layouts dropped, so it's decoded as leniently as it was
+		// once written
+		if err := json.Unmarshal(object.Object, v); err != nil {
+			return err
+		}
+	} else {
+		body := []byte(object.Object)
+		for _, step := range migrations[kind][object.Schema-firstBinarySchema:] {
+			var err error
+			if body, err = step(body); err != nil {
+				return err
+			}
+		}
+		d := decoder{data: body, schema: currentSchema(kind)}
+		v.decode(&d)
+		if err := d.finish(); err != nil {
+			return err
+		}
+	}
+	if c, ok := v.(checked); ok {
+		return c.check()
+	}
+	return nil
+}
+
+// binaryObject is implemented by everything encodeObject writes. decode
+// reads the fields back in the order encode wrote them.
+type binaryObject interface {
+	encode(e *encoder)
+	decode(d *decoder)
+}
+
+// encoder writes the binary encoding objects are stored and signed in.
+// Fields go in a fixed order, integers at a fixed width, everything of
+// variable length after its length and maps in key order, so a value has
+// exactly one encoding and what is MACed or signed doesn't depend on how
+// a library chose to print it.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) writeUint(v uint64, size int) {
+	for i := size - 1; i >= 0; i-- {
+		e.buf = append(e.buf, byte(v>>(8*uint(i))))
+	}
+}
+
+func (e *encoder) writeInt(v int64) {
+	e.writeUint(uint64(v), 8)
+}
+
+func (e *encoder) writeCount(n int) {
+	e.writeUint(uint64(n), 4)
+}
+
+func (e *encoder) writeBool(v bool) {
+	if v {
+		e.writeUint(1, 1)
+	} else {
+		e.writeUint(0, 1)
+	}
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.writeCount(len(b))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) writeString(s string) {
+	e.writeCount(len(s))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) writeUUID(id uuid.UUID) {
+	e.buf = append(e.buf, id[:]...)
+}
+
+func (e *encoder) writeStrings(list []string) {
+	e.writeCount(len(list))
+	for _, s := range list {
+		e.writeString(s)
+	}
+}
+
+// writeSet writes the keys of a map[string]bool whose values are all
+// true, which is how every such map here is used.
+func (e *encoder) writeSet(set map[string]bool) {
+	e.writeStrings(sortedKeys(set))
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key, ok := range set {
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	sortStrings(keys)
+	return keys
+}
+
+// decoder reads what encoder wrote. The first problem it meets sticks and
+// every read after it returns a zero value, so a decode method can read
+// all of its fields and leave the caller to check once.
+type decoder struct {
+	data   []byte
+	err    error
+	schema int // of the object being read, for the types whose layout it changes
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errors.New("malformed object")
+	}
+	d.data = nil
+}
+
+// finish is the error, if any, from decoding a whole object, which must
+// have used up all of the data.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.fail()
+	}
+	return d.err
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.data) {
+		d.fail()
+		return nil
+	}
+	taken := d.data[:n]
+	d.data = d.data[n:]
+	return taken
+}
+
+func (d *decoder) readUint(size int) uint64 {
+	var v uint64
+	for _, b := range d.take(size) {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func (d *decoder) readInt() int64 {
+	return int64(d.readUint(8))
+}
+
+// readCount reads how many of something follow. Nothing is encoded in
+// less than a byte, so a count larger than what is left is a forgery, and
+// refusing it keeps us from allocating for elements that aren't there.
+func (d *decoder) readCount() int {
+	n := d.readUint(4)
+	if n > uint64(len(d.data)) {
+		d.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) readBool() bool {
+	v := d.readUint(1)
+	if v > 1 {
+		d.fail()
+	}
+	return v == 1
+}
+
+func (d *decoder) readBytes() []byte {
+	b := d.take(d.readCount())
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (d *decoder) readString() string {
+	return string(d.take(d.readCount()))
+}
+
+func (d *decoder) readUUID() (id uuid.UUID) {
+	copy(id[:], d.take(16))
+	return id
+}
+
+func (d *decoder) readStrings() []string {
+	var list []string
+	for i, n := 0, d.readCount(); i < n; i++ {
+		list = append(list, d.readString())
+	}
+	return list
+}
+
+func (d *decoder) readSet() map[string]bool {
+	set := make(map[string]bool)
+	for _, key := range d.readKeys() {
+		set[key] = true
+	}
+	return set
+}
+
+// readKeys reads the keys of a map, which encoder writes in order, and
+// fails on any out of order or repeated.
+func (d *decoder) readKeys() []string {
+	keys := d.readStrings()
+	for i := 1; i < len(keys); i++ {
+		if keys[i] <= keys[i-1] {
+			d.fail()
+		}
+	}
+	return keys
+}
+
+func xorKeystream(encKey []byte, iv []byte, data []byte) []byte {
+	blocks := (len(data) + userlib.AESBlockSize - 1) / userlib.AESBlockSize
+	stream := userlib.SymEnc(encKey, iv, make([]byte, blocks*userlib.AESBlockSize))[userlib.AESBlockSize:]
+	out := make([]byte, len(data))
+	for i := range data {
+		out[i] = data[i] ^ stream[i]
+	}
+	return out
+}
+
+// This fetches the user information from the Datastore.  It should
+// fail with an error if the user/password is invalid, or if the user
+// data was corrupted, or if the user can't be found.
+
+/*GetUser
+- Derive sourceKey = Argon2Key(password, username, 16)
+- k1 = HMACEval(sourceKey, username)
+- k2 = HMACEval(sourceKey, 1 + username)
+- userUUID = bytesToUUID(HMACEval(k1, username))
+
+- Check if userUUID is in the datastore. If not, return error
+- a userUUID won't exist if the username or password is wrong
+- get the userEntry at userUUID
+- openRecord(k1, k2, recordAD("user", userUUID), userEntry)
+- If the tag doesn't verify, return error
+*/
+func GetUser(username string, password string) (userdataptr *User, err error) {
+	var userdata User
+	userdataptr = &userdata
+	sourceKey := userlib.Argon2Key([]byte(password), []byte(username), 16)
+	hmacKey, symKey := generateKeysForDataStore(username, sourceKey, []byte(username), []byte(username+"1"))
+	filename, _ := userlib.HMACEval(hmacKey[0:16], []byte(username))
+	userUUID := bytesToUUID(filename)
+	marshalData, ok := userlib.DatastoreGet(userUUID)
+	_, usernameOk := userlib.KeystoreGet(username + "enc")
+	if !ok || !usernameOk {
+		return nil, errors.New("The username doesn't exist or wrong password")
+	}
+	if err := openUserEntry(hmacKey, symKey, userUUID, marshalData, userdataptr); err != nil {
+		return nil, err
+	}
+	return userdataptr, nil
+}
+
+func openUserEntry(hmacKey []byte, symKey []byte, userUUID uuid.UUID, marshalData []byte, userdataptr *User) error {
+	userdataMarshal, err := openRecord(hmacKey, symKey, recordAD(recordUser, userUUID[:]), marshalData)
+	if err != nil {
+		return err
+	}
+	// a user stored before versions were kept has the default
+	userdataptr.KeepVersions = defaultKeepVersions
+	if err := decodeObject(recordUser, userdataMarshal, userdataptr); err != nil {
+		return errors.New("data corrupted")
+	}
+	if userdataptr.SharedFiles == nil {
+		userdataptr.SharedFiles = make(map[string]SharedFile)
+	}
+	if userdataptr.ListOfOwnedFiles == nil {
+		userdataptr.ListOfOwnedFiles = make(map[string]bool)
+	}
+	if userdataptr.UsedNonces == nil {
+		userdataptr.UsedNonces = make(map[string]map[string]int64)
+	}
+	if userdataptr.Grants == nil {
+		userdataptr.Grants = make(map[string][]AccessGrant)
+	}
+	if userdataptr.SeenVersions == nil {
+		userdataptr.SeenVersions = make(map[string]uint64)
+	}
+	if userdataptr.Snapshots == nil {
+		userdataptr.Snapshots = make(map[string]bool)
+	}
+	return nil
+}
+
+// check makes sure a user entry holds keys of the right length and type,
+// settings in range, and that each name it has can be opened one way or
+// the other.
+func (userdata *User) check() error {
+	if len(userdata.SourceKey) != 16 || len(userdata.HmacKey) != 16 || len(userdata.SymKey) != 16 ||
+		userdata.RsaSk.KeyType != "PKE" || userdata.DsSk.KeyType != "DS" || userdata.Padding > PadFullChunks ||
+		userdata.Compression > CompressLZ || userdata.ChunkSize < 0 || userdata.ChunkSize > maxChunkSize ||
+		userdata.KeepVersions < 0 || userdata.KeepVersions > maxKeepVersions {
+		return errors.New("data corrupted")
+	}
+	for _, entry := range userdata.SharedFiles {
+		if !(len(entry.Root) == 16 || (entry.Root == nil && len(entry.NodeKeys) == 32)) {
+			return errors.New("data corrupted")
+		}
+	}
+	for _, grants := range userdata.Grants {
+		for _, grant := range grants {
+			if len(grant.NodeKeys) != 32 {
+				return errors.New("data corrupted")
+			}
+		}
+	}
+	return nil
+}
+
+func (userdata *User) encode(e *encoder) {
+	e.writeString(userdata.Username)
+	e.writeBytes(userdata.SourceKey)
+	e.writeBytes(userdata.HmacKey)
+	e.writeBytes(userdata.SymKey)
+	e.writeUUID(userdata.UserUUID)
+	// userlib's keys can't be rebuilt from their parts without importing
+	// math/big, so they stay in the JSON it marshals them to
+	rsaSk, _ := json.Marshal(userdata.RsaSk)
+	dsSk, _ := json.Marshal(userdata.DsSk)
+	e.writeBytes(rsaSk)
+	e.writeBytes(dsSk)
+	names := make([]string, 0, len(userdata.SharedFiles))
+	for name := range userdata.SharedFiles {
+		names = append(names, name)
+	}
+	sortStrings(names)
+	e.writeStrings(names)
+	for _, name := range names {
+		entry := userdata.SharedFiles[name]
+		entry.encode(e)
+	}
+	e.writeSet(userdata.ListOfOwnedFiles)
+	writeUsedNonces(e, userdata.UsedNonces)
+	e.writeInt(userdata.Issued)
+	names = names[:0]
+	for name := range userdata.Grants {
+		names = append(names, name)
+	}
+	sortStrings(names)
+	e.writeStrings(names)
+	for _, name := range names {
+		writeAccessGrants(e, userdata.Grants[name])
+	}
+	names = names[:0]
+	for location := range userdata.SeenVersions {
+		names = append(names, location)
+	}
+	sortStrings(names)
+	e.writeStrings(names)
+	for _, location := range names {
+		e.writeUint(userdata.SeenVersions[location], 8)
+	}
+	e.writeInt(int64(userdata.ChunkSize))
+	e.writeInt(int64(userdata.KeepVersions))
+	e.writeUint(uint64(userdata.Padding), 1)
+	e.writeSet(userdata.Snapshots)
+	e.writeUint(uint64(userdata.Compression), 1)
+	e.writeBool(userdata.Dedup)
+}
+
+func (userdata *User) decode(d *decoder) {
+	userdata.Username = d.readString()
+	userdata.SourceKey = d.readBytes()
+	userdata.HmacKey = d.readBytes()
+	userdata.SymKey = d.readBytes()
+	userdata.UserUUID = d.readUUID()
+	if json.Unmarshal(d.readBytes(), &userdata.RsaSk) != nil || json.Unmarshal(d.readBytes(), &userdata.DsSk) != nil {
+		d.fail()
+	}
+	userdata.SharedFiles = make(map[string]SharedFile)
+	for _, name := range d.readKeys() {
+		var entry SharedFile
+		entry.decode(d)
+		userdata.SharedFiles[name] = entry
+	}
+	userdata.ListOfOwnedFiles = d.readSet()
+	userdata.UsedNonces = readUsedNonces(d)
+	userdata.Issued = d.readInt()
+	userdata.Grants = make(map[string][]AccessGrant)
+	for _, name := range d.readKeys() {
+		userdata.Grants[name] = readAccessGrants(d)
+	}
+	userdata.SeenVersions = make(map[string]uint64)
+	for _, location := range d.readKeys() {
+		userdata.SeenVersions[location] = d.readUint(8)
+	}
+	userdata.ChunkSize = int(d.readInt())
+	userdata.KeepVersions = int(d.readInt())
+	userdata.Padding = Padding(d.readUint(1))
+	userdata.Snapshots = d.readSet()
+	userdata.Compression = Compression(d.readUint(1))
+	userdata.Dedup = d.readBool()
+}
+
+func writeUsedNonces(e *encoder, used map[string]map[string]int64) {
+	senders := make(map[string]bool)
+	for sender := range used {
+		senders[sender] = true
+	}
+	e.writeSet(senders)
+	for _, sender := range sortedKeys(senders) {
+		nonces := make(map[string]bool)
+		for nonce := range used[sender] {
+			nonces[nonce] = true
+		}
+		e.writeSet(nonces)
+		for _, nonce := range sortedKeys(nonces) {
+			e.writeInt(used[sender][nonce])
+		}
+	}
+}
+
+func readUsedNonces(d *decoder) map[string]map[string]int64 {
+	used := make(map[string]map[string]int64)
+	for _, sender := range d.readKeys() {
+		used[sender] = make(map[string]int64)
+		for _, nonce := range d.readKeys() {
+			used[sender][nonce] = d.readInt()
+		}
+	}
+	return used
+}
+
+// SetClock gives the session a source of the current unix time, which
+// this package has no way to read for itself. Files are stamped with it;
+// without one, they're stamped zero.
+func (userdata *User) SetClock(now func() int64) {
+	userdata.clock = now
+}
+
+func (userdata *User) now() int64 {
+	if userdata.clock == nil {
+		return 0
+	}
+	return userdata.clock()
+}
+
+// SetChunkSize chooses the size of the chunks the files the user creates
+// from now on are split into. Files that already exist keep the chunk size
+// they were created with.
+func (userdata *User) SetChunkSize(size int) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	if size <= 0 || size > maxChunkSize {
+		return errors.New("invalid chunk size")
+	}
+	userdata.ChunkSize = size
+	userdata.storeUser()
+	return nil
+}
+
+// SetKeepVersions chooses how many earlier versions are kept of the files
+// the user creates from now on. Files that already exist keep as many as
+// they were created with, whoever writes to them.
+func (userdata *User) SetKeepVersions(keep int) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	if keep < 0 || keep > maxKeepVersions {
+		return errors.New("invalid number of versions to keep")
+	}
+	userdata.KeepVersions = keep
+	userdata.storeUser()
+	return nil
+}
+
+// SetPadding chooses how the files the user creates from now on are padded.
+// Files that already exist keep the padding they were created with.
+func (userdata *User) SetPadding(padding Padding) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	if padding > PadFullChunks {
+		return errors.New("unknown padding")
+	}
+	userdata.Padding = padding
+	userdata.storeUser()
+	return nil
+}
+
+// SetCompression chooses how the files the user creates from now on are
+// compressed. Files that already exist keep the compression they were
+// created with.
+func (userdata *User) SetCompression(compression Compression) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	if compression > CompressLZ {
+		return errors.New("unknown compression")
+	}
+	userdata.Compression = compression
+	userdata.storeUser()
+	return nil
+}
+
+// SetDedup chooses whether the files the user creates from now on are
+// deduplicated. Files that already exist keep the setting they were
+// created with.
+func (userdata *User) SetDedup(dedup bool) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	userdata.Dedup = dedup
+	userdata.storeUser()
+	return nil
+}
+
+// fileOptions is how a user stores the files they create.
+type fileOptions struct {
+	chunkSize   int
+	padding     Padding
+	compression Compression
+	keep        int      // the earlier versions the files keep
+	modified    int64    // the time the files are stamped with
+	dedup       *deduper // nil unless the files are deduplicated
+	run         *run     // what the chunks written are recorded in
+}
+
+func (userdata *User) fileOptions() fileOptions {
+	options := fileOptions{chunkSize: userdata.ChunkSize, padding: userdata.Padding, compression: userdata.Compression, keep: userdata.KeepVersions, modified: userdata.now(), run: userdata.activeRun()}
+	if options.chunkSize == 0 {
+		options.chunkSize = defaultChunkSize
+	}
+	if userdata.Dedup {
+		options.dedup = userdata.deduper()
+	}
+	return options
+}
+
+// syncUser picks up whatever other sessions of the same user have stored
+// since this one was loaded. Every change a session makes is written back
+// with storeUser straight away, so the copy in the datastore is never
+// behind this one.
+func (userdata *User) syncUser() error {
+	marshalData, ok := userlib.DatastoreGet(userdata.UserUUID)
+	if !ok {
+		return errors.New("data corrupted")
+	}
+	var latest User
+	if err := openUserEntry(userdata.HmacKey, userdata.SymKey, userdata.UserUUID, marshalData, &latest); err != nil {
+		return err
+	}
+	if latest.Username != userdata.Username {
+		return errors.New("data corrupted")
+	}
+	userdata.SharedFiles = latest.SharedFiles
+	userdata.ListOfOwnedFiles = latest.ListOfOwnedFiles
+	userdata.UsedNonces = latest.UsedNonces
+	userdata.Issued = latest.Issued
+	userdata.ChunkSize = latest.ChunkSize
+	userdata.KeepVersions = latest.KeepVersions
+	userdata.Padding = latest.Padding
+	userdata.Grants = latest.Grants
+	userdata.SeenVersions = latest.SeenVersions
+	userdata.Snapshots = latest.Snapshots
+	userdata.Compression = latest.Compression
+	userdata.Dedup = latest.Dedup
+	return nil
+}
+
+// This stores a file in the datastore.
+//
+// The name of the file should NOT be revealed to the datastore!
+// edge case, storing a file that's already stored
+
+/*StoreFile
+- If the user already has a file called filename, return (the old contents are kept)
+- root = RandomBytes(16), kept in userdata.SharedFiles[filename]
+- k7||k6 = sharedFileKeys(root, username)
+- sharedfileUUID = bytesToUUID(HMAC(k7, "magic_string"))
+
+- create fileData struct
+- populate fileData with the chunk list
+- each chunk = sealRecord(k7, k6, recordAD("chunk", chunkUUID), chunk of data)
+
+- store datastore[sharedfileUUID] = sealRecord(k7, k6, recordAD("header", sharedfileUUID), fileData)
+- The file lives at the same place whether or not it's ever shared
+- The filename is only the user's own handle for it and can be changed freely
+- A path like "dir/file" stores the file inside one of the user's directories instead
+*/
+func (userdata *User) StoreFile(filename string, data []byte) {
+	if err := userdata.syncUser(); err != nil {
+		return
+	}
+	defer userdata.settle()
+	userdata.storeFile(filename, data)
+}
+
+func (userdata *User) storeFile(filename string, data []byte) {
+	handle, root, err := userdata.placeFile(filename)
+	if err != nil {
+		// This implementation assumes calling StoreFile on an existing filename doesn't update it
+		return
+	}
+	userdata.activeRun().addFile(handle)
+	if err := handle.store(data, userdata.fileOptions()); err != nil {
+		return
+	}
+	userdata.linkFile(filename, handle, root)
+}
+
+// placeFile picks where a new file at path is to be stored and the keys
+// that open it, without adding it to the user's names yet. root is the
+// key root of a top-level name, and nil for one in a directory.
+func (userdata *User) placeFile(path string) (fileHandle, []byte, error) {
+	parts, err := splitPath(path)
+	if err != nil {
+		return fileHandle{}, nil, err
+	}
+	if len(parts) > 1 {
+		if err := userdata.checkWritable(path); err != nil {
+			return fileHandle{}, nil, err
+		}
+		_, dir, err := userdata.openParent(parts)
+		if err != nil {
+			return fileHandle{}, nil, err
+		}
+		if _, ok := dir.Children[parts[len(parts)-1]]; ok {
+			return fileHandle{}, nil, errors.New("a file with that name already exists")
+		}
+		return newFileHandle(false), nil, nil
+	}
+	if _, ok := userdata.SharedFiles[path]; ok {
+		return fileHandle{}, nil, errors.New("a file with that name already exists")
+	}
+	root := userlib.RandomBytes(16)
+	keys := sharedFileKeys(root, userdata.Username)
+	hashedFilename, _ := userlib.HMACEval(keys[0:16], []byte("magic_string"))
+	return fileHandle{false, bytesToUUID(hashedFilename), keys}, root, nil
+}
+
+// linkFile adds a file stored where placeFile said to the user's names.
+func (userdata *User) linkFile(path string, handle fileHandle, root []byte) error {
+	parts, err := splitPath(path)
+	if err != nil {
+		return err
+	}
+	if len(parts) > 1 {
+		parent, dir, err := userdata.openParent(parts)
+		if err != nil {
+			return err
+		}
+		if _, ok := dir.Children[parts[len(parts)-1]]; ok {
+			return errors.New("a file with that name already exists")
+		}
+		dir.Children[parts[len(parts)-1]] = handle
+		return userdata.storeDirectory(parent, dir)
+	}
+
+	var entry SharedFile
+	entry.Root = root
+	entry.Permissions = permAll
+	entry.Custody = []string{userdata.Username}
+	userdata.SharedFiles[path] = entry
+	userdata.ListOfOwnedFiles[path] = true
+	userdata.storeUser()
+	return nil
+}
+
+func storeData(fileEncKey []byte, data []byte, fileMacKey []byte, hashedFilename []byte, username string, options fileOptions) error {
+	var encryptedData FileEntry
+	fileUUID := bytesToUUID(hashedFilename)
+	deleteData(fileMacKey, fileEncKey, fileUUID)
+	encryptedData.ChunkSize = options.chunkSize
+	encryptedData.Padding = options.padding
+	encryptedData.Compression = options.compression
+	encryptedData.Modified = options.modified
+	encryptedData.Keep = options.keep
+	encryptedData.Dedup = options.dedup != nil
+	encryptedData.dedup = options.dedup
+	encryptedData.run = options.run
+	options.run.touch(fileHandle{Location: fileUUID, Keys: append(append([]byte{}, fileMacKey...), fileEncKey...)})
+	encryptedData.appendChunks(fileEncKey, fileMacKey, data)
+	return storeFileEntry(fileMacKey, fileEncKey, fileUUID, &encryptedData)
+}
+
+// storeFileEntry seals a header for its UUID, padded to the file's bucket,
+// and writes it. Versions past what the file keeps are dropped first, and
+// the chunks only they used are released once the header no longer points
+// at them. A header too large to be read back isn't written: the chunks
+// written for the change are discarded and the file is left as it was.
+//
+// The uses of deduplicated chunks the new header makes are counted before
+// it's written and those it stops making after, so a count is never short
+// of what the datastore points at.
+func storeFileEntry(fileMacKey []byte, fileEncKey []byte, fileUUID uuid.UUID, filedata *FileEntry) error {
+	orphans := filedata.prune(fileEncKey, fileMacKey)
+	headerMarshal := encodeObject(recordHeader, filedata)
+	if filedata.Padding != PadNone {
+		headerMarshal = padTo(headerMarshal, filedata.Padding.headerSize(filedata.fullLength(len(headerMarshal))))
+	}
+	record := sealRecord(fileMacKey, fileEncKey, recordAD(recordHeader, fileUUID[:]), headerMarshal)
+	if len(record) > maxObjectSize {
+		filedata.discard()
+		return errors.New("file too large")
+	}
+	current := keyedChunks(filedata.Chunks)
+	for location, ref := range current {
+		if _, ok := filedata.held[location]; !ok {
+			holdChunk(ref)
+		}
+	}
+	for _, ref := range filedata.pending {
+		holdChunk(ref)
+	}
+	userlib.DatastoreSet(fileUUID, record)
+	for location, ref := range filedata.held {
+		if _, ok := current[location]; !ok {
+			releaseChunk(ref)
+		}
+	}
+	for _, ref := range orphans {
+		releaseChunk(ref)
+	}
+	// a deduplicated chunk the change wrote and then cut again may be
+	// listed nowhere
+	for _, ref := range filedata.written {
+		if ref.Key != nil && !chunkUsed(ref) {
+			userlib.DatastoreDelete(ref.Location)
+		}
+	}
+	filedata.written = nil
+	filedata.held = current
+	filedata.pending = nil
+	return nil
+}
+
+// fullLength is how long a header of n bytes would be with a full history:
+// as many versions as the file keeps, each as long as the longest of the
+// ones it holds and the one the current contents would make. Padding to
+// that rather than to n keeps the number of versions, and so of appends,
+// out of the stored size.
+func (filedata *FileEntry) fullLength(n int) int {
+	record := encodeObject(objectVersion, &fileVersion{filedata.Chunks, filedata.ChunkSize, filedata.Size, filedata.Modified})
+	longest := versionRefLength(versionRef{filedata.Version, chunkRef{Size: len(record), Sigma: make([]byte, userlib.HashSize)}})
+	for _, ref := range filedata.History {
+		length := versionRefLength(ref)
+		n -= length
+		if length > longest {
+			longest = length
+		}
+	}
+	slots := filedata.Keep
+	if len(filedata.History) > slots {
+		slots = len(filedata.History)
+	}
+	return n + slots*longest
+}
+
+// versionRefLength is how much of a header one version in its history
+// takes up.
+func versionRefLength(ref versionRef) int {
+	var e encoder
+	writeVersionRef(&e, ref)
+	return len(e.buf)
+}
+
+// fileLocation returns the sharedfileUUID of one of the user's files and
+// the k7||k6 that open it.
+func (userdata *User) fileLocation(filename string) (uuid.UUID, []byte, error) {
+	if _, ok := userdata.SharedFiles[filename]; !ok {
+		return uuid.Nil, nil, errors.New("Your requested file isn't in the DataStore")
+	}
+	return userdata.sharedHandle(filename)
+}
+
+// fileHandle is where a file or directory lives and the keys that open
+// it. Top-level names get theirs from the user's SharedFiles; anything in
+// a directory gets them from the directory.
+type fileHandle struct {
+	Dir      bool
+	Location uuid.UUID
+	Keys     []byte // fileMacKey || fileEncKey
+}
+
+func newFileHandle(dir bool) fileHandle {
+	var handle fileHandle
+	handle.Dir = dir
+	handle.Location = uuid.New()
+	handle.Keys = userlib.RandomBytes(32)
+	return handle
+}
+
+func (handle fileHandle) store(data []byte, options fileOptions) error {
+	return storeData(handle.Keys[16:32], data, handle.Keys[0:16], handle.Location[:], "", options)
+}
+
+// move gives what a handle points at a new handle and fresh keys. A file
+// takes its history with it; a directory takes everything in it.
+func (handle fileHandle) move(options fileOptions) (fileHandle, error) {
+	moved := newFileHandle(handle.Dir)
+	if !handle.Dir {
+		return moved, moveFileEntry(handle.Keys, handle.Location, moved.Keys, moved.Location, options.run)
+	}
+	data, err := handle.load()
+	if err != nil {
+		return moved, err
+	}
+	if data, err = rekeyChildren(data, options); err != nil {
+		return moved, err
+	}
+	options.run.addMove(handle, moved)
+	deleteData(handle.Keys[0:16], handle.Keys[16:32], handle.Location)
+	return moved, moved.store(data, options)
+}
+
+func (handle fileHandle) load() ([]byte, error) {
+	fileMarshal, ok := userlib.DatastoreGet(handle.Location)
+	if !ok {
+		return nil, errors.New("Your requested file isn't in the DataStore")
+	}
+	return loadData(handle.Keys[0:16], handle.Keys[16:32], handle.Location, fileMarshal)
+}
+
+// locate walks a path from one of the user's top-level names down through
+// its directories.
+func (userdata *User) locate(path string) (fileHandle, error) {
+	parts, err := splitPath(path)
+	if err != nil {
+		return fileHandle{}, err
+	}
+	fileUUID, keys, err := userdata.fileLocation(parts[0])
+	if err != nil {
+		return fileHandle{}, err
+	}
+	handle := fileHandle{userdata.SharedFiles[parts[0]].Dir, fileUUID, keys}
+	for _, name := range parts[1:] {
+		if !handle.Dir {
+			return fileHandle{}, errors.New("not a directory")
+		}
+		dir, err := userdata.loadDirectory(handle)
+		if err != nil {
+			return fileHandle{}, err
+		}
+		child, ok := dir.Children[name]
+		if !ok {
+			return fileHandle{}, errors.New("Your requested file isn't in the DataStore")
+		}
+		handle = child
+	}
+	return handle, nil
+}
+
+func splitPath(path string) ([]string, error) {
+	parts := strings.Split(path, "/")
+	for _, part := range parts {
+		if part == "" {
+			return nil, errors.New("invalid path")
+		}
+	}
+	return parts, nil
+}
+
+// This adds on to an existing file.
+//
+// Append should be efficient, you shouldn't rewrite or reencrypt the
+// existing file, but only whatever additional information and
+// metadata you need.
+
+/*AppendFile
+- Find sharedfileUUID for filename in datastore (return error if not found)
+- Validate fileEntry for integrity
+- Add the new encrypted data to the list of ciphertexts and recompute the HMAC signature
+*/
+func (userdata *User) AppendFile(filename string, data []byte) (err error) {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	if err := userdata.checkWritable(filename); err != nil {
+		return err
+	}
+	handle, err := userdata.locate(filename)
+	if err != nil {
+		return err
+	}
+	if handle.Dir {
+		return errors.New("is a directory")
+	}
+	fileMarshal, fileOk := userlib.DatastoreGet(handle.Location)
+	if !fileOk {
+		return errors.New("Can't append, file requested not in datastore")
+	}
+	return appendData(handle.Keys[0:16], handle.Keys[16:32], fileMarshal, data, handle.Location, userdata)
+}
+
+func appendData(macKeytoUse []byte, encKeytoUse []byte, fileMarshalToUse []byte, data []byte, fileUUID uuid.UUID, writer *User) error {
+	// checking integrity of ciphertext
+	filedata, err := openFileEntry(macKeytoUse, encKeytoUse, fileUUID, fileMarshalToUse)
+	if err != nil {
+		return err
+	}
+	filedata.writeAs(writer, fileHandle{Location: fileUUID, Keys: append(append([]byte{}, macKeytoUse...), encKeytoUse...)})
+
+	// encrypt data into new chunks, only the last chunk and the header are rewritten
+	filedata.snapshot(encKeytoUse, macKeytoUse)
+	if err := filedata.appendChunks(encKeytoUse, macKeytoUse, data); err != nil {
+		filedata.discard()
+		return err
+	}
+	filedata.Modified = writer.now()
+	return storeFileEntry(macKeytoUse, encKeytoUse, fileUUID, &filedata) // update sigma on the filedata
+}
+
+// This loads a file from the Datastore.
+//
+// It should give an error if the file is corrupted in any way.
+
+/*LoadFile
+- find the keys and sharedfileUUID for filename
+- return error if sharedfileUUID not in datastore
+- check integrity of file
+- decrypt
+*/
+func (userdata *User) LoadFile(filename string) (data []byte, err error) {
+	if err := userdata.syncUser(); err != nil {
+		return nil, err
+	}
+	handle, err := userdata.locate(filename)
+	if err != nil {
+		return nil, err
+	}
+	if handle.Dir {
+		return nil, errors.New("is a directory")
+	}
+	return handle.load()
+}
+
+// loadFile returns what is stored under a top-level name, which for a
+// directory is the marshalled directory.
+func (userdata *User) loadFile(filename string) (data []byte, err error) {
+	fileUUID, keys, err := userdata.fileLocation(filename)
+	if err != nil {
+		return nil, err
+	}
+	fileMarshal, fileOk := userlib.DatastoreGet(fileUUID)
+	if !fileOk {
+		return nil, errors.New("Your requested file isn't in the DataStore")
+	}
+	return loadData(keys[0:16], keys[16:32], fileUUID, fileMarshal)
+}
+
+func loadData(macKeytoUse []byte, encKeytoUse []byte, fileUUID uuid.UUID, fileMarshalToUse []byte) (data []byte, err error) {
+	// checking integrity of ciphertext
+	filedata, err := openFileEntry(macKeytoUse, encKeytoUse, fileUUID, fileMarshalToUse)
+	if err != nil {
+		return nil, err
+	}
+
+	// decrypts each chunk in the list, and creates a new concatenated filedata to return
+	var decryptedFileData []byte
+	for _, ref := range filedata.Chunks {
+		decryptedSlice, err := filedata.loadChunk(encKeytoUse, macKeytoUse, ref)
+		if err != nil {
+			return nil, err
+		}
+		decryptedFileData = append(decryptedFileData, decryptedSlice...)
+	}
+	return decryptedFileData, nil
+}
+
+// WriteAt overwrites part of a file with data, starting at offset. Only
+// the chunks the write touches are re-encrypted. Writing past the end
+// grows the file, up to maxFileSize, and a gap between the old end and
+// offset reads as zeros. The file is unchanged unless the whole write
+// succeeds.
+func (userdata *User) WriteAt(filename string, offset int, data []byte) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	if err := userdata.checkWritable(filename); err != nil {
+		return err
+	}
+	if offset < 0 || offset > maxFileSize || len(data) > maxFileSize-offset {
+		return errors.New("range is outside the file")
+	}
+	handle, err := userdata.locate(filename)
+	if err != nil {
+		return err
+	}
+	if handle.Dir {
+		return errors.New("is a directory")
+	}
+	fileMarshal, ok := userlib.DatastoreGet(handle.Location)
+	if !ok {
+		return errors.New("Your requested file isn't in the DataStore")
+	}
+	filedata, err := openFileEntry(handle.Keys[0:16], handle.Keys[16:32], handle.Location, fileMarshal)
+	if err != nil {
+		return err
+	}
+	filedata.writeAs(userdata, handle)
+	filedata.snapshot(handle.Keys[16:32], handle.Keys[0:16])
+	if err := filedata.writeAt(handle.Keys[16:32], handle.Keys[0:16], offset, data); err != nil {
+		filedata.discard()
+		return err
+	}
+	filedata.Modified = userdata.now()
+	return storeFileEntry(handle.Keys[0:16], handle.Keys[16:32], handle.Location, &filedata)
+}
+
+func (filedata *FileEntry) writeAt(fileEncKey []byte, fileMacKey []byte, offset int, data []byte) error {
+	if offset > filedata.Size {
+		if err := filedata.growZeros(fileEncKey, fileMacKey, offset); err != nil {
+			return err
+		}
+	}
+	// patch the chunks that already exist, each one is replaced whole
+	for len(data) > 0 && offset < filedata.Size {
+		i, start := filedata.chunkAt(offset)
+		chunk, err := filedata.loadChunk(fileEncKey, fileMacKey, filedata.Chunks[i])
+		if err != nil {
+			return err
+		}
+		n := copy(chunk[offset-start:], data)
+		filedata.drop(filedata.Chunks[i])
+		filedata.Chunks[i] = filedata.storeChunk(fileEncKey, fileMacKey, chunk)
+		offset += n
+		data = data[n:]
+	}
+	return filedata.appendChunks(fileEncKey, fileMacKey, data)
+}
+
+// Truncate changes the length of a file to size. Chunks past the new end
+// are dropped and the chunk the end now falls in is re-encrypted, shorter;
+// the old ones are deleted once no kept version uses them.
+// Growing a file fills it with zeros, up to maxFileSize.
+func (userdata *User) Truncate(filename string, size int) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	if err := userdata.checkWritable(filename); err != nil {
+		return err
+	}
+	if size < 0 || size > maxFileSize {
+		return errors.New("range is outside the file")
+	}
+	handle, err := userdata.locate(filename)
+	if err != nil {
+		return err
+	}
+	if handle.Dir {
+		return errors.New("is a directory")
+	}
+	fileMarshal, ok := userlib.DatastoreGet(handle.Location)
+	if !ok {
+		return errors.New("Your requested file isn't in the DataStore")
+	}
+	filedata, err := openFileEntry(handle.Keys[0:16], handle.Keys[16:32], handle.Location, fileMarshal)
+	if err != nil {
+		return err
+	}
+	filedata.writeAs(userdata, handle)
+	filedata.snapshot(handle.Keys[16:32], handle.Keys[0:16])
+	if err := filedata.truncate(handle.Keys[16:32], handle.Keys[0:16], size); err != nil {
+		filedata.discard()
+		return err
+	}
+	filedata.Modified = userdata.now()
+	return storeFileEntry(handle.Keys[0:16], handle.Keys[16:32], handle.Location, &filedata)
+}
+
+func (filedata *FileEntry) truncate(fileEncKey []byte, fileMacKey []byte, size int) error {
+	if size >= filedata.Size {
+		return filedata.growZeros(fileEncKey, fileMacKey, size)
+	}
+	keep, start := filedata.chunkAt(size)
+	tail := size - start
+	if tail != 0 {
+		keep++
+	}
+	for _, ref := range filedata.Chunks[keep:] {
+		filedata.drop(ref)
+	}
+	filedata.Chunks = filedata.Chunks[:keep]
+	filedata.Size = size
+	if tail != 0 && filedata.Chunks[keep-1].Size != tail {
+		chunk, err := filedata.loadChunk(fileEncKey, fileMacKey, filedata.Chunks[keep-1])
+		if err != nil {
+			return err
+		}
+		filedata.drop(filedata.Chunks[keep-1])
+		filedata.Chunks[keep-1] = filedata.storeChunk(fileEncKey, fileMacKey, chunk[:tail])
+	}
+	return nil
+}
+
+// CopyFile makes dst a copy of src under its own keys. The chunks are
+// decrypted and re-encrypted one at a time, so the plaintext never has
+// to be held whole, and the copy shares nothing with the original unless
+// both are deduplicated. dst only appears once the whole copy is stored.
+func (userdata *User) CopyFile(src string, dst string) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	if err := userdata.checkWritable(dst); err != nil {
+		return err
+	}
+	source, err := userdata.locate(src)
+	if err != nil {
+		return err
+	}
+	if source.Dir {
+		return errors.New("is a directory")
+	}
+	if _, err := userdata.locate(dst); err == nil {
+		return errors.New("a file with the new name already exists")
+	}
+	fileMarshal, ok := userlib.DatastoreGet(source.Location)
+	if !ok {
+		return errors.New("Your requested file isn't in the DataStore")
+	}
+	filedata, err := openFileEntry(source.Keys[0:16], source.Keys[16:32], source.Location, fileMarshal)
+	if err != nil {
+		return err
+	}
+	target, root, err := userdata.placeFile(dst)
+	if err != nil {
+		return err
+	}
+	options := userdata.fileOptions()
+	copied := FileEntry{ChunkSize: filedata.ChunkSize, Modified: options.modified, Keep: options.keep, Padding: options.padding, Compression: options.compression,
+		Dedup: options.dedup != nil, dedup: options.dedup, run: options.run}
+	options.run.addFile(target)
+	options.run.touch(target)
+	// the copy is cut afresh, as the original may be laid out differently
+	var pending []byte
+	for _, ref := range filedata.Chunks {
+		chunk, err := filedata.loadChunk(source.Keys[16:32], source.Keys[0:16], ref)
+		if err != nil {
+			copied.discard()
+			return err
+		}
+		pending = copied.cutChunks(target.Keys[16:32], target.Keys[0:16], append(pending, chunk...), false)
+	}
+	copied.cutChunks(target.Keys[16:32], target.Keys[0:16], pending, true)
+	if err := storeFileEntry(target.Keys[0:16], target.Keys[16:32], target.Location, &copied); err != nil {
+		return err
+	}
+	if err := userdata.linkFile(dst, target, root); err != nil {
+		deleteData(target.Keys[0:16], target.Keys[16:32], target.Location)
+		return err
+	}
+	return nil
+}
+
+// VersionInfo describes one version of a file, as ListVersions reports it.
+type VersionInfo struct {
+	Version  int
+	Size     int
+	Chunks   int
+	Modified int64 // unix time, zero if the session that changed it had no clock
+	Current  bool  // the file's contents now, rather than a kept version
+}
+
+// openFile finds one of the user's files and opens its header.
+func (userdata *User) openFile(filename string) (fileHandle, FileEntry, error) {
+	handle, err := userdata.locate(filename)
+	if err != nil {
+		return handle, FileEntry{}, err
+	}
+	if handle.Dir {
+		return handle, FileEntry{}, errors.New("is a directory")
+	}
+	fileMarshal, ok := userlib.DatastoreGet(handle.Location)
+	if !ok {
+		return handle, FileEntry{}, errors.New("Your requested file isn't in the DataStore")
+	}
+	filedata, err := openFileEntry(handle.Keys[0:16], handle.Keys[16:32], handle.Location, fileMarshal)
+	return handle, filedata, err
+}
+
+// findVersion returns version v of a file, which may be the current one.
+func (filedata *FileEntry) findVersion(fileEncKey []byte, fileMacKey []byte, v int) (fileVersion, error) {
+	if v == filedata.Version {
+		return fileVersion{filedata.Chunks, filedata.ChunkSize, filedata.Size, filedata.Modified}, nil
+	}
+	for _, ref := range filedata.History {
+		if ref.Version == v {
+			return filedata.loadVersion(fileEncKey, fileMacKey, ref)
+		}
+	}
+	return fileVersion{}, errors.New("no such version")
+}
+
+// ListVersions returns the versions of a file that are still kept, oldest
+// first, ending with the current one.
+func (userdata *User) ListVersions(filename string) ([]VersionInfo, error) {
+	if err := userdata.syncUser(); err != nil {
+		return nil, err
+	}
+	handle, filedata, err := userdata.openFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var versions []VersionInfo
+	for _, ref := range filedata.History {
+		version, err := filedata.loadVersion(handle.Keys[16:32], handle.Keys[0:16], ref)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, VersionInfo{ref.Version, version.Size, len(version.Chunks), version.Modified, false})
+	}
+	versions = append(versions, VersionInfo{filedata.Version, filedata.Size, len(filedata.Chunks), filedata.Modified, true})
+	return versions, nil
+}
+
+// LoadFileVersion returns a file's contents as they were at version v.
+func (userdata *User) LoadFileVersion(filename string, v int) ([]byte, error) {
+	if err := userdata.syncUser(); err != nil {
+		return nil, err
+	}
+	handle, filedata, err := userdata.openFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	version, err := filedata.findVersion(handle.Keys[16:32], handle.Keys[0:16], v)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for _, ref := range version.Chunks {
+		chunk, err := filedata.loadChunk(handle.Keys[16:32], handle.Keys[0:16], ref)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// RestoreVersion makes version v the file's contents again. The restore is
+// itself a change, so what it replaces is kept as a version too. The
+// restored data is written to new chunks, so no chunk is ever listed again
+// once a change has replaced it.
+func (userdata *User) RestoreVersion(filename string, v int) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	if err := userdata.checkWritable(filename); err != nil {
+		return err
+	}
+	handle, filedata, err := userdata.openFile(filename)
+	if err != nil {
+		return err
+	}
+	version, err := filedata.findVersion(handle.Keys[16:32], handle.Keys[0:16], v)
+	if err != nil {
+		return err
+	}
+	if v == filedata.Version {
+		return nil
+	}
+	filedata.writeAs(userdata, handle)
+	filedata.snapshot(handle.Keys[16:32], handle.Keys[0:16])
+	filedata.Chunks = nil
+	filedata.ChunkSize = version.ChunkSize
+	filedata.Size = 0
+	for _, ref := range version.Chunks {
+		chunk, err := filedata.loadChunk(handle.Keys[16:32], handle.Keys[0:16], ref)
+		if err != nil {
+			filedata.discard()
+			return err
+		}
+		filedata.Chunks = append(filedata.Chunks, filedata.storeChunk(handle.Keys[16:32], handle.Keys[0:16], chunk))
+		filedata.Size += len(chunk)
+	}
+	filedata.Modified = userdata.now()
+	return storeFileEntry(handle.Keys[0:16], handle.Keys[16:32], handle.Location, &filedata)
+}
+
+// LoadFileRange returns length bytes of a file starting at offset. Only
+// the chunks covering the range are fetched and decrypted, and each is
+// checked against the file's MACed chunk list.
+func (userdata *User) LoadFileRange(filename string, offset int, length int) (data []byte, err error) {
+	if err := userdata.syncUser(); err != nil {
+		return nil, err
+	}
+	handle, err := userdata.locate(filename)
+	if err != nil {
+		return nil, err
+	}
+	if handle.Dir {
+		return nil, errors.New("is a directory")
+	}
+	fileMarshal, ok := userlib.DatastoreGet(handle.Location)
+	if !ok {
+		return nil, errors.New("Your requested file isn't in the DataStore")
+	}
+	return loadDataRange(handle.Keys[0:16], handle.Keys[16:32], handle.Location, fileMarshal, offset, length)
+}
+
+func loadDataRange(macKeytoUse []byte, encKeytoUse []byte, fileUUID uuid.UUID, fileMarshalToUse []byte, offset int, length int) ([]byte, error) {
+	filedata, err := openFileEntry(macKeytoUse, encKeytoUse, fileUUID, fileMarshalToUse)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || length < 0 || offset > filedata.Size || length > filedata.Size-offset {
+		return nil, errors.New("range is outside the file")
+	}
+
+	first, start := filedata.chunkAt(offset)
+	data := make([]byte, 0, length)
+	for i := first; len(data) < length; i++ {
+		chunk, err := filedata.loadChunk(encKeytoUse, macKeytoUse, filedata.Chunks[i])
+		if err != nil {
+			return nil, err
+		}
+		from := 0
+		if i == first {
+			from = offset - start
+		}
+		to := len(chunk)
+		if remaining := length - len(data); to-from > remaining {
+			to = from + remaining
+		}
+		data = append(data, chunk[from:to]...)
+	}
+	return data, nil
+}
+
+// Reader, Writer and Closer have the methods of their namesakes in the io
+// package, which OpenReader and OpenWriter would return if the package
+// could import it. They aren't io.Reader and io.WriteCloser all the same:
+// the end of a file is this package's EOF rather than io.EOF, so helpers
+// such as io.ReadAll and io.Copy see it as an error. Callers read until
+// EOF themselves, or wrap the reader to translate it.
+type Reader interface {
+	Read(p []byte) (n int, err error)
+}
+
+type Writer interface {
+	Write(p []byte) (n int, err error)
+}
+
+type Closer interface {
+	Close() error
+}
+
+type ReadCloser interface {
+	Reader
+	Closer
+}
+
+type WriteCloser interface {
+	Writer
+	Closer
+}
+
+// EOF is what a Reader returns once it has read the whole file.
+var EOF = errors.New("EOF")
+
+// fileReader reads a file one chunk at a time. The header, and with it the
+// list of chunks, is checked when the reader is opened; each chunk is
+// checked as it is reached.
+type fileReader struct {
+	fileEncKey []byte
+	fileMacKey []byte
+	filedata   FileEntry
+	chunks     []chunkRef
+	buf        []byte
+	err        error
+}
+
+// OpenReader returns a reader over the contents of a file that keeps no
+// more than one chunk of it in memory. A tampered chunk fails the read
+// that reaches it.
+func (userdata *User) OpenReader(filename string) (ReadCloser, error) {
+	if err := userdata.syncUser(); err != nil {
+		return nil, err
+	}
+	handle, err := userdata.locate(filename)
+	if err != nil {
+		return nil, err
+	}
+	if handle.Dir {
+		return nil, errors.New("is a directory")
+	}
+	fileMarshal, ok := userlib.DatastoreGet(handle.Location)
+	if !ok {
+		return nil, errors.New("Your requested file isn't in the DataStore")
+	}
+	filedata, err := openFileEntry(handle.Keys[0:16], handle.Keys[16:32], handle.Location, fileMarshal)
+	if err != nil {
+		return nil, err
+	}
+	return &fileReader{fileEncKey: handle.Keys[16:32], fileMacKey: handle.Keys[0:16], filedata: filedata, chunks: filedata.Chunks}, nil
+}
+
+func (reader *fileReader) Read(p []byte) (int, error) {
+	for len(reader.buf) == 0 {
+		if reader.err != nil {
+			return 0, reader.err
+		}
+		if len(reader.chunks) == 0 {
+			return 0, EOF
+		}
+		reader.buf, reader.err = reader.filedata.loadChunk(reader.fileEncKey, reader.fileMacKey, reader.chunks[0])
+		reader.chunks = reader.chunks[1:]
+	}
+	n := copy(p, reader.buf)
+	reader.buf = reader.buf[n:]
+	return n, nil
+}
+
+func (reader *fileReader) Close() error {
+	reader.chunks = nil
+	reader.buf = nil
+	reader.err = errors.New("reader is closed")
+	return nil
+}
+
+// fileWriter stores what is written to it as new chunks. The file's header
+// only changes on Close, so readers see either the old contents or all of
+// the new ones.
+type fileWriter struct {
+	userdata *User
+	handle   fileHandle
+	filedata FileEntry
+	buf      []byte
+	closed   bool
+}
+
+// OpenWriter returns a writer that replaces the contents of a file, which
+// is created first if the user doesn't have it yet. Data is encrypted and
+// stored a chunk at a time as it's written; Close commits it.
+func (userdata *User) OpenWriter(filename string) (WriteCloser, error) {
+	if err := userdata.syncUser(); err != nil {
+		return nil, err
+	}
+	defer userdata.settle()
+	if err := userdata.checkWritable(filename); err != nil {
+		return nil, err
+	}
+	handle, err := userdata.locate(filename)
+	if err != nil {
+		userdata.storeFile(filename, nil)
+		if handle, err = userdata.locate(filename); err != nil {
+			return nil, err
+		}
+	}
+	if handle.Dir {
+		return nil, errors.New("is a directory")
+	}
+	fileMarshal, ok := userlib.DatastoreGet(handle.Location)
+	if !ok {
+		return nil, errors.New("Your requested file isn't in the DataStore")
+	}
+	existing, err := openFileEntry(handle.Keys[0:16], handle.Keys[16:32], handle.Location, fileMarshal)
+	if err != nil {
+		return nil, err
+	}
+	// the file keeps its chunk size, padding, compression and whether it's
+	// deduplicated, whoever is writing it
+	writer := &fileWriter{userdata: userdata, handle: handle}
+	writer.filedata.ChunkSize = existing.ChunkSize
+	writer.filedata.Padding = existing.Padding
+	writer.filedata.Compression = existing.Compression
+	writer.filedata.Dedup = existing.Dedup
+	writer.filedata.writeAs(userdata, handle)
+	// the writer's run lasts until it's closed
+	userdata.active = nil
+	return writer, nil
+}
+
+func (writer *fileWriter) Write(p []byte) (int, error) {
+	if writer.closed {
+		return 0, errors.New("writer is closed")
+	}
+	writer.buf = append(writer.buf, p...)
+	if len(writer.buf) >= writer.filedata.ChunkSize {
+		rest := writer.filedata.cutChunks(writer.handle.Keys[16:32], writer.handle.Keys[0:16], writer.buf, false)
+		writer.buf = append([]byte{}, rest...)
+	}
+	return len(p), nil
+}
+
+func (writer *fileWriter) Close() error {
+	if writer.closed {
+		return errors.New("writer is closed")
+	}
+	writer.closed = true
+	r := writer.filedata.run
+	defer r.settle()
+	writer.filedata.cutChunks(writer.handle.Keys[16:32], writer.handle.Keys[0:16], writer.buf, true)
+	writer.buf = nil
+	// garbage collection can't tell a writer still open from one that
+	// never will be, so it may have deleted what this one wrote
+	if r.collected() {
+		writer.filedata.discard()
+		return errors.New("the chunks written were collected as garbage")
+	}
+	fileMarshal, ok := userlib.DatastoreGet(writer.handle.Location)
+	if !ok {
+		writer.filedata.discard()
+		return errors.New("Your requested file isn't in the DataStore")
+	}
+	// the old contents become a version of the file
+	filedata, err := openFileEntry(writer.handle.Keys[0:16], writer.handle.Keys[16:32], writer.handle.Location, fileMarshal)
+	if err != nil {
+		writer.filedata.discard()
+		return err
+	}
+	filedata.written = writer.filedata.written
+	filedata.run = r
+	filedata.snapshot(writer.handle.Keys[16:32], writer.handle.Keys[0:16])
+	filedata.Chunks = writer.filedata.Chunks
+	filedata.Size = writer.filedata.Size
+	filedata.Modified = writer.userdata.now()
+	return storeFileEntry(writer.handle.Keys[0:16], writer.handle.Keys[16:32], writer.handle.Location, &filedata)
+}
+
+// You may want to define what you actually want to pass as a
+// sharingRecord to serialized/deserialize in the data store.
+type sharingRecord struct {
+	Payload []byte // marshalled sharingPayload
+	Sigma   []byte // DSSign(sender's private key, Payload)
+}
+
+// sharingPayload is everything the sender signs. Binding the sender, the
+// recipient and the body into the signed bytes means a record can't be
+// re-signed by someone else or accepted by anyone but the named recipient,
+// and the nonce lets the recipient refuse a record it has already used.
+//
+// IssuedAt counts the records the sender has issued, this one included.
+// A recipient accepts a record only within nonceWindow of the newest it
+// has seen from the sender, so it only has to remember the nonces of
+// records in that window.
+//
+// A record shared with a group has no body. It names the group share, and
+// each member finds their own record in a slot derived from ShareID.
+type sharingPayload struct {
+	Sender    string
+	Recipient string
+	Body      hybridEnvelope // sharingBody sealed for the recipient
+	Group     string
+	ShareID   uuid.UUID
+	Transfer  bool  // the body is a transferBody handing over ownership
+	IssuedAt  int64 // the sender's count of records issued
+	Nonce     []byte
+}
+
+// sharingBody is the part of a sharing record only the recipient can read.
+type sharingBody struct {
+	FileUUID uuid.UUID // sharedfileUUID the node currently opens
+	Node     uuid.UUID
+	NodeKeys []byte        // nodeMacKey || nodeEncKey
+	Chain    []signedGrant // owner's grant first, the sender's grant to the recipient last
+	Dir      bool          // the share is a whole directory
+}
+
+func (payload *sharingPayload) encode(e *encoder) {
+	e.writeString(payload.Sender)
+	e.writeString(payload.Recipient)
+	e.writeBytes(payload.Body.WrappedKeys)
+	e.writeBytes(payload.Body.CipherText)
+	e.writeString(payload.Group)
+	e.writeUUID(payload.ShareID)
+	e.writeBool(payload.Transfer)
+	e.writeInt(payload.IssuedAt)
+	e.writeBytes(payload.Nonce)
+}
+
+func (payload *sharingPayload) decode(d *decoder) {
+	payload.Sender = d.readString()
+	payload.Recipient = d.readString()
+	payload.Body.WrappedKeys = d.readBytes()
+	payload.Body.CipherText = d.readBytes()
+	payload.Group = d.readString()
+	payload.ShareID = d.readUUID()
+	payload.Transfer = d.readBool()
+	payload.IssuedAt = d.readInt()
+	payload.Nonce = d.readBytes()
+}
+
+func (body *sharingBody) encode(e *encoder) {
+	e.writeUUID(body.FileUUID)
+	e.writeUUID(body.Node)
+	e.writeBytes(body.NodeKeys)
+	writeSignedGrants(e, body.Chain)
+	e.writeBool(body.Dir)
+}
+
+func (body *sharingBody) decode(d *decoder) {
+	body.FileUUID = d.readUUID()
+	body.Node = d.readUUID()
+	body.NodeKeys = d.readBytes()
+	body.Chain = readSignedGrants(d)
+	body.Dir = d.readBool()
+}
+
+// nonceWindow is how many more records a sender can issue before an
+// earlier one of theirs is no longer accepted.
+const nonceWindow = 1024
+
+// permissions a sharing record can grant
+const (
+	permRead uint8 = 1 << iota
+	permWrite
+	permShare // may pass the file on to others
+
+	permAll = permRead | permWrite | permShare
+)
+
+// shareGrant is one hop of a share: the issuer lets the recipient use the
+// node with the given permissions. A recipient only accepts a share whose
+// hops lead back, signature by signature, to the owner of the file, so a
+// holder without permShare has nothing valid to hand on.
+type shareGrant struct {
+	Issuer      string
+	Recipient   string
+	Node        uuid.UUID
+	Permissions uint8
+}
+
+type signedGrant struct {
+	Grant []byte // marshalled shareGrant
+	Sigma []byte // DSSign(issuer's private key, Grant)
+}
+
+func (grant *shareGrant) encode(e *encoder) {
+	e.writeString(grant.Issuer)
+	e.writeString(grant.Recipient)
+	e.writeUUID(grant.Node)
+	e.writeUint(uint64(grant.Permissions), 1)
+}
+
+func (grant *shareGrant) decode(d *decoder) {
+	grant.Issuer = d.readString()
+	grant.Recipient = d.readString()
+	grant.Node = d.readUUID()
+	grant.Permissions = uint8(d.readUint(1))
+}
+
+func writeSignedGrants(e *encoder, chain []signedGrant) {
+	e.writeCount(len(chain))
+	for _, signed := range chain {
+		e.writeBytes(signed.Grant)
+		e.writeBytes(signed.Sigma)
+	}
+}
+
+func readSignedGrants(d *decoder) []signedGrant {
+	var chain []signedGrant
+	for i, n := 0, d.readCount(); i < n; i++ {
+		var signed signedGrant
+		signed.Grant = d.readBytes()
+		signed.Sigma = d.readBytes()
+		chain = append(chain, signed)
+	}
+	return chain
+}
+
+func (userdata *User) signGrant(recipient string, node uuid.UUID, permissions uint8) (signedGrant, error) {
+	var grant shareGrant
+	grant.Issuer = userdata.Username
+	grant.Recipient = recipient
+	grant.Node = node
+	grant.Permissions = permissions
+
+	var signed signedGrant
+	var err error
+	signed.Grant = encodeObject(objectGrant, &grant)
+	signed.Sigma, err = userlib.DSSign(userdata.DsSk, signed.Grant)
+	return signed, err
+}
+
+// verifyChain checks every hop of a chain of grants for node ending at
+// recipient. It returns the custody it describes and the permissions that
+// reach the recipient, which can only narrow along the way.
+func verifyChain(chain []signedGrant, node uuid.UUID, owners []string, recipient string) (custody []string, permissions uint8, err error) {
+	if len(chain) == 0 {
+		return nil, 0, errors.New("sharing record has no grants")
+	}
+	permissions = permAll
+	for i, signed := range chain {
+		var grant shareGrant
+		if err := decodeObject(objectGrant, signed.Grant, &grant); err != nil {
+			return nil, 0, errors.New("malformed grant")
+		}
+		issuerDsPk, ok := userlib.KeystoreGet(grant.Issuer + "sig")
+		if !ok {
+			return nil, 0, errors.New("invalid grant issuer")
+		}
+		if err := userlib.DSVerify(issuerDsPk, signed.Grant, signed.Sigma); err != nil {
+			return nil, 0, err
+		}
+		if grant.Node != node {
+			return nil, 0, errors.New("grant is for a different file")
+		}
+		if i == 0 && !containsString(owners, grant.Issuer) {
+			return nil, 0, errors.New("grant chain doesn't start with an owner")
+		}
+		if i > 0 && grant.Issuer != custody[i] {
+			return nil, 0, errors.New("grant chain is broken")
+		}
+		if i > 0 && permissions&permShare == 0 {
+			return nil, 0, errors.New(grant.Issuer + " isn't allowed to share this file")
+		}
+		if grant.Permissions == 0 || grant.Permissions&^permissions != 0 {
+			return nil, 0, errors.New("grant widens permissions")
+		}
+		if i == 0 {
+			custody = append(custody, grant.Issuer)
+		}
+		custody = append(custody, grant.Recipient)
+		permissions = grant.Permissions
+	}
+	if custody[len(custody)-1] != recipient {
+		return nil, 0, errors.New("grant chain doesn't end with you")
+	}
+	return custody, permissions, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedFileKeys derives k7||k6 from a file's key root and its owner. Since
+// the owner is mixed in, nobody else can present the same root as their
+// own file and end up at the owner's sharedfileUUID.
+func sharedFileKeys(root []byte, owner string) []byte {
+	sharedfileMacKey, _ := userlib.HMACEval(root, []byte(owner+"sharesig"))
+	sharedfileEncKey, _ := userlib.HMACEval(root, []byte(owner+"shareenc"))
+	return append(sharedfileMacKey[0:16], sharedfileEncKey[0:16]...)
+}
+
+// hybridEnvelope carries a body of any size to a single recipient. RSA can
+// only encrypt a few dozen bytes, so it wraps a fresh pair of symmetric
+// keys and the body itself is encrypted and MACed under those.
+type hybridEnvelope struct {
+	WrappedKeys []byte // PKEEnc(recipient's public key, encKey||macKey)
+	CipherText  []byte // sealRecord(macKey, encKey, recordAD("envelope", WrappedKeys), body)
+}
+
+func sealEnvelope(recipientPk userlib.PKEEncKey, body []byte) (envelope hybridEnvelope, err error) {
+	encKey := userlib.RandomBytes(16)
+	macKey := userlib.RandomBytes(16)
+	envelope.WrappedKeys, err = userlib.PKEEnc(recipientPk, append(encKey, macKey...))
+	if err != nil {
+		return envelope, err
+	}
+	envelope.CipherText = sealRecord(macKey, encKey, recordAD(recordEnvelope, envelope.WrappedKeys), body)
+	return envelope, nil
+}
+
+func openEnvelope(sk userlib.PKEDecKey, envelope hybridEnvelope) ([]byte, error) {
+	keys, err := userlib.PKEDec(sk, envelope.WrappedKeys)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) != 32 {
+		return nil, errors.New("envelope keys corrupted")
+	}
+	body, err := openRecord(keys[16:32], keys[0:16], recordAD(recordEnvelope, envelope.WrappedKeys), envelope.CipherText)
+	if err != nil {
+		return nil, errors.New("envelope corrupted")
+	}
+	return body, nil
+}
+
+// sealEntry seals one of the small objects a user keeps under a pair of
+// symmetric keys (access nodes, groups, snapshots) for the UUID it is
+// stored at, so it can't be moved to another one.
+func sealEntry(macKey []byte, encKey []byte, kind string, location uuid.UUID, plaintext []byte) []byte {
+	return sealRecord(macKey, encKey, recordAD(kind, location[:]), plaintext)
+}
+
+func openEntry(macKey []byte, encKey []byte, kind string, location uuid.UUID, entryMarshal []byte) ([]byte, error) {
+	return openRecord(macKey, encKey, recordAD(kind, location[:]), entryMarshal)
+}
+
+// accessNode is what a share actually points at. The owner writes one per
+// direct recipient or group, which lets it hand out new file keys when the
+// file is re-keyed and cut a recipient off by deleting their node. Holders
+// share the node keys with whoever they pass the file on to, so the owner
+// also signs the node to keep them from rewriting it.
+//
+// A node for a top-level file holds its root. Something shared from inside
+// a directory has no root of its own, so its node holds the handle the
+// directory keeps for it instead.
+type accessNode struct {
+	Root     []byte   // the file's current key root
+	Owners   []string // everyone who has owned the file, the current owner last
+	Deleted  bool     // the owner deleted the file, and left the node behind to say so
+	Sigma    []byte   // the current owner's signature over accessNodeSigned
+	Location uuid.UUID
+	Keys     []byte // fileMacKey || fileEncKey, set instead of Root
+}
+
+func (content *accessNode) encode(e *encoder) {
+	e.writeBytes(content.Root)
+	e.writeStrings(content.Owners)
+	e.writeBool(content.Deleted)
+	e.writeBytes(content.Sigma)
+	e.writeUUID(content.Location)
+	e.writeBytes(content.Keys)
+}
+
+func (content *accessNode) decode(d *decoder) {
+	content.Root = d.readBytes()
+	content.Owners = d.readStrings()
+	content.Deleted = d.readBool()
+	content.Sigma = d.readBytes()
+	content.Location = d.readUUID()
+	content.Keys = d.readBytes()
+}
+
+func accessNodeSigned(node uuid.UUID, content accessNode) []byte {
+	var e encoder
+	e.writeString(recordNode)
+	e.writeUUID(node)
+	e.writeBytes(content.Root)
+	e.writeStrings(content.Owners)
+	e.writeBool(content.Deleted)
+	e.writeUUID(content.Location)
+	e.writeBytes(content.Keys)
+	return e.buf
+}
+
+// legacyAccessNodeSigned is what nodes were signed over before the binary
+// encoding. A node is signed again whenever its file is re-keyed, so one
+// like this is only met until then.
+func legacyAccessNodeSigned(node uuid.UUID, content accessNode) []byte {
+	signed, _ := json.Marshal(struct {
+		Node     uuid.UUID
+		Root     []byte
+		Owners   []string
+		Deleted  bool
+		Location uuid.UUID
+		Keys     []byte
+	}{node, content.Root, content.Owners, content.Deleted, content.Location, content.Keys})
+	return signed
+}
+
+func (userdata *User) storeAccessNode(node uuid.UUID, nodeKeys []byte, root []byte, owners []string) error {
+	var content accessNode
+	content.Root = root
+	content.Owners = owners
+	return userdata.sealAccessNode(node, nodeKeys, content)
+}
+
+// storeTombstone replaces a node with one that tells its holders the file
+// was deleted, rather than that they were cut off.
+func (userdata *User) storeTombstone(node uuid.UUID, nodeKeys []byte, owners []string) error {
+	var content accessNode
+	content.Owners = owners
+	content.Deleted = true
+	return userdata.sealAccessNode(node, nodeKeys, content)
+}
+
+// storeGrantNode writes the node for one of the user's grants on path:
+// the root of a top-level file, or the handle of something in one of the
+// user's directories.
+func (userdata *User) storeGrantNode(path string, grant AccessGrant) error {
+	parts, err := splitPath(path)
+	if err != nil {
+		return err
+	}
+	entry := userdata.SharedFiles[parts[0]]
+	if len(parts) == 1 {
+		return userdata.storeAccessNode(grant.Node, grant.NodeKeys, entry.Root, entry.Custody)
+	}
+	handle, err := userdata.locate(path)
+	if err != nil {
+		return err
+	}
+	var content accessNode
+	content.Owners = entry.Custody
+	content.Location = handle.Location
+	content.Keys = handle.Keys
+	return userdata.sealAccessNode(grant.Node, grant.NodeKeys, content)
+}
+
+func (userdata *User) sealAccessNode(node uuid.UUID, nodeKeys []byte, content accessNode) error {
+	var err error
+	content.Sigma, err = userlib.DSSign(userdata.DsSk, accessNodeSigned(node, content))
+	if err != nil {
+		return err
+	}
+	contentMarshal := encodeObject(recordNode, &content)
+	userlib.DatastoreSet(node, sealEntry(nodeKeys[0:16], nodeKeys[16:32], recordNode, node, contentMarshal))
+	return nil
+}
+
+// loadAccessNode returns where the file a node opens is, the keys that
+// open it and the owners the node was signed with, the current owner last.
+func loadAccessNode(node uuid.UUID, nodeKeys []byte) (uuid.UUID, []byte, []string, error) {
+	entryMarshal, ok := userlib.DatastoreGet(node)
+	if !ok {
+		return uuid.Nil, nil, nil, errors.New("access to the file was revoked")
+	}
+	contentMarshal, err := openEntry(nodeKeys[0:16], nodeKeys[16:32], recordNode, node, entryMarshal)
+	if err != nil {
+		return uuid.Nil, nil, nil, err
+	}
+	var content accessNode
+	if err := decodeObject(recordNode, contentMarshal, &content); err != nil || len(content.Owners) == 0 ||
+		(!content.Deleted && !(len(content.Root) == 16 && content.Keys == nil) &&
+			!(content.Root == nil && len(content.Keys) == 32)) {
+		return uuid.Nil, nil, nil, errors.New("access node corrupted")
+	}
+	ownerDsPk, ok := userlib.KeystoreGet(content.Owners[len(content.Owners)-1] + "sig")
+	if !ok {
+		return uuid.Nil, nil, nil, errors.New("access node corrupted")
+	}
+	if err := userlib.DSVerify(ownerDsPk, accessNodeSigned(node, content), content.Sigma); err != nil {
+		if userlib.DSVerify(ownerDsPk, legacyAccessNodeSigned(node, content), content.Sigma) != nil {
+			return uuid.Nil, nil, nil, err
+		}
+	}
+	if content.Deleted {
+		return uuid.Nil, nil, nil, ErrDeleted
+	}
+	if content.Keys != nil {
+		return content.Location, content.Keys, content.Owners, nil
+	}
+	// the keys depend on the owner who signed the node, so a node holding
+	// some other user's root can't pass for the owner's file
+	keys := sharedFileKeys(content.Root, content.Owners[len(content.Owners)-1])
+	hashedFilename, _ := userlib.HMACEval(keys[0:16], []byte("magic_string"))
+	return bytesToUUID(hashedFilename), keys, content.Owners, nil
+}
+
+// sharedHandle returns the sharedfileUUID and k7||k6 of a file reached
+// through the shared location. The owner derives them from the root;
+// everyone else reads them from the access node they were given, and a
+// group member whose node was rotated picks up the new one from their slot.
+func (userdata *User) sharedHandle(filename string) (uuid.UUID, []byte, error) {
+	entry := userdata.SharedFiles[filename]
+	if entry.Root != nil {
+		keys := sharedFileKeys(entry.Root, userdata.Username)
+		hashedFilename, _ := userlib.HMACEval(keys[0:16], []byte("magic_string"))
+		return bytesToUUID(hashedFilename), keys, nil
+	}
+	location, keys, _, err := loadAccessNode(entry.Node, entry.NodeKeys)
+	if err != nil && err != ErrDeleted && entry.Slot != uuid.Nil {
+		if err := userdata.refreshFromSlot(filename); err != nil {
+			return uuid.Nil, nil, err
+		}
+		entry = userdata.SharedFiles[filename]
+		location, keys, _, err = loadAccessNode(entry.Node, entry.NodeKeys)
+	}
+	return location, keys, err
+}
+
+func (userdata *User) refreshFromSlot(filename string) error {
+	entry := userdata.SharedFiles[filename]
+	slotRecord, ok := userlib.DatastoreGet(entry.Slot)
+	if !ok {
+		return errors.New("access to the file was revoked")
+	}
+	// the group owner signed our slot and is the one who handed it to us
+	if len(entry.Custody) < 2 {
+		return errors.New("malformed sharing record")
+	}
+	sender := entry.Custody[len(entry.Custody)-2]
+	payload, err := userdata.openSharingRecord(sender, string(slotRecord))
+	if err != nil {
+		return err
+	}
+	received, custody, permissions, err := userdata.openSharingBody(sender, payload)
+	if err != nil {
+		return err
+	}
+	entry.Node = received.Node
+	entry.NodeKeys = received.NodeKeys
+	entry.Chain = received.Chain
+	entry.Custody = custody
+	entry.Permissions = permissions
+	userdata.SharedFiles[filename] = entry
+	userdata.storeUser()
+	return nil
+}
+
+// Group is a named set of users that one user can share files with as a
+// whole. It sits in the datastore encrypted under keys only its owner can
+// derive.
+type Group struct {
+	Name    string
+	Members []string
+}
+
+func (group *Group) encode(e *encoder) {
+	e.writeString(group.Name)
+	e.writeStrings(group.Members)
+}
+
+func (group *Group) decode(d *decoder) {
+	group.Name = d.readString()
+	group.Members = d.readStrings()
+}
+
+func (userdata *User) groupLocation(name string) (uuid.UUID, []byte, []byte) {
+	groupMacKey, groupEncKey := generateKeysForDataStore(userdata.Username, userdata.SourceKey, []byte(name+userdata.Username+"groupsig"), []byte(name+userdata.Username+"groupenc"))
+	hashedName, _ := userlib.HMACEval(groupMacKey, []byte(name))
+	return bytesToUUID(hashedName), groupMacKey, groupEncKey
+}
+
+func (userdata *User) loadGroup(name string) (*Group, error) {
+	groupUUID, groupMacKey, groupEncKey := userdata.groupLocation(name)
+	entryMarshal, ok := userlib.DatastoreGet(groupUUID)
+	if !ok {
+		return nil, errors.New("group doesn't exist")
+	}
+	groupMarshal, err := openEntry(groupMacKey, groupEncKey, recordGroup, groupUUID, entryMarshal)
+	if err != nil {
+		return nil, err
+	}
+	var group Group
+	if err := decodeObject(recordGroup, groupMarshal, &group); err != nil || group.Name != name {
+		return nil, errors.New("group data corrupted")
+	}
+	return &group, nil
+}
+
+func (userdata *User) storeGroup(group *Group) {
+	groupUUID, groupMacKey, groupEncKey := userdata.groupLocation(group.Name)
+	groupMarshal := encodeObject(recordGroup, group)
+	userlib.DatastoreSet(groupUUID, sealEntry(groupMacKey, groupEncKey, recordGroup, groupUUID, groupMarshal))
+}
+
+// CreateGroup makes an empty group the user can add members to and share
+// files with through ShareFileWithGroup. A group can't take the name of a
+// registered user.
+func (userdata *User) CreateGroup(name string) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New("group name can't be empty")
+	}
+	if _, ok := userlib.KeystoreGet(name + "enc"); ok {
+		return errors.New("group name is already a username")
+	}
+	groupUUID, _, _ := userdata.groupLocation(name)
+	if _, ok := userlib.DatastoreGet(groupUUID); ok {
+		return errors.New("group already exists")
+	}
+	var group Group
+	group.Name = name
+	userdata.storeGroup(&group)
+	return nil
+}
+
+// AddMember adds a user to a group and gives them access to every file
+// already shared with the group. They accept it by calling ReceiveFile
+// with the record the group share returned.
+func (userdata *User) AddMember(groupName string, member string) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	group, err := userdata.loadGroup(groupName)
+	if err != nil {
+		return err
+	}
+	if _, ok := userlib.KeystoreGet(member + "enc"); !ok {
+		return errors.New("invalid member")
+	}
+	for _, m := range group.Members {
+		if m == member {
+			return errors.New("already a member of the group")
+		}
+	}
+	group.Members = append(group.Members, member)
+	userdata.storeGroup(group)
+
+	for filename, grants := range userdata.Grants {
+		for _, grant := range grants {
+			if grant.Group && grant.Recipient == groupName {
+				if err := userdata.writeSlot(filename, grant, member); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// RemoveMember takes a user out of a group. Every file shared with the
+// group is re-keyed and the group's access node replaced, so whatever the
+// removed member kept is useless from here on.
+func (userdata *User) RemoveMember(groupName string, member string) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	group, err := userdata.loadGroup(groupName)
+	if err != nil {
+		return err
+	}
+	found := false
+	for i, m := range group.Members {
+		if m == member {
+			group.Members = append(group.Members[:i], group.Members[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New("not a member of the group")
+	}
+	userdata.storeGroup(group)
+
+	for filename, grants := range userdata.Grants {
+		rotated := false
+		for i := range grants {
+			if grants[i].Group && grants[i].Recipient == groupName {
+				userlib.DatastoreDelete(slotUUID(grants[i].ShareID, member))
+				userlib.DatastoreDelete(grants[i].Node)
+				grants[i].Node = uuid.New()
+				grants[i].NodeKeys = userlib.RandomBytes(32)
+				userdata.activeRun().addObject(grants[i].Node)
+				rotated = true
+			}
+		}
+		if !rotated {
+			continue
+		}
+		if err := userdata.rekeyFile(filename); err != nil {
+			return err
+		}
+		for _, grant := range grants {
+			if grant.Group && grant.Recipient == groupName {
+				for _, m := range group.Members {
+					if err := userdata.writeSlot(filename, grant, m); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	userdata.storeUser()
+	return nil
+}
+
+// slotUUID is where a group member finds their own sharing record for a
+// group share.
+func slotUUID(shareID uuid.UUID, member string) uuid.UUID {
+	hashedMember, _ := userlib.HMACEval(shareID[:], []byte(member))
+	return bytesToUUID(hashedMember)
+}
+
+func (userdata *User) writeSlot(filename string, grant AccessGrant, member string) error {
+	memberPk, ok := userlib.KeystoreGet(member + "enc")
+	if !ok {
+		return errors.New("invalid member")
+	}
+	body, err := userdata.sharingBodyFor(filename, grant, member)
+	if err != nil {
+		return err
+	}
+	record, err := userdata.newSharingRecord(member, memberPk, body)
+	if err != nil {
+		return err
+	}
+	userdata.activeRun().addObject(slotUUID(grant.ShareID, member))
+	userlib.DatastoreSet(slotUUID(grant.ShareID, member), []byte(record))
+	return nil
+}
+
+// rekeyFile moves a shared file the user owns to fresh keys and points every
+// access node still handed out at them. Anyone holding the old keys, or a
+// node that has since been deleted, is left with nothing.
+func (userdata *User) rekeyFile(filename string) error {
+	parts, err := splitPath(filename)
+	if err != nil {
+		return err
+	}
+	if len(parts) > 1 {
+		return userdata.rekeyChild(parts)
+	}
+	entry := userdata.SharedFiles[filename]
+	keys := sharedFileKeys(entry.Root, userdata.Username)
+	hashedFilename, _ := userlib.HMACEval(keys[0:16], []byte("magic_string"))
+	return userdata.storeRekeyed(filename, keys, bytesToUUID(hashedFilename))
+}
+
+// storeRekeyed moves a file the user owns from the keys and location it
+// has now to a fresh root, and rewrites every access node handed out for
+// it. A file keeps its history; a directory moves everything under it.
+func (userdata *User) storeRekeyed(filename string, oldKeys []byte, oldUUID uuid.UUID) error {
+	entry := userdata.SharedFiles[filename]
+	root := userlib.RandomBytes(16)
+	keys := sharedFileKeys(root, userdata.Username)
+	hashedFilename, _ := userlib.HMACEval(keys[0:16], []byte("magic_string"))
+	if entry.Dir {
+		fileMarshal, ok := userlib.DatastoreGet(oldUUID)
+		if !ok {
+			return errors.New("Data failed to load.")
+		}
+		originalData, err := loadData(oldKeys[0:16], oldKeys[16:32], oldUUID, fileMarshal)
+		if err != nil {
+			return errors.New("Data failed to load.")
+		}
+		// a directory hands out the keys of everything in it, so all of
+		// that moves too
+		if originalData, err = rekeyChildren(originalData, userdata.fileOptions()); err != nil {
+			return err
+		}
+		userdata.activeRun().addMove(fileHandle{true, oldUUID, oldKeys}, fileHandle{true, bytesToUUID(hashedFilename), keys})
+		deleteData(oldKeys[0:16], oldKeys[16:32], oldUUID)
+		if err := storeData(keys[16:32], originalData, keys[0:16], hashedFilename, userdata.Username, userdata.fileOptions()); err != nil {
+			return err
+		}
+	} else if err := moveFileEntry(oldKeys, oldUUID, keys, bytesToUUID(hashedFilename), userdata.activeRun()); err != nil {
+		return err
+	}
+	entry.Root = root
+	userdata.SharedFiles[filename] = entry
+	return userdata.repointGrants(filename)
+}
+
+// rekeyChild is rekeyFile for something in one of the user's directories.
+// It gets a new handle, which the directory it's in is rewritten to hold.
+func (userdata *User) rekeyChild(parts []string) error {
+	parent, dir, err := userdata.openParent(parts)
+	if err != nil {
+		return err
+	}
+	name := parts[len(parts)-1]
+	old, ok := dir.Children[name]
+	if !ok {
+		return errors.New("Your requested file isn't in the DataStore")
+	}
+	moved, err := old.move(userdata.fileOptions())
+	if err != nil {
+		return err
+	}
+	dir.Children[name] = moved
+	if err := userdata.storeDirectory(parent, dir); err != nil {
+		return err
+	}
+	return userdata.repointGrants(strings.Join(parts, "/"))
+}
+
+// repointGrants rewrites the nodes the user handed out for path, and for
+// anything under it, to the keys they have now.
+func (userdata *User) repointGrants(path string) error {
+	for _, granted := range append([]string{path}, userdata.grantsBelow(path)...) {
+		for _, grant := range userdata.Grants[granted] {
+			if err := userdata.storeGrantNode(granted, grant); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// grantsBelow returns the paths inside directory path that the user has
+// handed out grants for, in order.
+func (userdata *User) grantsBelow(path string) []string {
+	var paths []string
+	for granted := range userdata.Grants {
+		if strings.HasPrefix(granted, path+"/") {
+			paths = append(paths, granted)
+		}
+	}
+	sortSlice(len(paths), func(i, j int) bool { return paths[i] < paths[j] },
+		func(i, j int) { paths[i], paths[j] = paths[j], paths[i] })
+	return paths
+}
+
+// dropGrants ends every grant the user handed out for the given paths.
+// When the file was deleted its nodes are replaced by tombstones, so their
+// holders get ErrDeleted; otherwise they're deleted outright.
+func (userdata *User) dropGrants(paths []string, deleted bool) error {
+	for _, granted := range paths {
+		custody := userdata.SharedFiles[strings.Split(granted, "/")[0]].Custody
+		for _, grant := range userdata.Grants[granted] {
+			if !deleted {
+				userlib.DatastoreDelete(grant.Node)
+			} else if err := userdata.storeTombstone(grant.Node, grant.NodeKeys, custody); err != nil {
+				return err
+			}
+			if grant.Group {
+				if group, err := userdata.loadGroup(grant.Recipient); err == nil {
+					for _, member := range group.Members {
+						userlib.DatastoreDelete(slotUUID(grant.ShareID, member))
+					}
+				}
+			}
+		}
+		delete(userdata.Grants, granted)
+	}
+	return nil
+}
+
+// moveFileEntry re-encrypts a file and every version it keeps under new
+// keys at a new location, then deletes it from the old one. A chunk shared
+// by several versions is moved once and stays shared. Deduplicated chunks
+// have keys of their own and stay where they are, used by the new header
+// and its versions instead of the old. The move is recorded in r.
+func moveFileEntry(oldKeys []byte, oldUUID uuid.UUID, newKeys []byte, newUUID uuid.UUID, r *run) error {
+	fileMarshal, ok := userlib.DatastoreGet(oldUUID)
+	if !ok {
+		return errors.New("Data failed to load.")
+	}
+	filedata, err := openFileEntry(oldKeys[0:16], oldKeys[16:32], oldUUID, fileMarshal)
+	if err != nil {
+		return errors.New("Data failed to load.")
+	}
+	to := fileHandle{Location: newUUID, Keys: newKeys}
+	r.addMove(fileHandle{Location: oldUUID, Keys: oldKeys}, to)
+	r.touch(to)
+	filedata.run = r
+	moved := make(map[uuid.UUID]chunkRef)
+	filedata.Chunks, err = filedata.moveChunks(oldKeys, newKeys, filedata.Chunks, moved)
+	for i := 0; i < len(filedata.History) && err == nil; i++ {
+		var version fileVersion
+		if version, err = filedata.loadVersion(oldKeys[16:32], oldKeys[0:16], filedata.History[i]); err != nil {
+			break
+		}
+		if version.Chunks, err = filedata.moveChunks(oldKeys, newKeys, version.Chunks, moved); err == nil {
+			record := encodeObject(objectVersion, &version)
+			filedata.History[i].Record = filedata.storeRecord(newKeys[16:32], newKeys[0:16], record)
+			for _, ref := range keyedChunks(version.Chunks) {
+				filedata.pending = append(filedata.pending, ref)
+			}
+		}
+	}
+	if err != nil {
+		filedata.discard()
+		return err
+	}
+	// pins stay behind with the chunks and keys the snapshots know, and the
+	// new header is a use of its chunks before the old one stops being one
+	filedata.Pins = nil
+	filedata.held = nil
+	if err := storeFileEntry(newKeys[0:16], newKeys[16:32], newUUID, &filedata); err != nil {
+		return err
+	}
+	deleteData(oldKeys[0:16], oldKeys[16:32], oldUUID)
+	return nil
+}
+
+func (filedata *FileEntry) moveChunks(oldKeys []byte, newKeys []byte, chunks []chunkRef, moved map[uuid.UUID]chunkRef) ([]chunkRef, error) {
+	refs := make([]chunkRef, len(chunks))
+	for i, ref := range chunks {
+		if ref.Key != nil {
+			refs[i] = ref
+			continue
+		}
+		if _, ok := moved[ref.Location]; !ok {
+			chunk, err := filedata.loadChunk(oldKeys[16:32], oldKeys[0:16], ref)
+			if err != nil {
+				return nil, err
+			}
+			moved[ref.Location] = filedata.storeChunk(newKeys[16:32], newKeys[0:16], chunk)
+		}
+		refs[i] = moved[ref.Location]
+	}
+	return refs, nil
+}
+
+// This creates a sharing record, which is a key pointing to something
+// in the datastore to share with the recipient.
+
+// This enables the recipient to access the encrypted file as well
+// for reading/appending.
+
+// Note that neither the recipient NOR the datastore should gain any
 // information about what the sender calls the file.  Only the
 // recipient can access the sharing record, and only the recipient
 // should be able to know the sender.
 
-/*ShareFile
-- See if filename = your_version_of_filename in map[sharedfileUUID, your_version_of_filename] in userdata
-- If so, you are trying to share a file for which you are not the owner
-	- create magic_string = DSSign(sender's private key, PKEEnc(recipient's public key, k6||k7))
+/*ShareFile
+- See if filename = your_version_of_filename in map[sharedfileUUID, your_version_of_filename] in userdata
+- If so, you are trying to share a file for which you are not the owner
+	- you need permShare, and you add your own signed grant to the chain you received
+	- create magic_string = DSSign(sender's private key, PKEEnc(recipient's public key, node||nodeKeys))
+
+- If not,
+- Find sharedfileUUID in datastore
+- If sharedfileUUID doesn't exist, return
+
+- k7||k6 are derived from the file's root and the owner's username
+- The owner writes the root into a new access node, and signs a grant of it to the recipient
+- magic_string = DSSign(sender's private key, PKEEnc(recipient's public key, node||nodeKeys))
+- ShareFileWithGroup instead puts that in the slot of every member of one of the owner's groups
+- For a path inside one of the owner's directories, the node holds the handle the directory keeps for it instead of a root
+
+- Later, if Bob calls receiveFile, he will verify & decrypt magic_string, and read k6, k7 from the node
+*/
+func (userdata *User) ShareFile(filename string, recipient string) (magic_string string, err error) {
+	return userdata.shareWithUser(filename, recipient, permAll)
+}
+
+// ShareFileNoReshare is ShareFile, except that the recipient can read and
+// append to the file but can't share it any further.
+func (userdata *User) ShareFileNoReshare(filename string, recipient string) (magic_string string, err error) {
+	return userdata.shareWithUser(filename, recipient, permRead|permWrite)
+}
+
+// ShareFileWithGroup shares a file the user owns with one of their groups.
+// Every member finds a record in their own slot, and any of them can pass
+// the returned record to ReceiveFile to pick theirs up.
+func (userdata *User) ShareFileWithGroup(filename string, groupName string) (magic_string string, err error) {
+	return userdata.shareWithGroup(filename, groupName, permAll)
+}
+
+// ShareFileWithGroupNoReshare is ShareFileWithGroup, except that the members
+// can read and append to the file but can't share it any further.
+func (userdata *User) ShareFileWithGroupNoReshare(filename string, groupName string) (magic_string string, err error) {
+	return userdata.shareWithGroup(filename, groupName, permRead|permWrite)
+}
+
+func (userdata *User) shareWithUser(filename string, recipient string, permissions uint8) (string, error) {
+	defer userdata.settle()
+	recipientPk, ok := userlib.KeystoreGet(recipient + "enc")
+	if !ok {
+		return "", errors.New("invalid recipient")
+	}
+	return userdata.shareFile(filename, recipient, recipientPk, nil, permissions)
+}
+
+func (userdata *User) shareWithGroup(filename string, groupName string, permissions uint8) (string, error) {
+	defer userdata.settle()
+	group, err := userdata.loadGroup(groupName)
+	if err != nil {
+		return "", err
+	}
+	return userdata.shareFile(filename, groupName, userlib.PKEEncKey{}, group, permissions)
+}
+
+// shareFile shares with a user, or with the group when one is given.
+func (userdata *User) shareFile(filename string, recipient string, recipientPk userlib.PKEEncKey, group *Group, permissions uint8) (string, error) {
+	if err := userdata.syncUser(); err != nil {
+		return "", err
+	}
+	if err := userdata.checkFileExists(filename); err != nil {
+		return "", err
+	}
+	parts, _ := splitPath(filename)
+	entry := userdata.SharedFiles[parts[0]]
+
+	if !userdata.ListOfOwnedFiles[parts[0]] {
+		// only the owner hands out nodes, everyone else passes on their own
+		if len(parts) > 1 {
+			return "", errors.New("only the owner of a directory can share what's in it")
+		}
+		if group != nil {
+			return "", errors.New("only the owner of a file can share it with a group")
+		}
+		if entry.Permissions&permShare == 0 {
+			return "", errors.New("you aren't allowed to share this file")
+		}
+		var grant AccessGrant
+		grant.Node = entry.Node
+		grant.NodeKeys = entry.NodeKeys
+		grant.Permissions = permissions & entry.Permissions
+		body, err := userdata.sharingBodyFor(filename, grant, recipient)
+		if err != nil {
+			return "", err
+		}
+		return userdata.newSharingRecord(recipient, recipientPk, body)
+	}
+
+	var grant AccessGrant
+	grant.Recipient = recipient
+	grant.Node = uuid.New()
+	grant.NodeKeys = userlib.RandomBytes(32)
+	grant.Permissions = permissions
+	userdata.activeRun().addObject(grant.Node)
+	if err := userdata.storeGrantNode(filename, grant); err != nil {
+		return "", err
+	}
+	if group != nil {
+		grant.Group = true
+		grant.ShareID = uuid.New()
+	}
+	userdata.Grants[filename] = append(userdata.Grants[filename], grant)
+	userdata.storeUser()
+
+	if !grant.Group {
+		// initialize sharing
+		body, err := userdata.sharingBodyFor(filename, grant, recipient)
+		if err != nil {
+			return "", err
+		}
+		return userdata.newSharingRecord(recipient, recipientPk, body)
+	}
+	for _, member := range group.Members {
+		if err := userdata.writeSlot(filename, grant, member); err != nil {
+			return "", err
+		}
+	}
+	return userdata.newGroupRecord(recipient, grant.ShareID)
+}
+
+// checkWritable refuses changes to a file, or to anything in a directory,
+// that was shared with the user without permWrite. The keys the user
+// holds would open it for writing all the same; it's the user's own client
+// that keeps to what the owner granted.
+func (userdata *User) checkWritable(path string) error {
+	parts, err := splitPath(path)
+	if err != nil {
+		return err
+	}
+	if entry, ok := userdata.SharedFiles[parts[0]]; ok && entry.Permissions&permWrite == 0 {
+		return errors.New("you aren't allowed to change this file")
+	}
+	return nil
+}
+
+// checkFileExists makes sure the user can still reach the file, so that
+// nobody is handed a share of something that has been revoked or deleted.
+func (userdata *User) checkFileExists(filename string) error {
+	handle, err := userdata.locate(filename)
+	if err != nil {
+		return err
+	}
+	if _, ok := userlib.DatastoreGet(handle.Location); !ok {
+		// if the file was revoked or an attacker deleted the file, we can't share the file
+		return errors.New("File deleted.")
+	}
+	return nil
+}
+
+// AccessGrant is the owner's note of an access node it handed out for one
+// of its files, kept so the node can be rewritten or deleted later.
+type AccessGrant struct {
+	Recipient   string // username, or the group name when Group is set
+	Group       bool
+	Node        uuid.UUID
+	NodeKeys    []byte    // nodeMacKey || nodeEncKey
+	ShareID     uuid.UUID // seeds the members' slots for a group share
+	Permissions uint8
+}
+
+func writeAccessGrants(e *encoder, grants []AccessGrant) {
+	e.writeCount(len(grants))
+	for _, grant := range grants {
+		e.writeString(grant.Recipient)
+		e.writeBool(grant.Group)
+		e.writeUUID(grant.Node)
+		e.writeBytes(grant.NodeKeys)
+		e.writeUUID(grant.ShareID)
+		e.writeUint(uint64(grant.Permissions), 1)
+	}
+}
+
+func readAccessGrants(d *decoder) []AccessGrant {
+	var grants []AccessGrant
+	for i, n := 0, d.readCount(); i < n; i++ {
+		var grant AccessGrant
+		grant.Recipient = d.readString()
+		grant.Group = d.readBool()
+		grant.Node = d.readUUID()
+		grant.NodeKeys = d.readBytes()
+		grant.ShareID = d.readUUID()
+		grant.Permissions = uint8(d.readUint(1))
+		grants = append(grants, grant)
+	}
+	return grants
+}
+
+// sharingBodyFor builds the body of a record handing grant to recipient,
+// with the user's own signed hop appended to the chain it received.
+func (userdata *User) sharingBodyFor(filename string, grant AccessGrant, recipient string) (body sharingBody, err error) {
+	handle, err := userdata.locate(filename)
+	if err != nil {
+		return body, err
+	}
+	parts, _ := splitPath(filename)
+	entry := userdata.SharedFiles[parts[0]]
+
+	hop, err := userdata.signGrant(recipient, grant.Node, grant.Permissions)
+	if err != nil {
+		return body, err
+	}
+	body.FileUUID = handle.Location
+	body.Node = grant.Node
+	body.NodeKeys = grant.NodeKeys
+	body.Chain = append(append([]signedGrant{}, entry.Chain...), hop)
+	body.Dir = handle.Dir
+	return body, nil
+}
+
+// newSharingRecord seals the body in an envelope for the recipient, and
+// signs it together with who the record is from and to and a fresh nonce.
+func (userdata *User) newSharingRecord(recipient string, recipientPk userlib.PKEEncKey, body sharingBody) (string, error) {
+	bodyMarshal := encodeObject(objectShare, &body)
+
+	var payload sharingPayload
+	var err error
+	payload.Sender = userdata.Username
+	payload.Recipient = recipient
+	payload.Body, err = sealEnvelope(recipientPk, bodyMarshal)
+	if err != nil {
+		return "", err
+	}
+	return userdata.signSharingPayload(payload)
+}
+
+// newGroupRecord is what sharing with a group returns: any member can pass
+// it to ReceiveFile to pick up the record waiting in their slot.
+func (userdata *User) newGroupRecord(groupName string, shareID uuid.UUID) (string, error) {
+	var payload sharingPayload
+	payload.Sender = userdata.Username
+	payload.Group = groupName
+	payload.ShareID = shareID
+	return userdata.signSharingPayload(payload)
+}
+
+func (userdata *User) signSharingPayload(payload sharingPayload) (string, error) {
+	var err error
+	userdata.Issued++
+	userdata.storeUser()
+	payload.IssuedAt = userdata.Issued
+	payload.Nonce = userlib.RandomBytes(16)
+
+	var sharingEntry sharingRecord
+	sharingEntry.Payload = encodeObject(objectPayload, &payload)
+	sharingEntry.Sigma, err = userlib.DSSign(userdata.DsSk, sharingEntry.Payload)
+	if err != nil {
+		return "", err
+	}
+	sharingEntryMarshal, _ := json.Marshal(sharingEntry)
+	return string(sharingEntryMarshal), nil
+}
+
+// Note recipient's filename can be different from the sender's filename.
+// The recipient should not be able to discover the sender's view on
+// what the filename even is!  However, the recipient must ensure that
+// it is authentically from the sender.
+func (userdata *User) ReceiveFile(filename string, sender string, magic_string string) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	if _, ok := userdata.SharedFiles[filename]; ok {
+		return errors.New("File already shared with someone")
+	}
+
+	payload, err := userdata.openSharingRecord(sender, magic_string)
+	if err != nil {
+		return err
+	}
+	if payload.Transfer {
+		return errors.New("ownership transfers are accepted with AcceptOwnership")
+	}
+	if err := userdata.checkUnused(payload); err != nil {
+		return err
+	}
+	record := payload
+
+	var entry SharedFile
+	if payload.Group != "" {
+		// a group record only names the share, our own record is in our slot
+		entry.Slot = slotUUID(payload.ShareID, userdata.Username)
+		slotRecord, ok := userlib.DatastoreGet(entry.Slot)
+		if !ok {
+			return errors.New("you are not a member of the group")
+		}
+		payload, err = userdata.openSharingRecord(sender, string(slotRecord))
+		if err != nil {
+			return err
+		}
+		if payload.Group != "" {
+			return errors.New("malformed sharing record")
+		}
+	}
+	body, custody, permissions, err := userdata.openSharingBody(sender, payload)
+	if err != nil {
+		return err
+	}
+
+	entry.Node = body.Node
+	entry.NodeKeys = body.NodeKeys
+	entry.Chain = body.Chain
+	entry.Permissions = permissions
+	entry.Custody = custody
+	entry.Dir = body.Dir
+	userdata.SharedFiles[filename] = entry
+	userdata.useNonce(record)
+	userdata.storeUser()
+	return nil
+}
+
+// openSharingRecord checks the sender's signature on a record and that the
+// signed payload is complete and meant for this user or one of the sender's
+// groups.
+func (userdata *User) openSharingRecord(sender string, magic_string string) (payload sharingPayload, err error) {
+	senderDsPk, ok := userlib.KeystoreGet(sender + "sig")
+	if !ok {
+		return payload, errors.New("invalid sender")
+	}
+	var sharingEntry sharingRecord
+	if err := decodeJSON([]byte(magic_string), &sharingEntry); err != nil {
+		return payload, errors.New("malformed sharing record")
+	}
+	err = userlib.DSVerify(senderDsPk, sharingEntry.Payload, sharingEntry.Sigma)
+	if err != nil {
+		return payload, err
+	}
+	if err := decodeObject(objectPayload, sharingEntry.Payload, &payload); err != nil {
+		return payload, errors.New("malformed sharing record")
+	}
+
+	// the signature only tells us the sender wrote these bytes; make sure
+	// they were written for us and that nothing was left out
+	if payload.Sender != sender {
+		return payload, errors.New("sharing record is not from the sender")
+	}
+	if payload.Group == "" && payload.Recipient != userdata.Username {
+		return payload, errors.New("sharing record is not addressed to you")
+	}
+	if len(payload.Nonce) == 0 || payload.IssuedAt <= 0 ||
+		(payload.Group == "" && len(payload.Body.WrappedKeys) == 0) ||
+		(payload.Group != "" && payload.ShareID == uuid.Nil) {
+		return payload, errors.New("sharing record is incomplete")
+	}
+	return payload, nil
+}
+
+// openSharingBody decrypts the body of a record addressed to this user,
+// checks its chain of grants back to the owner and that the node it names
+// opens the owner's file. It returns the custody and permissions the chain
+// hands this user.
+func (userdata *User) openSharingBody(sender string, payload sharingPayload) (body sharingBody, custody []string, permissions uint8, err error) {
+	bodyMarshal, err := openEnvelope(userdata.RsaSk, payload.Body)
+	if err != nil {
+		return body, nil, 0, err
+	}
+	if err := decodeObject(objectShare, bodyMarshal, &body); err != nil {
+		return body, nil, 0, errors.New("malformed sharing record")
+	}
+	if len(body.NodeKeys) != 32 {
+		return body, nil, 0, errors.New("sharing record is incomplete")
+	}
+	location, _, owners, err := loadAccessNode(body.Node, body.NodeKeys)
+	if err != nil {
+		return body, nil, 0, err
+	}
+	custody, permissions, err = verifyChain(body.Chain, body.Node, owners, userdata.Username)
+	if err != nil {
+		return body, nil, 0, err
+	}
+	if custody[len(custody)-2] != sender {
+		return body, nil, 0, errors.New("sharing record is not from the sender")
+	}
+	if location != body.FileUUID {
+		return body, nil, 0, errors.New("sharing record doesn't match the file")
+	}
+	return body, custody, permissions, nil
+}
+
+// checkUnused refuses a record whose nonce the user has already accepted,
+// or that is too far behind the newest the sender has been seen to issue
+// for the user to still know.
+func (userdata *User) checkUnused(payload sharingPayload) error {
+	nonces := userdata.UsedNonces[payload.Sender]
+	if _, used := nonces[hex.EncodeToString(payload.Nonce)]; used {
+		return errors.New("sharing record has already been used")
+	}
+	if payload.IssuedAt <= newestIssued(nonces)-nonceWindow {
+		return errors.New("sharing record has expired")
+	}
+	return nil
+}
+
+// useNonce records a record's nonce and forgets those of the sender's
+// records that fell out of the window.
+func (userdata *User) useNonce(payload sharingPayload) {
+	nonces := userdata.UsedNonces[payload.Sender]
+	if nonces == nil {
+		nonces = make(map[string]int64)
+		userdata.UsedNonces[payload.Sender] = nonces
+	}
+	nonces[hex.EncodeToString(payload.Nonce)] = payload.IssuedAt
+	newest := newestIssued(nonces)
+	for nonce, issued := range nonces {
+		if issued <= newest-nonceWindow {
+			delete(nonces, nonce)
+		}
+	}
+}
+
+func newestIssued(nonces map[string]int64) int64 {
+	var newest int64
+	for _, issued := range nonces {
+		if issued > newest {
+			newest = issued
+		}
+	}
+	return newest
+}
+
+// ErrDeleted is returned to the holders of a file once its owner has
+// deleted it.
+var ErrDeleted = errors.New("file was deleted by its owner")
+
+// DeleteFile removes a file from the user's namespace. For the owner that
+// means the file itself: its data, every node and group
+// slot handed out for it, and the user's records of them. Each node is
+// replaced by a tombstone so its holders get ErrDeleted. Anyone else just
+// forgets their own name for the file.
+func (userdata *User) DeleteFile(filename string) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	handle, err := userdata.locate(filename)
+	if err == nil && handle.Dir {
+		return errors.New("is a directory")
+	}
+	if parts, _ := splitPath(filename); len(parts) > 1 {
+		if err != nil {
+			return err
+		}
+		if err := userdata.checkWritable(filename); err != nil {
+			return err
+		}
+		return userdata.removeChild(parts)
+	}
+	return userdata.deleteTopLevel(filename)
+}
+
+// deleteTopLevel is DeleteFile for one of the user's top-level names.
+func (userdata *User) deleteTopLevel(filename string) error {
+	entry, isShared := userdata.SharedFiles[filename]
+	if !userdata.ListOfOwnedFiles[filename] {
+		if !isShared {
+			return errors.New("Your requested file isn't in the DataStore")
+		}
+		delete(userdata.SharedFiles, filename)
+		userdata.storeUser()
+		return nil
+	}
+
+	keys := sharedFileKeys(entry.Root, userdata.Username)
+	hashedFilename, _ := userlib.HMACEval(keys[0:16], []byte("magic_string"))
+	userdata.activeRun().addFile(fileHandle{entry.Dir, bytesToUUID(hashedFilename), keys})
+	deleteData(keys[0:16], keys[16:32], bytesToUUID(hashedFilename))
+	if err := userdata.dropGrants(append([]string{filename}, userdata.grantsBelow(filename)...), true); err != nil {
+		return err
+	}
+	delete(userdata.SharedFiles, filename)
+	delete(userdata.ListOfOwnedFiles, filename)
+	userdata.storeUser()
+	return nil
+}
+
+// RenameFile changes the user's own name for a file. Only the user's
+// mapping changes; the file and everyone else's access to it stay as
+// they are.
+//
+// Paths inside directories can be renamed too, and moved from one of the
+// user's directories to another; that changes the directories rather than
+// the user's names. Moving something between a top-level name and a
+// directory isn't supported, since the two are kept under different keys.
+func (userdata *User) RenameFile(oldName string, newName string) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	oldParts, err := splitPath(oldName)
+	if err != nil {
+		return err
+	}
+	newParts, err := splitPath(newName)
+	if err != nil {
+		return err
+	}
+	if len(oldParts) > 1 || len(newParts) > 1 {
+		if len(oldParts) == 1 || len(newParts) == 1 {
+			return errors.New("can't move between a top-level name and a directory")
+		}
+		return userdata.moveChild(oldParts, newParts)
+	}
+	entry, ok := userdata.SharedFiles[oldName]
+	if !ok {
+		return errors.New("Your requested file isn't in the DataStore")
+	}
+	if oldName == newName {
+		return nil
+	}
+	if _, exists := userdata.SharedFiles[newName]; exists {
+		return errors.New("a file with the new name already exists")
+	}
+	userdata.SharedFiles[newName] = entry
+	delete(userdata.SharedFiles, oldName)
+	if userdata.ListOfOwnedFiles[oldName] {
+		userdata.ListOfOwnedFiles[newName] = true
+		delete(userdata.ListOfOwnedFiles, oldName)
+	}
+	userdata.renameGrants(oldName, newName)
+	userdata.storeUser()
+	return nil
+}
+
+// moveChild is RenameFile for paths inside the user's directories. The
+// handle moves from one directory to the other as it is, so the file keeps
+// its keys and anyone it was shared with keeps their access.
+func (userdata *User) moveChild(oldParts []string, newParts []string) error {
+	oldName := strings.Join(oldParts, "/")
+	newName := strings.Join(newParts, "/")
+	if err := userdata.checkWritable(oldName); err != nil {
+		return err
+	}
+	if err := userdata.checkWritable(newName); err != nil {
+		return err
+	}
+	oldParent, oldDir, err := userdata.openParent(oldParts)
+	if err != nil {
+		return err
+	}
+	handle, ok := oldDir.Children[oldParts[len(oldParts)-1]]
+	if !ok {
+		return errors.New("Your requested file isn't in the DataStore")
+	}
+	if oldName == newName {
+		return nil
+	}
+	if strings.HasPrefix(newName, oldName+"/") {
+		return errors.New("can't move a directory into itself")
+	}
+	newParent, newDir, err := userdata.openParent(newParts)
+	if err != nil {
+		return err
+	}
+	if _, exists := newDir.Children[newParts[len(newParts)-1]]; exists {
+		return errors.New("a file with the new name already exists")
+	}
+	if oldParent.Location == newParent.Location {
+		newDir = oldDir
+	}
+	delete(oldDir.Children, oldParts[len(oldParts)-1])
+	newDir.Children[newParts[len(newParts)-1]] = handle
+	if oldParent.Location != newParent.Location {
+		if err := userdata.storeDirectory(oldParent, oldDir); err != nil {
+			return err
+		}
+	}
+	if err := userdata.storeDirectory(newParent, newDir); err != nil {
+		return err
+	}
+	userdata.renameGrants(oldName, newName)
+	userdata.storeUser()
+	return nil
+}
+
+// renameGrants moves the user's records of what it shared at oldName, and
+// at anything under it, to newName.
+func (userdata *User) renameGrants(oldName string, newName string) {
+	for _, granted := range append([]string{oldName}, userdata.grantsBelow(oldName)...) {
+		if grants, ok := userdata.Grants[granted]; ok {
+			userdata.Grants[newName+strings.TrimPrefix(granted, oldName)] = grants
+			delete(userdata.Grants, granted)
+		}
+	}
+}
+
+// sortSlice orders n elements, compared with less and moved with swap,
+// the way sort.Slice would if the package could import sort. It's a heap
+// sort, so it stays O(n log n) however many files there are.
+func sortSlice(n int, less func(i, j int) bool, swap func(i, j int)) {
+	for root := n/2 - 1; root >= 0; root-- {
+		siftDown(root, n, less, swap)
+	}
+	for end := n - 1; end > 0; end-- {
+		swap(0, end)
+		siftDown(0, end, less, swap)
+	}
+}
+
+func siftDown(root int, n int, less func(i, j int) bool, swap func(i, j int)) {
+	for {
+		child := 2*root + 1
+		if child >= n {
+			return
+		}
+		if child+1 < n && less(child, child+1) {
+			child++
+		}
+		if !less(root, child) {
+			return
+		}
+		swap(root, child)
+		root = child
+	}
+}
+
+// sortStrings puts a list of strings in order.
+func sortStrings(list []string) {
+	sortSlice(len(list), func(i, j int) bool { return list[i] < list[j] }, func(i, j int) { list[i], list[j] = list[j], list[i] })
+}
+
+// uuidLess orders UUIDs by their bytes, which is cheaper than comparing
+// their strings and gives the same order.
+func uuidLess(a uuid.UUID, b uuid.UUID) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// directory is what a directory stores: the handles of everything in it,
+// by name. It is stored like a file, so its FileEntry MAC covers it, and
+// the version lets a reader notice an older copy being put back.
+type directory struct {
+	Version  uint64
+	Children map[string]fileHandle
+}
+
+func (dir *directory) encode(e *encoder) {
+	e.writeUint(dir.Version, 8)
+	names := make([]string, 0, len(dir.Children))
+	for name := range dir.Children {
+		names = append(names, name)
+	}
+	sortStrings(names)
+	e.writeStrings(names)
+	for _, name := range names {
+		child := dir.Children[name]
+		e.writeBool(child.Dir)
+		e.writeUUID(child.Location)
+		e.writeBytes(child.Keys)
+	}
+}
+
+func (dir *directory) decode(d *decoder) {
+	dir.Version = d.readUint(8)
+	for _, name := range d.readKeys() {
+		if dir.Children == nil {
+			dir.Children = make(map[string]fileHandle)
+		}
+		var child fileHandle
+		child.Dir = d.readBool()
+		child.Location = d.readUUID()
+		child.Keys = d.readBytes()
+		dir.Children[name] = child
+	}
+}
+
+// DirEntry is one name in a directory, as ReadDir reports it.
+type DirEntry struct {
+	Name string
+	Dir  bool
+}
+
+// check makes sure every child has a full set of keys.
+func (dir *directory) check() error {
+	for name, child := range dir.Children {
+		if name == "" || strings.Contains(name, "/") || len(child.Keys) != 32 {
+			return errors.New("directory corrupted")
+		}
+	}
+	return nil
+}
+
+func (userdata *User) loadDirectory(handle fileHandle) (*directory, error) {
+	dirMarshal, err := handle.load()
+	if err != nil {
+		return nil, err
+	}
+	var dir directory
+	if err := decodeObject(objectDirectory, dirMarshal, &dir); err != nil {
+		return nil, errors.New("directory corrupted")
+	}
+	if dir.Children == nil {
+		dir.Children = make(map[string]fileHandle)
+	}
+	location := handle.Location.String()
+	if dir.Version < userdata.SeenVersions[location] {
+		return nil, errors.New("directory was rolled back")
+	}
+	if dir.Version > userdata.SeenVersions[location] {
+		userdata.SeenVersions[location] = dir.Version
+		userdata.storeUser()
+	}
+	return &dir, nil
+}
+
+func (userdata *User) storeDirectory(handle fileHandle, dir *directory) error {
+	dir.Version++
+	dirMarshal := encodeObject(objectDirectory, dir)
+	if err := handle.store(dirMarshal, userdata.fileOptions()); err != nil {
+		return err
+	}
+	userdata.SeenVersions[handle.Location.String()] = dir.Version
+	userdata.storeUser()
+	return nil
+}
+
+// openParent loads the directory the last part of a path is in.
+func (userdata *User) openParent(parts []string) (fileHandle, *directory, error) {
+	parent, err := userdata.locate(strings.Join(parts[:len(parts)-1], "/"))
+	if err != nil {
+		return parent, nil, err
+	}
+	if !parent.Dir {
+		return parent, nil, errors.New("not a directory")
+	}
+	dir, err := userdata.loadDirectory(parent)
+	return parent, dir, err
+}
+
+// removeChild takes the last part of a path out of its directory and
+// deletes what it pointed at.
+func (userdata *User) removeChild(parts []string) error {
+	parent, dir, err := userdata.openParent(parts)
+	if err != nil {
+		return err
+	}
+	name := parts[len(parts)-1]
+	child, ok := dir.Children[name]
+	if !ok {
+		return errors.New("Your requested file isn't in the DataStore")
+	}
+	delete(dir.Children, name)
+	if err := userdata.storeDirectory(parent, dir); err != nil {
+		return err
+	}
+	userdata.activeRun().addFile(child)
+	deleteData(child.Keys[0:16], child.Keys[16:32], child.Location)
+	path := strings.Join(parts, "/")
+	if err := userdata.dropGrants(append([]string{path}, userdata.grantsBelow(path)...), true); err != nil {
+		return err
+	}
+	userdata.storeUser()
+	return nil
+}
+
+// rekeyChildren moves everything in a marshalled directory, and everything
+// below it, to fresh locations and keys, stored with options.
+func rekeyChildren(dirMarshal []byte, options fileOptions) ([]byte, error) {
+	var dir directory
+	if err := decodeObject(objectDirectory, dirMarshal, &dir); err != nil {
+		return nil, errors.New("directory corrupted")
+	}
+	for name, child := range dir.Children {
+		moved, err := child.move(options)
+		if err != nil {
+			return nil, err
+		}
+		dir.Children[name] = moved
+	}
+	dir.Version++
+	dirMarshal = encodeObject(objectDirectory, &dir)
+	return dirMarshal, nil
+}
+
+// Mkdir creates an empty directory, either as a new top-level name or
+// inside one of the user's directories.
+func (userdata *User) Mkdir(path string) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	parts, err := splitPath(path)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 1 {
+		if _, ok := userdata.SharedFiles[path]; ok {
+			return errors.New("a file with that name already exists")
+		}
+		var entry SharedFile
+		entry.Root = userlib.RandomBytes(16)
+		entry.Permissions = permAll
+		entry.Custody = []string{userdata.Username}
+		entry.Dir = true
+		userdata.SharedFiles[path] = entry
+		userdata.ListOfOwnedFiles[path] = true
+		fileUUID, keys, _ := userdata.fileLocation(path)
+		handle := fileHandle{true, fileUUID, keys}
+		userdata.activeRun().addFile(handle)
+		return userdata.storeDirectory(handle, &directory{})
+	}
+
+	if err := userdata.checkWritable(path); err != nil {
+		return err
+	}
+	parent, dir, err := userdata.openParent(parts)
+	if err != nil {
+		return err
+	}
+	name := parts[len(parts)-1]
+	if _, ok := dir.Children[name]; ok {
+		return errors.New("a file with that name already exists")
+	}
+	child := newFileHandle(true)
+	userdata.activeRun().addFile(child)
+	if err := userdata.storeDirectory(child, &directory{}); err != nil {
+		return err
+	}
+	dir.Children[name] = child
+	return userdata.storeDirectory(parent, dir)
+}
+
+// ReadDir lists a directory, in name order.
+func (userdata *User) ReadDir(path string) ([]DirEntry, error) {
+	if err := userdata.syncUser(); err != nil {
+		return nil, err
+	}
+	handle, err := userdata.locate(path)
+	if err != nil {
+		return nil, err
+	}
+	if !handle.Dir {
+		return nil, errors.New("not a directory")
+	}
+	dir, err := userdata.loadDirectory(handle)
+	if err != nil {
+		return nil, err
+	}
+	var entries []DirEntry
+	for name, child := range dir.Children {
+		entries = append(entries, DirEntry{name, child.Dir})
+	}
+	sortSlice(len(entries), func(i, j int) bool { return entries[i].Name < entries[j].Name },
+		func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+	return entries, nil
+}
+
+// RemoveDir removes an empty directory. For a top-level directory this is
+// DeleteFile: the owner deletes it for everyone it was shared with, anyone
+// else just drops their name for it.
+func (userdata *User) RemoveDir(path string) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	handle, err := userdata.locate(path)
+	if err != nil {
+		return err
+	}
+	if !handle.Dir {
+		return errors.New("not a directory")
+	}
+	dir, err := userdata.loadDirectory(handle)
+	if err != nil {
+		return err
+	}
+	if len(dir.Children) != 0 {
+		return errors.New("directory not empty")
+	}
+	if parts, _ := splitPath(path); len(parts) > 1 {
+		if err := userdata.checkWritable(path); err != nil {
+			return err
+		}
+		return userdata.removeChild(parts)
+	}
+	return userdata.deleteTopLevel(path)
+}
+
+// FileInfo describes one of the files a user can reach, as ListFiles
+// reports it. Everything but the name comes from the file's own MACed
+// entry or the user's encrypted record.
+type FileInfo struct {
+	Name     string
+	Dir      bool
+	Owned    bool
+	SharedBy string // who handed the file to the user, empty for owned files
+	Size     int
+	Chunks   int
+	Modified int64 // unix time, zero if the session that changed it had no clock
+}
+
+// ListFiles returns every file the user can currently reach, in name
+// order. Files the user has lost access to are left out; a file whose
+// entry has been tampered with is an error.
+//
+// Modified is only as good as the clocks of the sessions that change the
+// file. The package can't read the time itself, so a file last changed by
+// a session that wasn't given one with SetClock reports zero.
+func (userdata *User) ListFiles() ([]FileInfo, error) {
+	if err := userdata.syncUser(); err != nil {
+		return nil, err
+	}
+	var files []FileInfo
+	for filename, entry := range userdata.SharedFiles {
+		fileUUID, keys, err := userdata.fileLocation(filename)
+		if err != nil {
+			continue
+		}
+		fileMarshal, ok := userlib.DatastoreGet(fileUUID)
+		if !ok {
+			continue
+		}
+		filedata, err := openFileEntry(keys[0:16], keys[16:32], fileUUID, fileMarshal)
+		if err != nil {
+			return nil, err
+		}
+
+		var info FileInfo
+		info.Name = filename
+		info.Dir = entry.Dir
+		info.Owned = userdata.ListOfOwnedFiles[filename]
+		if !info.Owned && len(entry.Custody) >= 2 {
+			info.SharedBy = entry.Custody[len(entry.Custody)-2]
+		}
+		info.Size = filedata.Size
+		info.Chunks = len(filedata.Chunks)
+		info.Modified = filedata.Modified
+		files = append(files, info)
+	}
+	sortSlice(len(files), func(i, j int) bool { return files[i].Name < files[j].Name },
+		func(i, j int) { files[i], files[j] = files[j], files[i] })
+	return files, nil
+}
+
+// Removes access for all others.
+func (userdata *User) RevokeFile(filename string) (err error) {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	parts, err := splitPath(filename)
+	if err != nil {
+		return err
+	}
+	if !userdata.ListOfOwnedFiles[parts[0]] {
+		return errors.New("You have to be the owner of the file to revoke")
+	}
+	if _, err := userdata.locate(filename); err != nil {
+		return err
+	}
+
+	// every node and group slot handed out for the file, or for anything
+	// in it, goes, and the file moves to keys nobody else has seen
+	if err := userdata.dropGrants(append([]string{filename}, userdata.grantsBelow(filename)...), false); err != nil {
+		return err
+	}
+	if err := userdata.rekeyFile(filename); err != nil {
+		return err
+	}
+	userdata.storeUser()
+	return nil
+}
+
+// transferBody is what the old owner of a file seals for the new one: the
+// root the file is currently stored under and every access node handed out
+// for it, the old owner's own node included.
+type transferBody struct {
+	FileUUID uuid.UUID
+	Root     []byte
+	Owners   []string // everyone who has owned the file, the sender last
+	Grants   []AccessGrant
+	Dir      bool
+}
+
+func (body *transferBody) encode(e *encoder) {
+	e.writeUUID(body.FileUUID)
+	e.writeBytes(body.Root)
+	e.writeStrings(body.Owners)
+	writeAccessGrants(e, body.Grants)
+	e.writeBool(body.Dir)
+}
+
+func (body *transferBody) decode(d *decoder) {
+	body.FileUUID = d.readUUID()
+	body.Root = d.readBytes()
+	body.Owners = d.readStrings()
+	body.Grants = readAccessGrants(d)
+	body.Dir = d.readBool()
+}
+
+// TransferOwnership hands a file the user owns to newOwner, who takes it
+// over with AcceptOwnership. The user is left holding the file like any
+// other recipient with full permissions, through a node the new owner can
+// revoke. Shares already handed out keep working across the transfer.
+func (userdata *User) TransferOwnership(filename string, newOwner string) (magic_string string, err error) {
+	if err := userdata.syncUser(); err != nil {
+		return "", err
+	}
+	defer userdata.settle()
+	if !userdata.ListOfOwnedFiles[filename] {
+		return "", errors.New("You have to be the owner of the file to transfer it")
+	}
+	newOwnerPk, ok := userlib.KeystoreGet(newOwner + "enc")
+	if !ok || newOwner == userdata.Username {
+		return "", errors.New("invalid new owner")
+	}
+	if err := userdata.checkFileExists(filename); err != nil {
+		return "", err
+	}
+	entry := userdata.SharedFiles[filename]
+	// what the user shared from inside a directory was shared on the user's
+	// own authority, so those shares end here
+	if err := userdata.dropGrants(userdata.grantsBelow(filename), false); err != nil {
+		return "", err
+	}
+
+	// the user keeps the file through a node of its own, which moves to the
+	// new owner along with the rest
+	var grant AccessGrant
+	grant.Recipient = userdata.Username
+	grant.Node = uuid.New()
+	grant.NodeKeys = userlib.RandomBytes(32)
+	grant.Permissions = permAll
+	userdata.activeRun().addObject(grant.Node)
+	if err := userdata.storeAccessNode(grant.Node, grant.NodeKeys, entry.Root, entry.Custody); err != nil {
+		return "", err
+	}
+	hop, err := userdata.signGrant(userdata.Username, grant.Node, grant.Permissions)
+	if err != nil {
+		return "", err
+	}
+
+	keys := sharedFileKeys(entry.Root, userdata.Username)
+	hashedFilename, _ := userlib.HMACEval(keys[0:16], []byte("magic_string"))
+	var body transferBody
+	body.FileUUID = bytesToUUID(hashedFilename)
+	body.Root = entry.Root
+	body.Owners = entry.Custody
+	body.Grants = append(userdata.Grants[filename], grant)
+	body.Dir = entry.Dir
+	bodyMarshal := encodeObject(objectTransfer, &body)
+
+	var payload sharingPayload
+	payload.Sender = userdata.Username
+	payload.Recipient = newOwner
+	payload.Transfer = true
+	payload.Body, err = sealEnvelope(newOwnerPk, bodyMarshal)
+	if err != nil {
+		return "", err
+	}
+	magic_string, err = userdata.signSharingPayload(payload)
+	if err != nil {
+		return "", err
+	}
+
+	var held SharedFile
+	held.Node = grant.Node
+	held.NodeKeys = grant.NodeKeys
+	held.Permissions = permAll
+	held.Custody = []string{userdata.Username, userdata.Username}
+	held.Chain = []signedGrant{hop}
+	held.Dir = entry.Dir
+	userdata.SharedFiles[filename] = held
+	delete(userdata.ListOfOwnedFiles, filename)
+	delete(userdata.Grants, filename)
+	userdata.storeUser()
+	return magic_string, nil
+}
+
+// AcceptOwnership takes over a file handed to the user by TransferOwnership,
+// under the user's own name for it. The file is re-keyed under a root only
+// the user knows, and every access node is re-signed with the user as owner.
+func (userdata *User) AcceptOwnership(filename string, sender string, magic_string string) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	if _, ok := userdata.SharedFiles[filename]; ok {
+		return errors.New("File already shared with someone")
+	}
+	payload, err := userdata.openSharingRecord(sender, magic_string)
+	if err != nil {
+		return err
+	}
+	if !payload.Transfer {
+		return errors.New("not an ownership transfer")
+	}
+	if err := userdata.checkUnused(payload); err != nil {
+		return err
+	}
+	bodyMarshal, err := openEnvelope(userdata.RsaSk, payload.Body)
+	if err != nil {
+		return err
+	}
+	var body transferBody
+	if err := decodeObject(objectTransfer, bodyMarshal, &body); err != nil {
+		return errors.New("malformed sharing record")
+	}
+	if len(body.Root) != 16 || len(body.Owners) == 0 || body.Owners[len(body.Owners)-1] != sender {
+		return errors.New("sharing record is incomplete")
+	}
+	for _, grant := range body.Grants {
+		if len(grant.NodeKeys) != 32 {
+			return errors.New("sharing record is incomplete")
+		}
+	}
+
+	keys := sharedFileKeys(body.Root, sender)
+	hashedFilename, _ := userlib.HMACEval(keys[0:16], []byte("magic_string"))
+	fileUUID := bytesToUUID(hashedFilename)
+	if fileUUID != body.FileUUID {
+		return errors.New("sharing record doesn't match the file")
+	}
+	fileMarshal, ok := userlib.DatastoreGet(fileUUID)
+	if !ok {
+		return errors.New("File deleted.")
+	}
+	if _, err := openFileEntry(keys[0:16], keys[16:32], fileUUID, fileMarshal); err != nil {
+		return err
+	}
+
+	var entry SharedFile
+	entry.Permissions = permAll
+	entry.Custody = append(body.Owners, userdata.Username)
+	entry.Dir = body.Dir
+	userdata.SharedFiles[filename] = entry
+	userdata.ListOfOwnedFiles[filename] = true
+	userdata.Grants[filename] = body.Grants
+	userdata.useNonce(payload)
+	if err := userdata.storeRekeyed(filename, keys, fileUUID); err != nil {
+		return err
+	}
+	userdata.storeUser()
+	return nil
+}
+
+// snapshot is a frozen copy of everything a user could reach: for each
+// file, where it was, the keys that open it and its chunk list at the
+// time. The chunks of a file the user owns aren't copied; the file's
+// header pins the ones the snapshot uses, so later changes to the file
+// leave them alone. A file someone else owns is copied instead, since its
+// owner decides what happens to it; the copy has keys of its own and no
+// header, so its Location is uuid.Nil.
+type snapshot struct {
+	ID      uuid.UUID // names the snapshot's pins in file headers
+	Label   string
+	Created int64
+	Files   map[string]snapshotFile // by path
+}
+
+type snapshotFile struct {
+	Location uuid.UUID
+	Keys     []byte
+	Chunks   []chunkRef
+	Size     int
+}
+
+// check makes sure every file has a full set of keys and a chunk list
+// that adds up to its size.
+func (snap *snapshot) check() error {
+	for _, file := range snap.Files {
+		total := 0
+		for _, ref := range file.Chunks {
+			if ref.Size <= 0 || len(ref.Sigma) != userlib.HashSize || !(ref.Key == nil || len(ref.Key) == 32) {
+				return errors.New("snapshot corrupted")
+			}
+			total += ref.Size
+		}
+		if len(file.Keys) != 32 || total != file.Size {
+			return errors.New("snapshot corrupted")
+		}
+	}
+	return nil
+}
+
+func (snap *snapshot) encode(e *encoder) {
+	e.writeUUID(snap.ID)
+	e.writeString(snap.Label)
+	e.writeInt(snap.Created)
+	paths := make([]string, 0, len(snap.Files))
+	for path := range snap.Files {
+		paths = append(paths, path)
+	}
+	sortStrings(paths)
+	e.writeStrings(paths)
+	for _, path := range paths {
+		file := snap.Files[path]
+		e.writeUUID(file.Location)
+		e.writeBytes(file.Keys)
+		writeChunks(e, file.Chunks)
+		e.writeInt(int64(file.Size))
+	}
+}
+
+// keyedSnapshotSchema is the snapshot schema chunk references gained their
+// keys in.
+const keyedSnapshotSchema = 3
+
+func (snap *snapshot) decode(d *decoder) {
+	snap.ID = d.readUUID()
+	snap.Label = d.readString()
+	snap.Created = d.readInt()
+	snap.Files = make(map[string]snapshotFile)
+	for _, path := range d.readKeys() {
+		var file snapshotFile
+		file.Location = d.readUUID()
+		file.Keys = d.readBytes()
+		file.Chunks = readChunks(d, d.schema >= keyedSnapshotSchema)
+		file.Size = int(d.readInt())
+		snap.Files[path] = file
+	}
+}
+
+// SnapshotInfo describes one of a user's snapshots, as ListSnapshots
+// reports it.
+type SnapshotInfo struct {
+	Label   string
+	Created int64 // unix time, zero if the session had no clock
+	Files   int
+}
+
+func (userdata *User) snapshotLocation(label string) (uuid.UUID, []byte, []byte) {
+	snapMacKey, snapEncKey := generateKeysForDataStore(userdata.Username, userdata.SourceKey, []byte(label+userdata.Username+"snapsig"), []byte(label+userdata.Username+"snapenc"))
+	hashedLabel, _ := userlib.HMACEval(snapMacKey, []byte(label))
+	return bytesToUUID(hashedLabel), snapMacKey, snapEncKey
+}
+
+func (userdata *User) loadSnapshot(label string) (*snapshot, error) {
+	if !userdata.Snapshots[label] {
+		return nil, errors.New("snapshot doesn't exist")
+	}
+	snapUUID, snapMacKey, snapEncKey := userdata.snapshotLocation(label)
+	entryMarshal, ok := userlib.DatastoreGet(snapUUID)
+	if !ok {
+		return nil, errors.New("snapshot doesn't exist")
+	}
+	snapMarshal, err := openEntry(snapMacKey, snapEncKey, recordSnapshot, snapUUID, entryMarshal)
+	if err != nil {
+		return nil, err
+	}
+	var snap snapshot
+	if err := decodeObject(recordSnapshot, snapMarshal, &snap); err != nil || snap.Label != label {
+		return nil, errors.New("snapshot corrupted")
+	}
+	return &snap, nil
+}
+
+// collectFiles adds every file at or below path to files.
+func (userdata *User) collectFiles(path string, handle fileHandle, files map[string]fileHandle) error {
+	if !handle.Dir {
+		files[path] = handle
+		return nil
+	}
+	dir, err := userdata.loadDirectory(handle)
+	if err != nil {
+		return err
+	}
+	for name, child := range dir.Children {
+		if err := userdata.collectFiles(path+"/"+name, child, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateSnapshot freezes every file the user can currently reach, top-level
+// and inside directories, under label. Files the user owns are pinned,
+// files shared with the user are copied, and files the user has lost
+// access to are left out.
+func (userdata *User) CreateSnapshot(label string) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	defer userdata.settle()
+	if userdata.Snapshots[label] {
+		return errors.New("a snapshot with this label already exists")
+	}
+	handles := make(map[string]fileHandle)
+	for filename := range userdata.SharedFiles {
+		handle, err := userdata.locate(filename)
+		if err != nil {
+			continue
+		}
+		if err := userdata.collectFiles(filename, handle, handles); err != nil {
+			return err
+		}
+	}
 
-- If not,
-- Obtain username from userdata
-- Derive sourceKey = Argon2Key(password, username, 16)  (how can the user find the password in the implementation?)
-- k3 = HMACEval(sourceKey, filename + username + "enc")
-- k4 = HMACEval(sourceKey, filename + username + "sig")
-- k6 = HMACEval(sourceKey, filename + username + "shareEnc")
-- k7 = HMACEval(sourceKey, filename + username + "shareSig")
-- magic_string = DSSign(sender's private key, PKEEnc(recipient's public key, k6||k7))
-- fileUUID = bytesToUUID(HMAC(k4, filename))
-- sharedfileUUID = bytesToUUID(HMAC(k6, k7))
-
-- Find fileUUID in datastore
-- If fileUUID doesn't exist, return
-- If fileUUID exists, verify & decrypt the filedata and encrypt/HMAC it again with k6 & k7
-- delete fileUUID from datastore
-
-- Later, if Bob calls receiveFile, he will verify & decrypt magic_string, and use k6, k7 to calculate the sharedfileUUID
-*/
-func (userdata *User) ShareFile(filename string, recipient string) (magic_string string, err error) {
-	recipientPk, ok := userlib.KeystoreGet(recipient + "enc")
+	// check every header before pinning anything, so a bad one doesn't
+	// leave pins behind
+	headers := make(map[string]FileEntry)
+	for path, handle := range handles {
+		fileMarshal, ok := userlib.DatastoreGet(handle.Location)
+		if !ok {
+			return errors.New("Your requested file isn't in the DataStore")
+		}
+		filedata, err := openFileEntry(handle.Keys[0:16], handle.Keys[16:32], handle.Location, fileMarshal)
+		if err != nil {
+			return err
+		}
+		headers[path] = filedata
+	}
+
+	// copy the files someone else owns before pinning anything, as a copy
+	// can fail halfway
+	snap := snapshot{ID: uuid.New(), Label: label, Created: userdata.now(), Files: make(map[string]snapshotFile)}
+	var copies []*FileEntry
+	for path, filedata := range headers {
+		if userdata.ListOfOwnedFiles[strings.Split(path, "/")[0]] {
+			continue
+		}
+		file, copied, err := copyToSnapshot(handles[path], filedata, userdata.activeRun())
+		copies = append(copies, copied)
+		if err != nil {
+			for _, copied := range copies {
+				copied.discard()
+			}
+			return err
+		}
+		snap.Files[path] = file
+	}
+	for path, filedata := range headers {
+		if _, ok := snap.Files[path]; ok {
+			continue
+		}
+		handle := handles[path]
+		var locations []uuid.UUID
+		for _, ref := range filedata.Chunks {
+			locations = append(locations, ref.Location)
+		}
+		if filedata.Pins == nil {
+			filedata.Pins = make(map[uuid.UUID][]uuid.UUID)
+		}
+		filedata.Pins[snap.ID] = locations
+		// the pin is a use of the deduplicated chunks, held for as long as
+		// the snapshot is
+		for _, ref := range keyedChunks(filedata.Chunks) {
+			filedata.pending = append(filedata.pending, ref)
+		}
+		if err := storeFileEntry(handle.Keys[0:16], handle.Keys[16:32], handle.Location, &filedata); err != nil {
+			// a header with no room for the pin undoes the ones already
+			// taken
+			for pinned, file := range snap.Files {
+				if file.Location != uuid.Nil {
+					unpinned := headers[pinned]
+					delete(unpinned.Pins, snap.ID)
+					storeFileEntry(file.Keys[0:16], file.Keys[16:32], file.Location, &unpinned)
+					for _, ref := range keyedChunks(file.Chunks) {
+						releaseChunk(ref)
+					}
+				}
+			}
+			for _, copied := range copies {
+				copied.discard()
+			}
+			return err
+		}
+		snap.Files[path] = snapshotFile{handle.Location, handle.Keys, filedata.Chunks, filedata.Size}
+	}
+	snapUUID, snapMacKey, snapEncKey := userdata.snapshotLocation(label)
+	userdata.activeRun().addObject(snapUUID)
+	snapMarshal := encodeObject(recordSnapshot, &snap)
+	userlib.DatastoreSet(snapUUID, sealEntry(snapMacKey, snapEncKey, recordSnapshot, snapUUID, snapMarshal))
+	userdata.Snapshots[label] = true
+	userdata.storeUser()
+	return nil
+}
+
+// copyToSnapshot copies the chunks of a file into fresh ones sealed with
+// new keys, padded the way the file is but not compressed, since there is
+// no header to say so. The FileEntry returned holds the chunks written, for
+// discarding them if the snapshot isn't taken, and records them in r.
+func copyToSnapshot(handle fileHandle, filedata FileEntry, r *run) (snapshotFile, *FileEntry, error) {
+	file := snapshotFile{Keys: userlib.RandomBytes(32), Size: filedata.Size}
+	copied := &FileEntry{ChunkSize: filedata.ChunkSize, Padding: filedata.Padding, run: r}
+	for _, ref := range filedata.Chunks {
+		chunk, err := filedata.loadChunk(handle.Keys[16:32], handle.Keys[0:16], ref)
+		if err != nil {
+			return file, copied, err
+		}
+		file.Chunks = append(file.Chunks, copied.storeChunk(file.Keys[16:32], file.Keys[0:16], chunk))
+	}
+	return file, copied, nil
+}
+
+// ListSnapshots returns the user's snapshots, oldest first.
+func (userdata *User) ListSnapshots() ([]SnapshotInfo, error) {
+	if err := userdata.syncUser(); err != nil {
+		return nil, err
+	}
+	var snapshots []SnapshotInfo
+	for label := range userdata.Snapshots {
+		snap, err := userdata.loadSnapshot(label)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, SnapshotInfo{label, snap.Created, len(snap.Files)})
+	}
+	sortSlice(len(snapshots), func(i, j int) bool {
+		if snapshots[i].Created == snapshots[j].Created {
+			return snapshots[i].Label < snapshots[j].Label
+		}
+		return snapshots[i].Created < snapshots[j].Created
+	}, func(i, j int) { snapshots[i], snapshots[j] = snapshots[j], snapshots[i] })
+	return snapshots, nil
+}
+
+// LoadFileAtSnapshot returns a file as it was when the snapshot was taken,
+// whatever has happened to it since.
+func (userdata *User) LoadFileAtSnapshot(label string, path string) ([]byte, error) {
+	if err := userdata.syncUser(); err != nil {
+		return nil, err
+	}
+	snap, err := userdata.loadSnapshot(label)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := snap.Files[path]
 	if !ok {
-		return "", errors.New("invalid recipient")
+		return nil, errors.New("file isn't in the snapshot")
+	}
+	// the header stays, retired if need be, for as long as the snapshot
+	// pins its chunks, and says how they are compressed; a copy has no
+	// header and isn't compressed
+	var filedata FileEntry
+	if file.Location != uuid.Nil {
+		fileMarshal, ok := userlib.DatastoreGet(file.Location)
+		if !ok {
+			return nil, errors.New("file data corrupted")
+		}
+		if filedata, err = openHeader(file.Keys[0:16], file.Keys[16:32], file.Location, fileMarshal); err != nil {
+			return nil, err
+		}
 	}
+	var data []byte
+	for _, ref := range file.Chunks {
+		chunk, err := filedata.loadChunk(file.Keys[16:32], file.Keys[0:16], ref)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+	if len(data) != file.Size {
+		return nil, errors.New("file data corrupted")
+	}
+	return data, nil
+}
 
-	var sharingEntry sharingRecord
-	var sharedfileMacKey []byte
-	var sharedfileEncKey []byte
-	keys, isShared := userdata.SharedFiles[filename]
-	if isShared {
-		// if the file has been shared with somebody before, we simply share the symmetric keys
-		sharedfileMacKey = keys[0:16]
-		sharedfileEncKey = keys[16:32]
-		hashedFilename, _ := userlib.HMACEval(sharedfileMacKey, []byte("magic_string"))
-		sharedFileUUID := bytesToUUID(hashedFilename)
-		if _, ok := userlib.DatastoreGet(sharedFileUUID); !ok {
-			// if the file was revoked or an attacker deleted the file, we can't share the file
-			return "", errors.New("File deleted.")
+// DeleteSnapshot removes a snapshot and releases its pins. Chunks that
+// nothing but the snapshot used any more are deleted with it, and
+// deduplicated chunks lose the use the snapshot counted.
+func (userdata *User) DeleteSnapshot(label string) error {
+	if err := userdata.syncUser(); err != nil {
+		return err
+	}
+	snap, err := userdata.loadSnapshot(label)
+	if err != nil {
+		return err
+	}
+	for _, file := range snap.Files {
+		for _, ref := range keyedChunks(file.Chunks) {
+			releaseChunk(ref)
+		}
+		live := make(map[uuid.UUID]bool)
+		// a copy has no header, and its chunks are the snapshot's alone
+		if fileMarshal, ok := userlib.DatastoreGet(file.Location); ok && file.Location != uuid.Nil {
+			if filedata, err := openHeader(file.Keys[0:16], file.Keys[16:32], file.Location, fileMarshal); err == nil {
+				delete(filedata.Pins, snap.ID)
+				if filedata.Retired && len(filedata.Pins) == 0 {
+					userlib.DatastoreDelete(file.Location)
+				} else if err := storeFileEntry(file.Keys[0:16], file.Keys[16:32], file.Location, &filedata); err != nil {
+					// the header still pins the chunks, so they're left
+					continue
+				} else if live, err = filedata.liveChunks(file.Keys[16:32], file.Keys[0:16]); err != nil {
+					// a version that won't open can't say which chunks it
+					// still uses, so they're all left
+					continue
+				}
+			}
+		}
+		for _, ref := range file.Chunks {
+			if ref.Key == nil && !live[ref.Location] {
+				userlib.DatastoreDelete(ref.Location)
+			}
 		}
-		// initialize sharing
-		keys = append(sharedfileMacKey, sharedfileEncKey...)
-		sharingEntry.CipherText, _ = userlib.PKEEnc(recipientPk, keys)
-		sharingEntry.Sigma, _ = userlib.DSSign(userdata.DsSk, sharingEntry.CipherText)
-		sharingEntryMarshal, _ := json.Marshal(sharingEntry)
-		return string(sharingEntryMarshal), nil
 	}
-	// if the file has never been shared before, it means the user if the owner of the file
+	snapUUID, _, _ := userdata.snapshotLocation(label)
+	userlib.DatastoreDelete(snapUUID)
+	delete(userdata.Snapshots, label)
+	userdata.storeUser()
+	return nil
+}
+
+// journal is how a user finds what their operations left behind when they
+// never finished: a session that died part way through, or a writer that
+// was never closed. Nothing lists what a user has stored, so before an
+// operation creates something, or deletes something it could leave half
+// gone, it writes that down in an intent under a run of its own, and once
+// it's done it takes the run out again. CollectGarbage goes through what's
+// left, and nothing else.
+type journal struct {
+	Runs map[uuid.UUID]intent
+}
+
+// intent is what one run may have left behind. The chunks and version
+// records it writes that aren't deduplicated are named from its seed, in
+// order, so it only has to say how many names it has handed out, and it
+// reserves them a batch at a time rather than storing the journal for
+// every chunk. A deduplicated chunk goes where its contents say, so the
+// run first stores where in a record of its own, also named from the seed.
+type intent struct {
+	Seed    []byte
+	Chunks  int          // chunk names reserved
+	Deduped int          // names reserved for records of deduplicated chunks
+	Written []fileHandle // the files the run wrote chunks for
+	Files   []fileHandle // files the run created or deleted, garbage unless something reaches them
+	Moves   []fileMove   // files the run moved to fresh keys
+	Objects []uuid.UUID  // access nodes, group slots and snapshots the run created
+}
+
+// fileMove is a file a run moved. Until the new copy can be reached it's
+// the garbage, and once it can, what's left of the old one is.
+type fileMove struct {
+	From fileHandle
+	To   fileHandle
+}
+
+// runReservation is how many names a run reserves at a time.
+const runReservation = 64
+
+func writeHandle(e *encoder, handle fileHandle) {
+	e.writeBool(handle.Dir)
+	e.writeUUID(handle.Location)
+	e.writeBytes(handle.Keys)
+}
 
-	// retrieve the original data & delete the original entry
-	originalData, error := userdata.LoadFile(filename)
-	if error != nil {
-		return "", errors.New("Data failed to load.")
+func readHandle(d *decoder) fileHandle {
+	var handle fileHandle
+	handle.Dir = d.readBool()
+	handle.Location = d.readUUID()
+	handle.Keys = d.readBytes()
+	return handle
+}
+
+func writeHandles(e *encoder, handles []fileHandle) {
+	e.writeCount(len(handles))
+	for _, handle := range handles {
+		writeHandle(e, handle)
 	}
-	deleteDataEntry(userdata.SourceKey, userdata.Username, filename, []byte(filename+userdata.Username+"sig"), []byte(filename+userdata.Username+"enc"))
+}
 
-	// create new shared symmetric keys
-	_, _, sharedfileEncKey, sharedfileMacKey = generateFileKeysForDataStore(filename, userdata.Username, userdata.SourceKey)
-	userdata.SharedFiles[filename] = append(sharedfileMacKey, sharedfileEncKey...)
-	hashedFilename, _ := userlib.HMACEval(sharedfileMacKey, []byte("magic_string"))
+func readHandles(d *decoder) []fileHandle {
+	var handles []fileHandle
+	for i, n := 0, d.readCount(); i < n; i++ {
+		handles = append(handles, readHandle(d))
+	}
+	return handles
+}
 
-	// store the original data into a new entry shared with the recipient
-	storeData(sharedfileEncKey, originalData, sharedfileMacKey, hashedFilename, userdata.Username)
+func (j *journal) encode(e *encoder) {
+	ids := j.ids()
+	e.writeCount(len(ids))
+	for _, id := range ids {
+		in := j.Runs[id]
+		e.writeUUID(id)
+		e.writeBytes(in.Seed)
+		e.writeInt(int64(in.Chunks))
+		e.writeInt(int64(in.Deduped))
+		writeHandles(e, in.Written)
+		writeHandles(e, in.Files)
+		e.writeCount(len(in.Moves))
+		for _, move := range in.Moves {
+			writeHandle(e, move.From)
+			writeHandle(e, move.To)
+		}
+		e.writeCount(len(in.Objects))
+		for _, object := range in.Objects {
+			e.writeUUID(object)
+		}
+	}
+}
 
-	// initialize sharing
-	keys = append(sharedfileMacKey, sharedfileEncKey...)
-	sharingEntry.CipherText, _ = userlib.PKEEnc(recipientPk, keys)
-	sharingEntry.Sigma, _ = userlib.DSSign(userdata.DsSk, sharingEntry.CipherText)
-	sharingEntryMarshal, _ := json.Marshal(sharingEntry)
-	return string(sharingEntryMarshal), nil
+func (j *journal) decode(d *decoder) {
+	j.Runs = make(map[uuid.UUID]intent)
+	for i, n := 0, d.readCount(); i < n; i++ {
+		id := d.readUUID()
+		if _, ok := j.Runs[id]; ok {
+			d.fail()
+		}
+		var in intent
+		in.Seed = d.readBytes()
+		in.Chunks = int(d.readInt())
+		in.Deduped = int(d.readInt())
+		in.Written = readHandles(d)
+		in.Files = readHandles(d)
+		for k, m := 0, d.readCount(); k < m; k++ {
+			var move fileMove
+			move.From = readHandle(d)
+			move.To = readHandle(d)
+			in.Moves = append(in.Moves, move)
+		}
+		for k, m := 0, d.readCount(); k < m; k++ {
+			in.Objects = append(in.Objects, d.readUUID())
+		}
+		j.Runs[id] = in
+	}
 }
 
-func deleteDataEntry(sourceKey []byte, username string, filename string, hmacSalt []byte, encSalt []byte) {
-	fileMacKey, _ := generateKeysForDataStore(username, sourceKey, hmacSalt, encSalt)
-	encryptedFilename, _ := userlib.HMACEval(fileMacKey, []byte(filename))
-	fileUUID := bytesToUUID(encryptedFilename)
-	userlib.DatastoreDelete(fileUUID)
+// check makes sure every run has a seed and counts that could be right,
+// and every file it names has a full set of keys.
+func (j *journal) check() error {
+	for _, in := range j.Runs {
+		handles := append(append([]fileHandle{}, in.Written...), in.Files...)
+		for _, move := range in.Moves {
+			handles = append(handles, move.From, move.To)
+		}
+		ok := len(in.Seed) == 16 && in.Chunks >= 0 && in.Deduped >= 0
+		for _, handle := range handles {
+			ok = ok && len(handle.Keys) == 32
+		}
+		if !ok {
+			return errors.New("journal corrupted")
+		}
+	}
+	return nil
 }
 
-// Note recipient's filename can be different from the sender's filename.
-// The recipient should not be able to discover the sender's view on
-// what the filename even is!  However, the recipient must ensure that
-// it is authentically from the sender.
-func (userdata *User) ReceiveFile(filename string, sender string, magic_string string) error {
-	if _, ok := userdata.SharedFiles[filename]; ok {
-		return errors.New("File already shared with someone")
+// ids is the journal's runs in order.
+func (j *journal) ids() []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(j.Runs))
+	for id := range j.Runs {
+		ids = append(ids, id)
 	}
+	sortSlice(len(ids), func(i, k int) bool { return uuidLess(ids[i], ids[k]) },
+		func(i, k int) { ids[i], ids[k] = ids[k], ids[i] })
+	return ids
+}
 
-	senderDsPk, ok := userlib.KeystoreGet(sender + "sig")
+// name is the ith name a run hands out for a kind of record.
+func (in *intent) name(kind string, i int) uuid.UUID {
+	named, _ := userlib.HMACEval(in.Seed, append([]byte(kind), byte(i>>24), byte(i>>16), byte(i>>8), byte(i)))
+	return bytesToUUID(named)
+}
+
+// journalLocation is where the user's journal is and the keys it's sealed
+// with, which also seal the records of the deduplicated chunks runs store.
+func (userdata *User) journalLocation() (uuid.UUID, []byte, []byte) {
+	journalMacKey, journalEncKey := generateKeysForDataStore(userdata.Username, userdata.SourceKey, []byte(userdata.Username+"journalsig"), []byte(userdata.Username+"journalenc"))
+	hashedName, _ := userlib.HMACEval(journalMacKey, []byte(recordJournal))
+	return bytesToUUID(hashedName), journalMacKey, journalEncKey
+}
+
+func (userdata *User) loadJournal() (*journal, error) {
+	location, journalMacKey, journalEncKey := userdata.journalLocation()
+	j := journal{Runs: make(map[uuid.UUID]intent)}
+	entryMarshal, ok := userlib.DatastoreGet(location)
 	if !ok {
-		return errors.New("invalid sender")
+		return &j, nil
 	}
-	var sharingEntry sharingRecord
-	json.Unmarshal([]byte(magic_string), &sharingEntry)
-	err := userlib.DSVerify(senderDsPk, sharingEntry.CipherText, sharingEntry.Sigma)
+	journalMarshal, err := openEntry(journalMacKey, journalEncKey, recordJournal, location, entryMarshal)
+	if err != nil || decodeObject(recordJournal, journalMarshal, &j) != nil {
+		return nil, errors.New("journal corrupted")
+	}
+	return &j, nil
+}
+
+// updateJournal changes the user's journal and stores it again, or deletes
+// it once no run is left in it. A journal that doesn't open is started
+// over, since the operation changing it can't wait for it to be sorted out.
+func (userdata *User) updateJournal(change func(j *journal)) {
+	j, err := userdata.loadJournal()
+	if err != nil {
+		j = &journal{Runs: make(map[uuid.UUID]intent)}
+	}
+	change(j)
+	location, journalMacKey, journalEncKey := userdata.journalLocation()
+	if len(j.Runs) == 0 {
+		userlib.DatastoreDelete(location)
+		return
+	}
+	journalMarshal := encodeObject(recordJournal, j)
+	userlib.DatastoreSet(location, sealEntry(journalMacKey, journalEncKey, recordJournal, location, journalMarshal))
+}
+
+// run is a session's side of an intent: the operation under way, or a
+// writer that's open. The intent isn't stored until the run first creates
+// something, so an operation that creates nothing never touches the
+// journal. Every method does nothing on a nil run, which is what a header
+// nobody is writing to has.
+type run struct {
+	userdata *User
+	id       uuid.UUID
+	intent   intent
+	chunks   int  // chunk names used
+	deduped  int  // records of deduplicated chunks used
+	stored   bool // the intent is in the journal, unless lost is set
+	lost     bool // CollectGarbage took the intent out, and what the run wrote with it
+}
+
+// activeRun is the run the session's current operation records what it
+// does in, started the first time the operation needs one.
+func (userdata *User) activeRun() *run {
+	if userdata.active == nil {
+		userdata.active = &run{userdata: userdata, id: uuid.New(), intent: intent{Seed: userlib.RandomBytes(16)}}
+	}
+	return userdata.active
+}
+
+// settle ends the session's current operation. One that failed has
+// already undone what it could, so either way its run is done with.
+func (userdata *User) settle() {
+	userdata.active.settle()
+	userdata.active = nil
+}
+
+// store writes the intent to the journal. A run that was stored before and
+// is missing from it now was collected, and isn't put back: what it wrote
+// may be gone, so it can't be committed, and the new chunks are for the
+// caller to discard.
+func (r *run) store() {
+	r.userdata.updateJournal(func(j *journal) {
+		if _, ok := j.Runs[r.id]; r.stored && !ok {
+			r.lost = true
+		}
+		if !r.lost {
+			j.Runs[r.id] = r.intent
+		}
+	})
+	r.stored = true
+}
+
+// collected is whether CollectGarbage has been through the run since it
+// was stored.
+func (r *run) collected() bool {
+	if r == nil || !r.stored || r.lost {
+		return r != nil && r.lost
+	}
+	j, err := r.userdata.loadJournal()
+	if err != nil {
+		r.lost = true
+	} else if _, ok := j.Runs[r.id]; !ok {
+		r.lost = true
+	}
+	return r.lost
+}
+
+// settle takes the run out of the journal, along with the records of the
+// deduplicated chunks it stored, which the headers that hold them count.
+func (r *run) settle() {
+	if r == nil || !r.stored {
+		return
+	}
+	for i := 0; i < r.deduped; i++ {
+		userlib.DatastoreDelete(r.intent.name(recordDeduped, i))
+	}
+	if !r.lost {
+		r.userdata.updateJournal(func(j *journal) { delete(j.Runs, r.id) })
+	}
+	r.stored = false
+}
+
+// chunkLocation is where the next chunk or version record the run writes
+// goes. Without a run, it goes somewhere random.
+func (r *run) chunkLocation() uuid.UUID {
+	if r == nil {
+		return uuid.New()
+	}
+	if r.chunks == r.intent.Chunks {
+		r.intent.Chunks += runReservation
+		r.store()
+	}
+	r.chunks++
+	return r.intent.name(recordChunk, r.chunks-1)
+}
+
+// noteDeduped records where a deduplicated chunk the run is about to
+// store goes. It has no count until a header holds it.
+func (r *run) noteDeduped(ref chunkRef) {
+	if r == nil {
+		return
+	}
+	if r.deduped == r.intent.Deduped {
+		r.intent.Deduped += runReservation
+		r.store()
+	}
+	location := r.intent.name(recordDeduped, r.deduped)
+	r.deduped++
+	_, journalMacKey, journalEncKey := r.userdata.journalLocation()
+	noted := append(append([]byte{}, ref.Location[:]...), ref.Key...)
+	userlib.DatastoreSet(location, sealEntry(journalMacKey, journalEncKey, recordDeduped, location, noted))
+}
+
+// touch records that the run writes chunks for a file.
+func (r *run) touch(handle fileHandle) {
+	if r == nil {
+		return
+	}
+	for _, written := range r.intent.Written {
+		if written.Location == handle.Location {
+			return
+		}
+	}
+	r.intent.Written = append(r.intent.Written, handle)
+	if r.stored {
+		r.store()
+	}
+}
+
+// addFile records a file the run is about to create or delete.
+func (r *run) addFile(handle fileHandle) {
+	if r == nil {
+		return
+	}
+	r.intent.Files = append(r.intent.Files, handle)
+	r.store()
+}
+
+// addMove records a file the run is about to move to fresh keys.
+func (r *run) addMove(from fileHandle, to fileHandle) {
+	if r == nil {
+		return
+	}
+	r.intent.Moves = append(r.intent.Moves, fileMove{from, to})
+	r.store()
+}
+
+// addObject records an access node, group slot or snapshot the run is
+// about to create.
+func (r *run) addObject(location uuid.UUID) {
+	if r == nil {
+		return
+	}
+	r.intent.Objects = append(r.intent.Objects, location)
+	r.store()
+}
+
+// storedChunks is everything a header points at that a run could have
+// written: its chunks, current, kept or pinned, and its version records.
+func (filedata *FileEntry) storedChunks(fileEncKey []byte, fileMacKey []byte) (map[uuid.UUID]bool, error) {
+	live, err := filedata.liveChunks(fileEncKey, fileMacKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range filedata.History {
+		live[ref.Record.Location] = true
+	}
+	return live, nil
+}
+
+// markFile marks a file's header and everything the header still points
+// at, and does the same for everything in a directory. Something it
+// reaches that doesn't open is an error, since what that uses can't be
+// told.
+func (userdata *User) markFile(handle fileHandle, marked map[uuid.UUID]bool) error {
+	marked[handle.Location] = true
+	fileMarshal, ok := userlib.DatastoreGet(handle.Location)
+	if !ok {
+		return nil
+	}
+	filedata, err := openHeader(handle.Keys[0:16], handle.Keys[16:32], handle.Location, fileMarshal)
+	if err != nil {
+		return err
+	}
+	live, err := filedata.storedChunks(handle.Keys[16:32], handle.Keys[0:16])
 	if err != nil {
 		return err
 	}
-	keys, err := userlib.PKEDec(userdata.RsaSk, sharingEntry.CipherText)
+	for location := range live {
+		marked[location] = true
+	}
+	if !handle.Dir {
+		return nil
+	}
+	dir, err := userdata.loadDirectory(handle)
 	if err != nil {
 		return err
 	}
-	userdata.SharedFiles[filename] = keys
+	for _, child := range dir.Children {
+		if err := userdata.markFile(child, marked); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Removes access for all others.
-func (userdata *User) RevokeFile(filename string) (err error) {
-	_, ok := userdata.ListOfOwnedFiles[filename]
+// markReachable marks everything the user can reach: the files and
+// directories they have names for and what's in them, the access nodes
+// and group slots they hold or handed out, and their snapshots and what
+// those keep.
+func (userdata *User) markReachable() (map[uuid.UUID]bool, error) {
+	marked := make(map[uuid.UUID]bool)
+	for filename, entry := range userdata.SharedFiles {
+		marked[entry.Node] = true
+		marked[entry.Slot] = true
+		// a name whose node was deleted by the owner reaches nothing
+		if handle, err := userdata.locate(filename); err == nil {
+			if err := userdata.markFile(handle, marked); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, grants := range userdata.Grants {
+		for _, grant := range grants {
+			marked[grant.Node] = true
+			if !grant.Group {
+				continue
+			}
+			group, err := userdata.loadGroup(grant.Recipient)
+			if err != nil {
+				return nil, err
+			}
+			for _, member := range group.Members {
+				marked[slotUUID(grant.ShareID, member)] = true
+			}
+		}
+	}
+	for label := range userdata.Snapshots {
+		snapUUID, _, _ := userdata.snapshotLocation(label)
+		marked[snapUUID] = true
+		snap, err := userdata.loadSnapshot(label)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range snap.Files {
+			for _, ref := range file.Chunks {
+				marked[ref.Location] = true
+			}
+			if file.Location != uuid.Nil {
+				if err := userdata.markFile(fileHandle{Location: file.Location, Keys: file.Keys}, marked); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return marked, nil
+}
+
+// fileGarbage is where the objects deleteData would remove for a file are.
+// A deduplicated chunk is among them if the file holds every use its count
+// has left.
+func fileGarbage(handle fileHandle) []uuid.UUID {
+	fileMarshal, ok := userlib.DatastoreGet(handle.Location)
 	if !ok {
-		return errors.New("You have to be the owner of the file to revoke")
+		return nil
 	}
-	fileEncKey, fileMacKey, _, _ := generateFileKeysForDataStore(filename, userdata.Username, userdata.SourceKey)
-	originalData, err := userdata.LoadFile(filename)
+	fileMacKey, fileEncKey := handle.Keys[0:16], handle.Keys[16:32]
+	filedata, err := openHeader(fileMacKey, fileEncKey, handle.Location, fileMarshal)
 	if err != nil {
-		return errors.New("Data failed to load.")
+		return []uuid.UUID{handle.Location}
 	}
-	deleteDataEntry(userdata.SourceKey, userdata.Username, "magic_string", []byte(filename+userdata.Username+"sharesig"), []byte(filename+userdata.Username+"shareenc"))
-	delete(userdata.SharedFiles, filename)
-	hashedFilename, _ := userlib.HMACEval(fileMacKey, []byte(filename))
-	storeData(fileEncKey, originalData, fileMacKey, hashedFilename, userdata.Username)
-	return nil
+	pinned := filedata.pinnedChunks()
+	var garbage []uuid.UUID
+	uses := make(map[uuid.UUID]uint64)
+	keyed := make(map[uuid.UUID]chunkRef)
+	chunks := func(list []chunkRef) {
+		for _, ref := range list {
+			if ref.Key == nil && !pinned[ref.Location] {
+				garbage = append(garbage, ref.Location)
+			}
+		}
+	}
+	chunks(filedata.Chunks)
+	for location, ref := range filedata.held {
+		uses[location]++
+		keyed[location] = ref
+	}
+	for _, ref := range filedata.History {
+		garbage = append(garbage, ref.Record.Location)
+		if version, err := filedata.loadVersion(fileEncKey, fileMacKey, ref); err == nil {
+			chunks(version.Chunks)
+			for location, chunk := range keyedChunks(version.Chunks) {
+				uses[location]++
+				keyed[location] = chunk
+			}
+		}
+	}
+	for location, n := range uses {
+		if count, ok := loadCount(keyed[location]); ok && count <= n {
+			counted, _, _ := countLocation(keyed[location])
+			garbage = append(garbage, location, counted)
+		}
+	}
+	if len(pinned) == 0 {
+		garbage = append(garbage, handle.Location)
+	}
+	return garbage
+}
+
+// sweep removes what a run left behind that the user can't reach, or with
+// dryRun only works out what that is, and returns where it is. If a file
+// the run wrote to doesn't open, the chunks the run named are all left,
+// since what uses them can't be told, and so is the run, for a later
+// collection to finish; it returns whether the run is done with.
+func (userdata *User) sweep(in intent, marked map[uuid.UUID]bool, dryRun bool) ([]uuid.UUID, bool) {
+	var doomed []fileHandle
+	for _, handle := range in.Files {
+		if !marked[handle.Location] {
+			doomed = append(doomed, handle)
+		}
+	}
+	for _, move := range in.Moves {
+		// a snapshot can still reach the old copy, but deleting it only
+		// takes what the snapshot doesn't hold
+		if !marked[move.To.Location] {
+			doomed = append(doomed, move.To)
+		} else {
+			doomed = append(doomed, move.From)
+		}
+	}
+	garbage := make(map[uuid.UUID]bool)
+	gone := make(map[uuid.UUID]bool)
+	var deleted []fileHandle
+	for _, handle := range doomed {
+		gone[handle.Location] = true
+		removed := fileGarbage(handle)
+		for _, location := range removed {
+			garbage[location] = true
+		}
+		if len(removed) > 0 {
+			deleted = append(deleted, handle)
+		}
+	}
+
+	// a chunk is in use if a file the run wrote to points at it, even one
+	// the user can't reach any more
+	live := make(map[uuid.UUID]bool)
+	known := true
+	for _, handle := range in.Written {
+		fileMarshal, ok := userlib.DatastoreGet(handle.Location)
+		if !ok || gone[handle.Location] {
+			continue
+		}
+		filedata, err := openHeader(handle.Keys[0:16], handle.Keys[16:32], handle.Location, fileMarshal)
+		if err != nil {
+			known = false
+			continue
+		}
+		stored, err := filedata.storedChunks(handle.Keys[16:32], handle.Keys[0:16])
+		if err != nil {
+			known = false
+			continue
+		}
+		for location := range stored {
+			live[location] = true
+		}
+	}
+	if known {
+		for i := 0; i < in.Chunks; i++ {
+			if location := in.name(recordChunk, i); !marked[location] && !live[location] {
+				garbage[location] = true
+			}
+		}
+	}
+	_, journalMacKey, journalEncKey := userdata.journalLocation()
+	for i := 0; i < in.Deduped; i++ {
+		location := in.name(recordDeduped, i)
+		entryMarshal, ok := userlib.DatastoreGet(location)
+		if !ok || !known {
+			continue
+		}
+		garbage[location] = true
+		noted, err := openEntry(journalMacKey, journalEncKey, recordDeduped, location, entryMarshal)
+		if err != nil || len(noted) != 16+32 {
+			continue
+		}
+		var ref chunkRef
+		copy(ref.Location[:], noted[:16])
+		ref.Key = noted[16:]
+		// once a header holds the chunk it has a count, which looks after
+		// it from then on
+		if !chunkUsed(ref) && !marked[ref.Location] && !live[ref.Location] {
+			garbage[ref.Location] = true
+		}
+	}
+	for _, object := range in.Objects {
+		if !marked[object] {
+			garbage[object] = true
+		}
+	}
+
+	var removed []uuid.UUID
+	for location := range garbage {
+		if _, ok := userlib.DatastoreGet(location); ok {
+			removed = append(removed, location)
+		}
+	}
+	if !dryRun {
+		for _, handle := range deleted {
+			deleteData(handle.Keys[0:16], handle.Keys[16:32], handle.Location)
+		}
+		for _, location := range removed {
+			userlib.DatastoreDelete(location)
+		}
+	}
+	return removed, known
+}
+
+// CollectGarbage removes what the user's operations left behind when they
+// never finished, as their journal has it: chunks, version records, files,
+// access nodes, group slots and snapshots they created that nothing the
+// user can reach uses, files they moved or deleted that they didn't finish
+// with, and deduplicated chunks stored without ever being counted. It
+// returns where the objects it removed were, in order. A writer that's
+// still open, in this session or another, can't be told from one that
+// never will be, so what it wrote goes too, and closing it fails.
+func (userdata *User) CollectGarbage() ([]uuid.UUID, error) {
+	return userdata.collectGarbage(false)
+}
+
+// CollectGarbageDryRun returns where the objects CollectGarbage would
+// remove are, and leaves them be.
+func (userdata *User) CollectGarbageDryRun() ([]uuid.UUID, error) {
+	return userdata.collectGarbage(true)
+}
+
+func (userdata *User) collectGarbage(dryRun bool) ([]uuid.UUID, error) {
+	if err := userdata.syncUser(); err != nil {
+		return nil, err
+	}
+	userdata.settle()
+	j, err := userdata.loadJournal()
+	if err != nil {
+		return nil, err
+	}
+	if len(j.Runs) == 0 {
+		return nil, nil
+	}
+	marked, err := userdata.markReachable()
+	if err != nil {
+		return nil, err
+	}
+	ids := j.ids()
+	var garbage []uuid.UUID
+	var swept []uuid.UUID
+	for _, id := range ids {
+		removed, done := userdata.sweep(j.Runs[id], marked, dryRun)
+		garbage = append(garbage, removed...)
+		if done {
+			swept = append(swept, id)
+		}
+	}
+	sortSlice(len(garbage), func(i, k int) bool { return uuidLess(garbage[i], garbage[k]) },
+		func(i, k int) { garbage[i], garbage[k] = garbage[k], garbage[i] })
+	if !dryRun {
+		userdata.updateJournal(func(j *journal) {
+			for _, id := range swept {
+				delete(j.Runs, id)
+			}
+		})
+	}
+	return garbage, nil
 }
@@ -2,12 +2,13 @@ package proj2
 
 import (
 	_ "encoding/hex"
-	_ "encoding/json"
+	"encoding/json"
 	_ "errors"
 	"reflect"
 	_ "strconv"
-	_ "strings"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/ryanleh/cs161-p2/userlib"
@@ -645,10 +646,10 @@ func TestCombineShareLoadRevoke(t *testing.T) {
 	// Bob shares file1 to Carol
 	magic_stringBC, _ := bob0004.ShareFile("file1", "carol0004")
 
-	// Bob receives file1 again, now under the name "fileBob"
+	// Bob receives file1 again, now under the name "fileBob". The record was already used
 	err = bob0004.ReceiveFile("fileBob", "alice0004", magic_stringAB)
-	if err != nil {
-		t.Error("Bob should be able to accept receiveFile twice on the same file with different chosen filename")
+	if err == nil {
+		t.Error("Bob should not be able to replay a sharing record under a different filename")
 	}
 
 	// Bob stores file1 (file1 already exists!) Bob's update should not change anything. (Implementation is actually undefined in the spec)
@@ -832,7 +833,14 @@ func TestComboAttack1(t *testing.T) {
 		t.Error("Error when bob receives file with different name")
 	}
 
-	// Bob receives same file with different chosen filename
+	// Bob replays the same record under a different chosen filename
+	err = bob0006.ReceiveFile("file1", "alice0006", magic_string)
+	if err == nil {
+		t.Error("Failed to detect Bob replaying a sharing record")
+	}
+
+	// Bob receives same file with different chosen filename from a fresh record
+	magic_string, err = alice0006.ShareFile("file1", "bob0006")
 	err = bob0006.ReceiveFile("file1", "alice0006", magic_string)
 	if err != nil {
 		t.Error("Error when bob receives file with different name 2")
@@ -890,8 +898,8 @@ func TestComboAttack1(t *testing.T) {
 	*/
 
 	// Datastore tampers with file1
-	sharedFileMacKey, _ := userlib.HMACEval(alice0006.SourceKey, []byte("file1"+"alice0006"+"sharesig"))
-	file1Filename, _ := userlib.HMACEval(sharedFileMacKey[0:16], []byte("magic_string"))
+	sharedFileKeys := sharedFileKeys(alice0006.SharedFiles["file1"].Root, "alice0006")
+	file1Filename, _ := userlib.HMACEval(sharedFileKeys[0:16], []byte("magic_string"))
 	file1UUID := bytesToUUID(file1Filename)
 
 	userlib.DatastoreSet(file1UUID, []byte("blabhaasdkfadfja;sdlkfja;sdlfka;sldfkasdfk"))
@@ -957,4 +965,3546 @@ func TestComboAttack1(t *testing.T) {
 
 }
 
+func TestShareRecordBinding(t *testing.T) {
+	alice0007, err := InitUser("alice0007", "alice_password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0007", err)
+		return
+	}
+	bob0007, err := InitUser("bob0007", "bob_password")
+	if err != nil {
+		t.Error("Failed to initialize user bob0007", err)
+		return
+	}
+	carol0007, err := InitUser("carol0007", "carol_password")
+	if err != nil {
+		t.Error("Failed to initialize user carol0007", err)
+		return
+	}
+
+	alice0007.StoreFile("file1", []byte("for bob's eyes only"))
+	magic_string, err := alice0007.ShareFile("file1", "bob0007")
+	if err != nil {
+		t.Error("Failed to share file1 with bob0007", err)
+		return
+	}
+
+	// Carol intercepts a record addressed to Bob
+	err = carol0007.ReceiveFile("file1", "alice0007", magic_string)
+	if err == nil {
+		t.Error("Carol accepted a sharing record addressed to Bob")
+	}
+
+	// Bob can't claim it came from someone else
+	err = bob0007.ReceiveFile("file1", "carol0007", magic_string)
+	if err == nil {
+		t.Error("Bob accepted a sharing record under the wrong sender")
+	}
+
+	err = bob0007.ReceiveFile("file1", "alice0007", magic_string)
+	if err != nil {
+		t.Error("Bob failed to receive file1", err)
+		return
+	}
+	file1, err := bob0007.LoadFile("file1")
+	if err != nil || !reflect.DeepEqual(file1, []byte("for bob's eyes only")) {
+		t.Error("file1 contents incorrect when bob0007 loaded", err)
+	}
+
+	// replaying the record fails, also from a fresh session
+	err = bob0007.ReceiveFile("file2", "alice0007", magic_string)
+	if err == nil {
+		t.Error("Bob replayed a sharing record")
+	}
+	bobAgain, err := GetUser("bob0007", "bob_password")
+	if err != nil {
+		t.Error("Failed to reload bob0007", err)
+		return
+	}
+	err = bobAgain.ReceiveFile("file2", "alice0007", magic_string)
+	if err == nil {
+		t.Error("Bob replayed a sharing record from a new session")
+	}
+
+	// Carol re-signs Bob's record as her own
+	var record sharingRecord
+	json.Unmarshal([]byte(magic_string), &record)
+	record.Sigma, _ = userlib.DSSign(carol0007.DsSk, record.Payload)
+	forged, _ := json.Marshal(record)
+	err = bob0007.ReceiveFile("file3", "carol0007", string(forged))
+	if err == nil {
+		t.Error("Bob accepted a record re-signed by Carol")
+	}
+
+	// a properly signed record with fields stripped is refused
+	magic_string, _ = alice0007.ShareFile("file1", "carol0007")
+	json.Unmarshal([]byte(magic_string), &record)
+	var payload sharingPayload
+	decodeObject(objectPayload, record.Payload, &payload)
+	payload.Nonce = nil
+	record.Payload = encodeObject(objectPayload, &payload)
+	record.Sigma, _ = userlib.DSSign(alice0007.DsSk, record.Payload)
+	stripped, _ := json.Marshal(record)
+	err = carol0007.ReceiveFile("file1", "alice0007", string(stripped))
+	if err == nil {
+		t.Error("Carol accepted a sharing record without a nonce")
+	}
+}
+
+func TestSharingWindow(t *testing.T) {
+	alice0031, err := InitUser("alice0031", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0031", err)
+		return
+	}
+	bob0031, _ := InitUser("bob0031", "password")
+	alice0031.StoreFile("f", []byte("shared"))
+	first, _ := alice0031.ShareFile("f", "bob0031")
+	unused, _ := alice0031.ShareFile("f", "bob0031")
+	if err := bob0031.ReceiveFile("first", "alice0031", first); err != nil {
+		t.Error("Failed to receive a record", err)
+	}
+
+	// a whole window of records later, the ones before it are refused and
+	// no longer remembered
+	alice0031.Issued += nonceWindow
+	alice0031.storeUser()
+	latest, _ := alice0031.ShareFile("f", "bob0031")
+	if err := bob0031.ReceiveFile("latest", "alice0031", latest); err != nil {
+		t.Error("Failed to receive a record", err)
+	}
+	if err := bob0031.ReceiveFile("unused", "alice0031", unused); err == nil {
+		t.Error("Accepted a record from before the window")
+	}
+	if err := bob0031.ReceiveFile("again", "alice0031", first); err == nil {
+		t.Error("Replayed a record from before the window")
+	}
+	if err := bob0031.ReceiveFile("again", "alice0031", latest); err == nil {
+		t.Error("Replayed a record in the window")
+	}
+	if len(bob0031.UsedNonces["alice0031"]) != 1 {
+		t.Error("Nonces outside the window were kept", bob0031.UsedNonces)
+	}
+	if data, err := bob0031.LoadFile("latest"); err != nil || string(data) != "shared" {
+		t.Error("Failed to load a file received in the window", err)
+	}
+}
+
+func TestShareEnvelope(t *testing.T) {
+	alice0008, err := InitUser("alice0008", "alice_password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0008", err)
+		return
+	}
+	bob0008, err := InitUser("bob0008", "bob_password")
+	if err != nil {
+		t.Error("Failed to initialize user bob0008", err)
+		return
+	}
+	carol0008, err := InitUser("carol0008", "carol_password")
+	if err != nil {
+		t.Error("Failed to initialize user carol0008", err)
+		return
+	}
+
+	// far more than RSA could encrypt directly
+	bobPk, _ := userlib.KeystoreGet("bob0008enc")
+	body := []byte(strings.Repeat("custody ", 1024))
+	envelope, err := sealEnvelope(bobPk, body)
+	if err != nil {
+		t.Error("Failed to seal a large envelope", err)
+		return
+	}
+	opened, err := openEnvelope(bob0008.RsaSk, envelope)
+	if err != nil || !reflect.DeepEqual(opened, body) {
+		t.Error("Large envelope did not round trip", err)
+	}
+	_, err = openEnvelope(carol0008.RsaSk, envelope)
+	if err == nil {
+		t.Error("Carol opened an envelope sealed for Bob")
+	}
+	envelope.CipherText[len(envelope.CipherText)-1] ^= 1
+	_, err = openEnvelope(bob0008.RsaSk, envelope)
+	if err == nil {
+		t.Error("Failed to detect a tampered envelope")
+	}
+
+	// the chain of custody follows the file through re-shares
+	alice0008.StoreFile("file1", []byte("passed along"))
+	magic_string, _ := alice0008.ShareFile("file1", "bob0008")
+	err = bob0008.ReceiveFile("file1", "alice0008", magic_string)
+	if err != nil {
+		t.Error("Bob failed to receive file1", err)
+		return
+	}
+	magic_string, _ = bob0008.ShareFile("file1", "carol0008")
+	err = carol0008.ReceiveFile("fromBob", "bob0008", magic_string)
+	if err != nil {
+		t.Error("Carol failed to receive file1", err)
+		return
+	}
+	custody := carol0008.SharedFiles["fromBob"].Custody
+	if !reflect.DeepEqual(custody, []string{"alice0008", "bob0008", "carol0008"}) {
+		t.Error("Chain of custody incorrect", custody)
+	}
+	file1, err := carol0008.LoadFile("fromBob")
+	if err != nil || !reflect.DeepEqual(file1, []byte("passed along")) {
+		t.Error("file1 contents incorrect when carol0008 loaded", err)
+	}
+}
+
+func TestGroupShare(t *testing.T) {
+	alice0009, err := InitUser("alice0009", "alice_password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0009", err)
+		return
+	}
+	bob0009, err := InitUser("bob0009", "bob_password")
+	if err != nil {
+		t.Error("Failed to initialize user bob0009", err)
+		return
+	}
+	carol0009, err := InitUser("carol0009", "carol_password")
+	if err != nil {
+		t.Error("Failed to initialize user carol0009", err)
+		return
+	}
+	dave0009, err := InitUser("dave0009", "dave_password")
+	if err != nil {
+		t.Error("Failed to initialize user dave0009", err)
+		return
+	}
+	eve0009, err := InitUser("eve0009", "eve_password")
+	if err != nil {
+		t.Error("Failed to initialize user eve0009", err)
+		return
+	}
+
+	err = alice0009.CreateGroup("team")
+	if err != nil {
+		t.Error("Failed to create group", err)
+		return
+	}
+	if alice0009.CreateGroup("team") == nil {
+		t.Error("Created the same group twice")
+	}
+	if alice0009.CreateGroup("bob0009") == nil {
+		t.Error("Created a group named after a user")
+	}
+	if alice0009.AddMember("team", "nobody0009") == nil {
+		t.Error("Added a user that doesn't exist")
+	}
+	alice0009.AddMember("team", "bob0009")
+	alice0009.AddMember("team", "carol0009")
+	if alice0009.AddMember("team", "bob0009") == nil {
+		t.Error("Added the same member twice")
+	}
+
+	alice0009.StoreFile("file1", []byte("team notes"))
+	if _, err = alice0009.ShareFile("file1", "team"); err == nil {
+		t.Error("Shared with a group as if it were a user")
+	}
+	magic_string, err := alice0009.ShareFileWithGroup("file1", "team")
+	if err != nil {
+		t.Error("Failed to share with the group", err)
+		return
+	}
+	direct, _ := alice0009.ShareFile("file1", "eve0009")
+	eve0009.ReceiveFile("file1", "alice0009", direct)
+
+	err = bob0009.ReceiveFile("file1", "alice0009", magic_string)
+	if err != nil {
+		t.Error("Bob failed to receive the group share", err)
+		return
+	}
+	err = carol0009.ReceiveFile("file1", "alice0009", magic_string)
+	if err != nil {
+		t.Error("Carol failed to receive the group share", err)
+		return
+	}
+	err = dave0009.ReceiveFile("file1", "alice0009", magic_string)
+	if err == nil {
+		t.Error("Dave received a group share before joining the group")
+	}
+
+	// Dave joins and the same record now works for him
+	alice0009.AddMember("team", "dave0009")
+	err = dave0009.ReceiveFile("file1", "alice0009", magic_string)
+	if err != nil {
+		t.Error("Dave failed to receive the group share after joining", err)
+		return
+	}
+	for _, u := range []*User{bob0009, carol0009, dave0009, eve0009} {
+		file1, err := u.LoadFile("file1")
+		if err != nil || !reflect.DeepEqual(file1, []byte("team notes")) {
+			t.Error("file1 contents incorrect for", u.Username, err)
+		}
+	}
+
+	// Carol keeps what she could see before she is removed
+	oldUUID, _, _ := carol0009.fileLocation("file1")
+
+	err = alice0009.RemoveMember("team", "carol0009")
+	if err != nil {
+		t.Error("Failed to remove Carol", err)
+		return
+	}
+	if alice0009.RemoveMember("team", "carol0009") == nil {
+		t.Error("Removed a member twice")
+	}
+	_, err = carol0009.LoadFile("file1")
+	if err == nil {
+		t.Error("Carol can still load the file after being removed")
+	}
+	if carol0009.AppendFile("file1", []byte("sneaky")) == nil {
+		t.Error("Carol can still append after being removed")
+	}
+	if _, ok := userlib.DatastoreGet(oldUUID); ok {
+		t.Error("The file is still under the keys Carol saw")
+	}
+
+	bob0009.AppendFile("file1", []byte(" and more"))
+	for _, u := range []*User{alice0009, bob0009, dave0009, eve0009} {
+		file1, err := u.LoadFile("file1")
+		if err != nil || !reflect.DeepEqual(file1, []byte("team notes and more")) {
+			t.Error("file1 contents incorrect after re-keying for", u.Username, err)
+		}
+	}
+
+	// only owners share with groups
+	bob0009.CreateGroup("team")
+	if _, err = bob0009.ShareFileWithGroup("file1", "team"); err == nil {
+		t.Error("Bob shared a file he doesn't own with a group")
+	}
+
+	// revoking reaches group members too
+	alice0009.RevokeFile("file1")
+	if _, err = bob0009.LoadFile("file1"); err == nil {
+		t.Error("Bob can load the file after it was revoked")
+	}
+	if _, err = eve0009.LoadFile("file1"); err == nil {
+		t.Error("Eve can load the file after it was revoked")
+	}
+}
+
 // err = nil -> success; err != nil -> fail
+
+func TestNoReshare(t *testing.T) {
+	alice0010, err := InitUser("alice0010", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0010", err)
+		return
+	}
+	bob0010, err := InitUser("bob0010", "password")
+	if err != nil {
+		t.Error("Failed to initialize user bob0010", err)
+		return
+	}
+	charlie0010, err := InitUser("charlie0010", "password")
+	if err != nil {
+		t.Error("Failed to initialize user charlie0010", err)
+		return
+	}
+
+	alice0010.StoreFile("file1", []byte("for Bob only"))
+	magic_string, err := alice0010.ShareFileNoReshare("file1", "bob0010")
+	if err != nil {
+		t.Error("Failed to share file without re-share", err)
+		return
+	}
+	err = bob0010.ReceiveFile("file1", "alice0010", magic_string)
+	if err != nil {
+		t.Error("Failed to receive file shared without re-share", err)
+		return
+	}
+
+	// Bob can still read and append
+	err = bob0010.AppendFile("file1", []byte(", really"))
+	if err != nil {
+		t.Error("Failed to append as a restricted recipient", err)
+	}
+	data, _ := bob0010.LoadFile("file1")
+	if !reflect.DeepEqual(data, []byte("for Bob only, really")) {
+		t.Error("Restricted recipient loaded wrong data", string(data))
+	}
+
+	// Bob tries to re-share to Charlie
+	_, err = bob0010.ShareFile("file1", "charlie0010")
+	if err == nil {
+		t.Error("Restricted recipient was able to re-share")
+	}
+
+	// Bob builds the record by hand, signing his own hop onto Alice's grant
+	entry := bob0010.SharedFiles["file1"]
+	hop, _ := bob0010.signGrant("charlie0010", entry.Node, permRead|permWrite)
+	fileUUID, _, _ := bob0010.fileLocation("file1")
+	var body sharingBody
+	body.FileUUID = fileUUID
+	body.Node = entry.Node
+	body.NodeKeys = entry.NodeKeys
+	body.Chain = append(entry.Chain, hop)
+	charliePk, _ := userlib.KeystoreGet("charlie0010enc")
+	magic_string, _ = bob0010.newSharingRecord("charlie0010", charliePk, body)
+	err = charlie0010.ReceiveFile("file1", "bob0010", magic_string)
+	if err == nil {
+		t.Error("Charlie accepted a re-share from a restricted recipient")
+	}
+
+	// Bob drops Alice's grant and claims the file as his own
+	hop, _ = bob0010.signGrant("charlie0010", entry.Node, permAll)
+	body.Chain = []signedGrant{hop}
+	magic_string, _ = bob0010.newSharingRecord("charlie0010", charliePk, body)
+	err = charlie0010.ReceiveFile("file1", "bob0010", magic_string)
+	if err == nil {
+		t.Error("Charlie accepted a chain that doesn't start with the owner")
+	}
+
+	// a full share can be passed on, and restricted further down the line
+	magic_string, _ = alice0010.ShareFile("file1", "bob0010")
+	err = bob0010.ReceiveFile("file2", "alice0010", magic_string)
+	if err != nil {
+		t.Error("Failed to receive full share", err)
+		return
+	}
+	magic_string, err = bob0010.ShareFileNoReshare("file2", "charlie0010")
+	if err != nil {
+		t.Error("Failed to re-share file", err)
+		return
+	}
+	err = charlie0010.ReceiveFile("file1", "bob0010", magic_string)
+	if err != nil {
+		t.Error("Failed to receive re-shared file", err)
+		return
+	}
+	custody := charlie0010.SharedFiles["file1"].Custody
+	if !reflect.DeepEqual(custody, []string{"alice0010", "bob0010", "charlie0010"}) {
+		t.Error("Custody chain is wrong", custody)
+	}
+	_, err = charlie0010.ShareFile("file1", "alice0010")
+	if err == nil {
+		t.Error("Restricted recipient down the chain was able to re-share")
+	}
+}
+
+func TestReadOnlyShare(t *testing.T) {
+	alice0032, err := InitUser("alice0032", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0032", err)
+		return
+	}
+	bob0032, _ := InitUser("bob0032", "password")
+	alice0032.StoreFile("file", []byte("read only"))
+	alice0032.AppendFile("file", []byte("!"))
+	magic_string, err := alice0032.shareWithUser("file", "bob0032", permRead)
+	if err != nil {
+		t.Error("Failed to share read only", err)
+		return
+	}
+	if err := bob0032.ReceiveFile("file", "alice0032", magic_string); err != nil {
+		t.Error("Failed to receive a read only share", err)
+		return
+	}
+
+	if bob0032.AppendFile("file", []byte("x")) == nil {
+		t.Error("Appended to a read only file")
+	}
+	if _, err := bob0032.OpenWriter("file"); err == nil {
+		t.Error("Opened a writer on a read only file")
+	}
+	if bob0032.WriteAt("file", 0, []byte("x")) == nil || bob0032.Truncate("file", 0) == nil {
+		t.Error("Changed a read only file in place")
+	}
+	if data, err := bob0032.LoadFile("file"); err != nil || string(data) != "read only!" {
+		t.Error("Failed to read a read only file", string(data), err)
+	}
+	if err := alice0032.AppendFile("file", []byte("?")); err != nil {
+		t.Error("The owner failed to write a file shared read only", err)
+	}
+
+	// a directory shared read only can't be changed through any path in it
+	alice0032.Mkdir("docs")
+	alice0032.StoreFile("docs/a", []byte("a"))
+	magic_string, _ = alice0032.shareWithUser("docs", "bob0032", permRead)
+	if err := bob0032.ReceiveFile("docs", "alice0032", magic_string); err != nil {
+		t.Error("Failed to receive a read only directory", err)
+		return
+	}
+	bob0032.StoreFile("docs/b", []byte("b"))
+	if bob0032.Mkdir("docs/sub") == nil {
+		t.Error("Made a directory in a read only directory")
+	}
+	if bob0032.CopyFile("file", "docs/copy") == nil {
+		t.Error("Copied into a read only directory")
+	}
+	if bob0032.DeleteFile("docs/a") == nil {
+		t.Error("Deleted from a read only directory")
+	}
+	if bob0032.RenameFile("docs/a", "docs/c") == nil {
+		t.Error("Renamed in a read only directory")
+	}
+	entries, err := bob0032.ReadDir("docs")
+	if err != nil || !reflect.DeepEqual(entries, []DirEntry{{"a", false}}) {
+		t.Error("A read only directory changed", entries, err)
+	}
+}
+
+func TestShareNested(t *testing.T) {
+	alice0033, err := InitUser("alice0033", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0033", err)
+		return
+	}
+	bob0033, _ := InitUser("bob0033", "password")
+	carol0033, _ := InitUser("carol0033", "password")
+	alice0033.Mkdir("docs")
+	alice0033.Mkdir("docs/sub")
+	alice0033.StoreFile("docs/sub/file", []byte("nested"))
+	alice0033.StoreFile("docs/other", []byte("other"))
+
+	magic_string, err := alice0033.ShareFile("docs/sub/file", "bob0033")
+	if err != nil {
+		t.Error("Failed to share a nested file", err)
+		return
+	}
+	if err := bob0033.ReceiveFile("file", "alice0033", magic_string); err != nil {
+		t.Error("Failed to receive a nested file", err)
+		return
+	}
+	magic_string, err = alice0033.ShareFile("docs/sub", "carol0033")
+	if err != nil {
+		t.Error("Failed to share a nested directory", err)
+		return
+	}
+	if err := carol0033.ReceiveFile("sub", "alice0033", magic_string); err != nil {
+		t.Error("Failed to receive a nested directory", err)
+		return
+	}
+	if data, err := bob0033.LoadFile("file"); err != nil || string(data) != "nested" {
+		t.Error("Failed to load a nested share", string(data), err)
+	}
+	if err := bob0033.AppendFile("file", []byte("!")); err != nil {
+		t.Error("Failed to append to a nested share", err)
+	}
+	if data, _ := alice0033.LoadFile("docs/sub/file"); string(data) != "nested!" {
+		t.Error("The owner doesn't see the recipient's append", string(data))
+	}
+	if data, err := carol0033.LoadFile("sub/file"); err != nil || string(data) != "nested!" {
+		t.Error("Failed to load through a nested directory share", string(data), err)
+	}
+	if _, err := carol0033.LoadFile("other"); err == nil {
+		t.Error("A nested share reaches outside what was shared")
+	}
+	if _, err := bob0033.ShareFile("file", "carol0033"); err != nil {
+		t.Error("Failed to pass on a nested share", err)
+	}
+	if _, err := carol0033.ShareFile("sub/file", "bob0033"); err == nil {
+		t.Error("Shared inside a directory someone else owns")
+	}
+
+	// renaming the directory keeps the shares, and revoking it re-keys
+	// everything in it and ends them
+	if err := alice0033.RenameFile("docs", "papers"); err != nil {
+		t.Error("Failed to rename a directory with nested shares", err)
+	}
+	if data, err := bob0033.LoadFile("file"); err != nil || string(data) != "nested!" {
+		t.Error("A nested share broke on rename", string(data), err)
+	}
+	if err := alice0033.RevokeFile("papers/sub"); err != nil {
+		t.Error("Failed to revoke a nested share", err)
+	}
+	if _, err := carol0033.LoadFile("sub/file"); err == nil {
+		t.Error("Loaded a revoked nested directory")
+	}
+	if _, err := bob0033.LoadFile("file"); err == nil {
+		t.Error("Loaded a nested file after its directory was revoked")
+	}
+	if data, err := alice0033.LoadFile("papers/sub/file"); err != nil || string(data) != "nested!" {
+		t.Error("The owner lost a revoked nested file", string(data), err)
+	}
+
+	// deleting what was shared leaves a tombstone
+	magic_string, _ = alice0033.ShareFile("papers/other", "bob0033")
+	if err := bob0033.ReceiveFile("other", "alice0033", magic_string); err != nil {
+		t.Error("Failed to receive a nested file", err)
+		return
+	}
+	if err := alice0033.DeleteFile("papers/other"); err != nil {
+		t.Error("Failed to delete a shared nested file", err)
+	}
+	if _, err := bob0033.LoadFile("other"); err != ErrDeleted {
+		t.Error("A deleted nested share didn't say so", err)
+	}
+}
+
+func TestTransferOwnership(t *testing.T) {
+	alice0011, err := InitUser("alice0011", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0011", err)
+		return
+	}
+	bob0011, _ := InitUser("bob0011", "password")
+	carol0011, _ := InitUser("carol0011", "password")
+	dave0011, _ := InitUser("dave0011", "password")
+	eve0011, _ := InitUser("eve0011", "password")
+
+	alice0011.StoreFile("file1", []byte("handover"))
+	magic_string, _ := alice0011.ShareFile("file1", "bob0011")
+	err = bob0011.ReceiveFile("file1", "alice0011", magic_string)
+	if err != nil {
+		t.Error("Failed to receive file", err)
+		return
+	}
+	magic_string, _ = bob0011.ShareFile("file1", "carol0011")
+	err = carol0011.ReceiveFile("file1", "bob0011", magic_string)
+	if err != nil {
+		t.Error("Failed to receive re-shared file", err)
+		return
+	}
+
+	_, err = bob0011.TransferOwnership("file1", "dave0011")
+	if err == nil {
+		t.Error("Non-owner was able to transfer ownership")
+	}
+	_, err = alice0011.TransferOwnership("file1", "nobody0011")
+	if err == nil {
+		t.Error("Transferred ownership to a non-existing user")
+	}
+
+	magic_string, err = alice0011.TransferOwnership("file1", "dave0011")
+	if err != nil {
+		t.Error("Failed to transfer ownership", err)
+		return
+	}
+	err = dave0011.ReceiveFile("docs", "alice0011", magic_string)
+	if err == nil {
+		t.Error("A transfer record was accepted as a share")
+	}
+	err = eve0011.AcceptOwnership("docs", "alice0011", magic_string)
+	if err == nil {
+		t.Error("Someone other than the new owner accepted the transfer")
+	}
+	err = dave0011.AcceptOwnership("docs", "alice0011", magic_string)
+	if err != nil {
+		t.Error("Failed to accept ownership", err)
+		return
+	}
+	err = dave0011.AcceptOwnership("docs2", "alice0011", magic_string)
+	if err == nil {
+		t.Error("A transfer record was accepted twice")
+	}
+
+	// the old owner is now a regular holder
+	if alice0011.ListOfOwnedFiles["file1"] || !dave0011.ListOfOwnedFiles["docs"] {
+		t.Error("Ownership didn't move")
+	}
+	err = alice0011.RevokeFile("file1")
+	if err == nil {
+		t.Error("Old owner was still able to revoke")
+	}
+	err = alice0011.AppendFile("file1", []byte(" done"))
+	if err != nil {
+		t.Error("Old owner lost access after the transfer", err)
+	}
+	for _, user := range []*User{alice0011, bob0011, carol0011} {
+		data, err := user.LoadFile("file1")
+		if err != nil || !reflect.DeepEqual(data, []byte("handover done")) {
+			t.Error("Holder can't read the file after the transfer", user.Username, err)
+		}
+	}
+	data, _ := dave0011.LoadFile("docs")
+	if !reflect.DeepEqual(data, []byte("handover done")) {
+		t.Error("New owner loaded wrong data", string(data))
+	}
+
+	// chains issued by the old owner can still be passed on
+	magic_string, _ = bob0011.ShareFile("file1", "eve0011")
+	err = eve0011.ReceiveFile("file1", "bob0011", magic_string)
+	if err != nil {
+		t.Error("Re-share from before the transfer was rejected", err)
+	}
+
+	// the new owner is the root of the share tree
+	err = dave0011.RevokeFile("docs")
+	if err != nil {
+		t.Error("New owner failed to revoke", err)
+	}
+	for _, user := range []*User{alice0011, bob0011, carol0011, eve0011} {
+		_, err := user.LoadFile("file1")
+		if err == nil {
+			t.Error("Holder still has access after the new owner revoked", user.Username)
+		}
+	}
+	data, _ = dave0011.LoadFile("docs")
+	if !reflect.DeepEqual(data, []byte("handover done")) {
+		t.Error("New owner lost the file after revoking", string(data))
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	alice0012, err := InitUser("alice0012", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0012", err)
+		return
+	}
+	bob0012, _ := InitUser("bob0012", "password")
+	carol0012, _ := InitUser("carol0012", "password")
+	dave0012, _ := InitUser("dave0012", "password")
+
+	err = alice0012.DeleteFile("nothing")
+	if err == nil {
+		t.Error("Deleted a file that doesn't exist")
+	}
+
+	// an owned file that was never shared
+	alice0012.StoreFile("private", []byte("gone soon"))
+	err = alice0012.DeleteFile("private")
+	if err != nil {
+		t.Error("Failed to delete file", err)
+	}
+	_, err = alice0012.LoadFile("private")
+	if err == nil {
+		t.Error("Loaded a deleted file")
+	}
+
+	// a file shared directly, through a re-share and with a group
+	alice0012.StoreFile("file1", []byte("shared"))
+	magic_string, _ := alice0012.ShareFile("file1", "bob0012")
+	bob0012.ReceiveFile("file1", "alice0012", magic_string)
+	magic_string, _ = bob0012.ShareFile("file1", "dave0012")
+	dave0012.ReceiveFile("file1", "bob0012", magic_string)
+	alice0012.CreateGroup("team")
+	alice0012.AddMember("team", "carol0012")
+	magic_string, _ = alice0012.ShareFileWithGroup("file1", "team")
+	err = carol0012.ReceiveFile("file1", "alice0012", magic_string)
+	if err != nil {
+		t.Error("Failed to receive group share", err)
+		return
+	}
+
+	fileUUID, _, _ := alice0012.fileLocation("file1")
+	err = alice0012.DeleteFile("file1")
+	if err != nil {
+		t.Error("Failed to delete shared file", err)
+	}
+	if _, ok := userlib.DatastoreGet(fileUUID); ok {
+		t.Error("Shared copy is still in the datastore")
+	}
+	for _, user := range []*User{bob0012, carol0012, dave0012} {
+		_, err := user.LoadFile("file1")
+		if err != ErrDeleted {
+			t.Error("Holder didn't get ErrDeleted", user.Username, err)
+		}
+	}
+	err = bob0012.AppendFile("file1", []byte("too late"))
+	if err != ErrDeleted {
+		t.Error("Append to a deleted file didn't give ErrDeleted", err)
+	}
+
+	// the name is free again for the owner
+	alice0012.StoreFile("file1", []byte("fresh"))
+	data, _ := alice0012.LoadFile("file1")
+	if !reflect.DeepEqual(data, []byte("fresh")) {
+		t.Error("Failed to store under a deleted name", string(data))
+	}
+
+	// a holder deleting only drops their own name for it
+	magic_string, _ = alice0012.ShareFile("file1", "bob0012")
+	err = bob0012.ReceiveFile("file2", "alice0012", magic_string)
+	if err != nil {
+		t.Error("Failed to receive file", err)
+		return
+	}
+	err = bob0012.DeleteFile("file2")
+	if err != nil {
+		t.Error("Holder failed to delete file", err)
+	}
+	_, err = bob0012.LoadFile("file2")
+	if err == nil {
+		t.Error("Holder still loads a file they deleted")
+	}
+	data, _ = alice0012.LoadFile("file1")
+	if !reflect.DeepEqual(data, []byte("fresh")) {
+		t.Error("Holder deleting removed the owner's file", string(data))
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	alice0013, err := InitUser("alice0013", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0013", err)
+		return
+	}
+	bob0013, _ := InitUser("bob0013", "password")
+
+	alice0013.StoreFile("draft", []byte("chapter one"))
+	alice0013.StoreFile("taken", []byte("something else"))
+	magic_string, _ := alice0013.ShareFile("draft", "bob0013")
+	err = bob0013.ReceiveFile("fromAlice", "alice0013", magic_string)
+	if err != nil {
+		t.Error("Failed to receive file", err)
+		return
+	}
+
+	err = alice0013.RenameFile("draft", "taken")
+	if err == nil {
+		t.Error("Renamed a file over an existing one")
+	}
+	data, _ := alice0013.LoadFile("taken")
+	if !reflect.DeepEqual(data, []byte("something else")) {
+		t.Error("Failed rename clobbered the existing file", string(data))
+	}
+	err = alice0013.RenameFile("missing", "other")
+	if err == nil {
+		t.Error("Renamed a file that doesn't exist")
+	}
+	err = alice0013.RenameFile("draft", "draft")
+	if err != nil {
+		t.Error("Failed to rename a file to its own name", err)
+	}
+
+	err = alice0013.RenameFile("draft", "final")
+	if err != nil {
+		t.Error("Failed to rename file", err)
+		return
+	}
+	_, err = alice0013.LoadFile("draft")
+	if err == nil {
+		t.Error("File can still be loaded under its old name")
+	}
+	err = alice0013.AppendFile("final", []byte(", chapter two"))
+	if err != nil {
+		t.Error("Failed to append under the new name", err)
+	}
+
+	// Bob's share is unaffected, and ownership moved with the name
+	data, err = bob0013.LoadFile("fromAlice")
+	if err != nil || !reflect.DeepEqual(data, []byte("chapter one, chapter two")) {
+		t.Error("Share broke after rename", string(data), err)
+	}
+	err = bob0013.RenameFile("fromAlice", "book")
+	if err != nil {
+		t.Error("Recipient failed to rename file", err)
+	}
+	data, _ = bob0013.LoadFile("book")
+	if !reflect.DeepEqual(data, []byte("chapter one, chapter two")) {
+		t.Error("Recipient's renamed file is wrong", string(data))
+	}
+	err = alice0013.RevokeFile("final")
+	if err != nil {
+		t.Error("Owner failed to revoke under the new name", err)
+	}
+	_, err = bob0013.LoadFile("book")
+	if err == nil {
+		t.Error("Recipient still has access after revoke")
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	alice0014, err := InitUser("alice0014", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0014", err)
+		return
+	}
+	bob0014, _ := InitUser("bob0014", "password")
+
+	// a second session of the same user sees what the first one stores
+	aliceLaptop, err := GetUser("alice0014", "password")
+	if err != nil {
+		t.Error("Failed to get user", err)
+		return
+	}
+	alice0014.StoreFile("b", []byte("0123456789"))
+	alice0014.AppendFile("b", []byte("abc"))
+	aliceLaptop.SetClock(func() int64 { return time.Now().Unix() })
+	aliceLaptop.StoreFile("a", []byte("x"))
+	magic_string, _ := bob0014.ShareFile("nothing", "alice0014")
+	if magic_string != "" {
+		t.Error("Shared a file that doesn't exist")
+	}
+	bob0014.StoreFile("c", []byte("from bob"))
+	magic_string, _ = bob0014.ShareFile("c", "alice0014")
+	err = aliceLaptop.ReceiveFile("c", "bob0014", magic_string)
+	if err != nil {
+		t.Error("Failed to receive file", err)
+		return
+	}
+
+	files, err := alice0014.ListFiles()
+	if err != nil {
+		t.Error("Failed to list files", err)
+		return
+	}
+	if len(files) != 3 || files[0].Name != "a" || files[1].Name != "b" || files[2].Name != "c" {
+		t.Error("Wrong files listed", files)
+		return
+	}
+	if !files[1].Owned || files[1].SharedBy != "" || files[1].Size != 13 || files[1].Chunks != 1 {
+		t.Error("Wrong metadata for an owned file", files[1])
+	}
+	if files[2].Owned || files[2].SharedBy != "bob0014" || files[2].Size != 8 || files[2].Chunks != 1 {
+		t.Error("Wrong metadata for a shared file", files[2])
+	}
+	if modified := time.Unix(files[0].Modified, 0); time.Since(modified) > time.Minute || time.Since(modified) < 0 {
+		t.Error("Wrong modification time", files[0].Modified)
+	}
+	if files[1].Modified != 0 {
+		t.Error("A session without a clock stamped a time", files[1].Modified)
+	}
+	data, err := alice0014.LoadFile("a")
+	if err != nil || !reflect.DeepEqual(data, []byte("x")) {
+		t.Error("Failed to load a file stored by another session", err)
+	}
+
+	// files that can't be reached any more are left out
+	bob0014.RevokeFile("c")
+	files, _ = aliceLaptop.ListFiles()
+	if len(files) != 2 {
+		t.Error("Revoked file still listed", files)
+	}
+
+	// the size comes from the sealed entry, not from the datastore
+	fileUUID, keys, _ := alice0014.fileLocation("b")
+	fileMarshal, _ := userlib.DatastoreGet(fileUUID)
+	var entry FileEntry
+	if json.Unmarshal(fileMarshal, &entry) == nil {
+		t.Error("File metadata is readable without the file's keys")
+	}
+	entry = loadHeader(fileHandle{Location: fileUUID, Keys: keys})
+	entry.Size = 1 << 20
+	fileMarshal, _ = json.Marshal(entry)
+	userlib.DatastoreSet(fileUUID, fileMarshal)
+	_, err = alice0014.ListFiles()
+	if err == nil {
+		t.Error("Failed to detect tampered file metadata")
+	}
+}
+
+func TestSortSlice(t *testing.T) {
+	for n := 0; n < 40; n++ {
+		list := make([]int, n)
+		for i := range list {
+			list[i] = (i * 7919) % 13
+		}
+		sortSlice(n, func(i, j int) bool { return list[i] < list[j] }, func(i, j int) { list[i], list[j] = list[j], list[i] })
+		for i := 1; i < n; i++ {
+			if list[i-1] > list[i] {
+				t.Error("Failed to sort", list)
+				break
+			}
+		}
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	alice0015, err := InitUser("alice0015", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0015", err)
+		return
+	}
+	bob0015, _ := InitUser("bob0015", "password")
+
+	err = alice0015.Mkdir("docs")
+	if err != nil {
+		t.Error("Failed to create directory", err)
+		return
+	}
+	err = alice0015.Mkdir("docs/2026")
+	if err != nil {
+		t.Error("Failed to create nested directory", err)
+		return
+	}
+	if alice0015.Mkdir("docs") == nil || alice0015.Mkdir("missing/dir") == nil || alice0015.Mkdir("docs//x") == nil {
+		t.Error("Created a directory that shouldn't exist")
+	}
+	alice0015.StoreFile("docs/readme", []byte("read me"))
+	alice0015.StoreFile("docs/2026/plan", []byte("step one"))
+	alice0015.StoreFile("docs/readme", []byte("ignored"))
+	err = alice0015.AppendFile("docs/2026/plan", []byte(", step two"))
+	if err != nil {
+		t.Error("Failed to append to a file in a directory", err)
+	}
+	data, err := alice0015.LoadFile("docs/2026/plan")
+	if err != nil || !reflect.DeepEqual(data, []byte("step one, step two")) {
+		t.Error("Wrong contents for a file in a directory", string(data), err)
+	}
+	data, _ = alice0015.LoadFile("docs/readme")
+	if !reflect.DeepEqual(data, []byte("read me")) {
+		t.Error("StoreFile replaced an existing file in a directory", string(data))
+	}
+	_, err = alice0015.LoadFile("docs")
+	if err == nil {
+		t.Error("Loaded a directory as a file")
+	}
+	entries, err := alice0015.ReadDir("docs")
+	if err != nil || !reflect.DeepEqual(entries, []DirEntry{{"2026", true}, {"readme", false}}) {
+		t.Error("Wrong directory listing", entries, err)
+	}
+
+	// another session sees the same tree
+	aliceLaptop, _ := GetUser("alice0015", "password")
+	data, _ = aliceLaptop.LoadFile("docs/readme")
+	if !reflect.DeepEqual(data, []byte("read me")) {
+		t.Error("Another session can't read the directory", string(data))
+	}
+
+	// sharing the directory shares everything in it
+	magic_string, err := alice0015.ShareFile("docs", "bob0015")
+	if err != nil {
+		t.Error("Failed to share directory", err)
+		return
+	}
+	err = bob0015.ReceiveFile("shared", "alice0015", magic_string)
+	if err != nil {
+		t.Error("Failed to receive directory", err)
+		return
+	}
+	data, _ = bob0015.LoadFile("shared/2026/plan")
+	if !reflect.DeepEqual(data, []byte("step one, step two")) {
+		t.Error("Recipient can't read a file in a shared directory", string(data))
+	}
+	bob0015.StoreFile("shared/notes", []byte("from bob"))
+	data, _ = alice0015.LoadFile("docs/notes")
+	if !reflect.DeepEqual(data, []byte("from bob")) {
+		t.Error("Owner can't read a file the recipient added", string(data))
+	}
+
+	// removing
+	err = alice0015.RemoveDir("docs/2026")
+	if err == nil {
+		t.Error("Removed a directory that isn't empty")
+	}
+	err = alice0015.DeleteFile("docs/2026/plan")
+	if err != nil {
+		t.Error("Failed to delete a file in a directory", err)
+	}
+	err = alice0015.RemoveDir("docs/2026")
+	if err != nil {
+		t.Error("Failed to remove empty directory", err)
+	}
+	entries, _ = bob0015.ReadDir("shared")
+	if !reflect.DeepEqual(entries, []DirEntry{{"notes", false}, {"readme", false}}) {
+		t.Error("Wrong listing after removing", entries)
+	}
+	err = alice0015.DeleteFile("docs")
+	if err == nil {
+		t.Error("DeleteFile removed a directory")
+	}
+
+	// revoking re-keys the whole subtree
+	readme, err := bob0015.locate("shared/readme")
+	if err != nil {
+		t.Error("Failed to locate file", err)
+		return
+	}
+	err = alice0015.RevokeFile("docs")
+	if err != nil {
+		t.Error("Failed to revoke directory", err)
+	}
+	_, err = bob0015.LoadFile("shared/readme")
+	if err == nil {
+		t.Error("Recipient can still read the directory after revoke")
+	}
+	_, err = readme.load()
+	if err == nil {
+		t.Error("A handle kept from before the revoke still opens the file")
+	}
+	data, _ = alice0015.LoadFile("docs/readme")
+	if !reflect.DeepEqual(data, []byte("read me")) {
+		t.Error("Owner lost the file after revoke", string(data))
+	}
+
+	// putting back an older copy of a directory is noticed
+	alice0015.Mkdir("scratch")
+	scratch, _ := alice0015.locate("scratch")
+	old, _ := userlib.DatastoreGet(scratch.Location)
+	alice0015.StoreFile("scratch/a", []byte("a"))
+	_, err = alice0015.ReadDir("scratch")
+	if err != nil {
+		t.Error("Failed to read directory", err)
+	}
+	userlib.DatastoreSet(scratch.Location, old)
+	_, err = alice0015.ReadDir("scratch")
+	if err == nil {
+		t.Error("Failed to detect a rolled back directory")
+	}
+}
+
+func TestRenameNested(t *testing.T) {
+	alice0034, err := InitUser("alice0034", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0034", err)
+		return
+	}
+	bob0034, _ := InitUser("bob0034", "password")
+	alice0034.Mkdir("docs")
+	alice0034.Mkdir("docs/sub")
+	alice0034.Mkdir("archive")
+	alice0034.StoreFile("docs/draft", []byte("draft"))
+	alice0034.StoreFile("docs/sub/notes", []byte("notes"))
+	alice0034.StoreFile("top", []byte("top"))
+
+	if err := alice0034.RenameFile("docs/draft", "docs/final"); err != nil {
+		t.Error("Failed to rename inside a directory", err)
+	}
+	if data, err := alice0034.LoadFile("docs/final"); err != nil || string(data) != "draft" {
+		t.Error("Wrong contents after a nested rename", string(data), err)
+	}
+	if _, err := alice0034.LoadFile("docs/draft"); err == nil {
+		t.Error("Loaded a file under its old nested name")
+	}
+
+	// moving a shared directory keeps the share
+	magic_string, _ := alice0034.ShareFile("docs/sub", "bob0034")
+	if err := bob0034.ReceiveFile("sub", "alice0034", magic_string); err != nil {
+		t.Error("Failed to receive a nested directory", err)
+		return
+	}
+	if err := alice0034.RenameFile("docs/sub", "archive/old"); err != nil {
+		t.Error("Failed to move a directory between directories", err)
+	}
+	if data, err := alice0034.LoadFile("archive/old/notes"); err != nil || string(data) != "notes" {
+		t.Error("Wrong contents after a move", string(data), err)
+	}
+	if data, err := bob0034.LoadFile("sub/notes"); err != nil || string(data) != "notes" {
+		t.Error("A share broke when its directory moved", string(data), err)
+	}
+	if err := alice0034.RevokeFile("archive/old"); err != nil {
+		t.Error("Failed to revoke a moved directory", err)
+	}
+	if _, err := bob0034.LoadFile("sub/notes"); err == nil {
+		t.Error("Loaded a moved directory after revoke")
+	}
+	entries, _ := alice0034.ReadDir("docs")
+	if !reflect.DeepEqual(entries, []DirEntry{{"final", false}}) {
+		t.Error("Wrong entries left behind by a move", entries)
+	}
+
+	if alice0034.RenameFile("docs/final", "archive/old") == nil {
+		t.Error("Moved a file over an existing name")
+	}
+	if alice0034.RenameFile("archive", "archive/old/archive") == nil {
+		t.Error("Moved a directory between a top-level name and a directory")
+	}
+	if alice0034.RenameFile("archive/old", "archive/old/inner") == nil {
+		t.Error("Moved a directory into itself")
+	}
+	if alice0034.RenameFile("top", "docs/top") == nil || alice0034.RenameFile("docs/final", "final") == nil {
+		t.Error("Moved between a top-level name and a directory")
+	}
+	if alice0034.RenameFile("docs/missing", "docs/other") == nil {
+		t.Error("Renamed a file that doesn't exist")
+	}
+}
+
+func TestLoadFileRange(t *testing.T) {
+	alice0016, err := InitUser("alice0016", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0016", err)
+		return
+	}
+	alice0016.SetChunkSize(5)
+	alice0016.StoreFile("log", []byte("hello "))
+	alice0016.AppendFile("log", []byte("big "))
+	alice0016.AppendFile("log", []byte("world"))
+
+	for _, c := range []struct {
+		offset, length int
+		want           string
+	}{{0, 5, "hello"}, {4, 6, "o big "}, {10, 5, "world"}, {0, 15, "hello big world"}, {15, 0, ""}} {
+		data, err := alice0016.LoadFileRange("log", c.offset, c.length)
+		if err != nil || string(data) != c.want {
+			t.Error("Wrong range", c.offset, c.length, string(data), err)
+		}
+	}
+	for _, c := range [][2]int{{14, 2}, {-1, 2}, {0, -1}, {16, 0}} {
+		_, err := alice0016.LoadFileRange("log", c[0], c[1])
+		if err == nil {
+			t.Error("Read outside the file", c)
+		}
+	}
+
+	handle, _ := alice0016.locate("log")
+	entry := loadHeader(handle)
+	if len(entry.Chunks) != 3 {
+		t.Error("Expected three chunks", len(entry.Chunks))
+		return
+	}
+
+	// only the chunks covering the range are fetched
+	first, _ := userlib.DatastoreGet(entry.Chunks[0].Location)
+	userlib.DatastoreDelete(entry.Chunks[0].Location)
+	data, err := alice0016.LoadFileRange("log", 10, 5)
+	if err != nil || string(data) != "world" {
+		t.Error("Range read touched a chunk it didn't need", string(data), err)
+	}
+	_, err = alice0016.LoadFileRange("log", 0, 5)
+	if err == nil {
+		t.Error("Failed to detect a missing chunk")
+	}
+
+	// a chunk swapped for another one of the same file is caught
+	userlib.DatastoreSet(entry.Chunks[0].Location, first)
+	userlib.DatastoreSet(entry.Chunks[2].Location, first)
+	_, err = alice0016.LoadFileRange("log", 10, 5)
+	if err == nil {
+		t.Error("Failed to detect a swapped chunk")
+	}
+	data, _ = alice0016.LoadFileRange("log", 0, 5)
+	if string(data) != "hello" {
+		t.Error("Untouched chunk failed to load", string(data))
+	}
+
+	// so is a reordered chunk list
+	entry.Chunks[0], entry.Chunks[1] = entry.Chunks[1], entry.Chunks[0]
+	fileMarshal, _ := json.Marshal(entry)
+	userlib.DatastoreSet(handle.Location, fileMarshal)
+	_, err = alice0016.LoadFileRange("log", 0, 5)
+	if err == nil {
+		t.Error("Failed to detect a reordered chunk list")
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	alice0017, err := InitUser("alice0017", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0017", err)
+		return
+	}
+
+	// more than two chunks, written in uneven pieces
+	want := []byte(strings.Repeat("0123456789abcdef", defaultChunkSize/16*2+100))
+	writer, err := alice0017.OpenWriter("big")
+	if err != nil {
+		t.Error("Failed to open writer", err)
+		return
+	}
+	for rest := want; len(rest) > 0; {
+		n := 1000
+		if n > len(rest) {
+			n = len(rest)
+		}
+		writer.Write(rest[:n])
+		rest = rest[n:]
+	}
+	_, err = alice0017.LoadFile("big")
+	if err != nil {
+		t.Error("File should exist, empty, before the writer is closed", err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Error("Failed to close writer", err)
+	}
+	_, err = writer.Write([]byte("late"))
+	if err == nil {
+		t.Error("Wrote to a closed writer")
+	}
+
+	reader, err := alice0017.OpenReader("big")
+	if err != nil {
+		t.Error("Failed to open reader", err)
+		return
+	}
+	var got []byte
+	buf := make([]byte, 777)
+	for {
+		n, err := reader.Read(buf)
+		got = append(got, buf[:n]...)
+		if err != nil {
+			if err != EOF {
+				t.Error("Failed to stream the file", err)
+			}
+			break
+		}
+	}
+	// the end of the file is EOF itself, and stays that way
+	if n, err := reader.Read(buf); n != 0 || err != EOF {
+		t.Error("Expected EOF after the end of the file", n, err)
+	}
+	reader.Close()
+	if !reflect.DeepEqual(got, want) {
+		t.Error("Streamed contents differ", len(got), len(want))
+	}
+	data, _ := alice0017.LoadFile("big")
+	if !reflect.DeepEqual(data, want) {
+		t.Error("LoadFile disagrees with the writer")
+	}
+
+	// rewriting replaces the contents
+	writer, _ = alice0017.OpenWriter("big")
+	writer.Write([]byte("small now"))
+	writer.Close()
+	data, _ = alice0017.LoadFile("big")
+	if !reflect.DeepEqual(data, []byte("small now")) {
+		t.Error("Writer didn't replace the contents", string(data))
+	}
+
+	// a tampered chunk fails the read that reaches it, not before
+	writer, _ = alice0017.OpenWriter("big")
+	writer.Write(want)
+	writer.Close()
+	handle, _ := alice0017.locate("big")
+	entry := loadHeader(handle)
+	first, _ := userlib.DatastoreGet(entry.Chunks[0].Location)
+	userlib.DatastoreSet(entry.Chunks[1].Location, first)
+	reader, err = alice0017.OpenReader("big")
+	if err != nil {
+		t.Error("Failed to open reader", err)
+		return
+	}
+	buf = make([]byte, defaultChunkSize)
+	if n, err := reader.Read(buf); err != nil || n != len(buf) {
+		t.Error("First chunk should still read", n, err)
+	}
+	_, err = reader.Read(buf)
+	if err == nil || err == EOF {
+		t.Error("Failed to detect a tampered chunk", err)
+	}
+}
+
+func TestFixedChunks(t *testing.T) {
+	alice0018, err := InitUser("alice0018", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0018", err)
+		return
+	}
+	bob0018, _ := InitUser("bob0018", "password")
+	alice0018.SetChunkSize(4)
+	chunkSizes := func(filename string) []int {
+		handle, _ := alice0018.locate(filename)
+		entry := loadHeader(handle)
+		var sizes []int
+		for _, ref := range entry.Chunks {
+			sizes = append(sizes, ref.Size)
+			value, _ := userlib.DatastoreGet(ref.Location)
+			if len(value) > userlib.AESBlockSize+entry.ChunkSize+userlib.HashSize {
+				t.Error("Chunk object bigger than one chunk", len(value))
+			}
+		}
+		return sizes
+	}
+
+	alice0018.StoreFile("f", []byte("hello world!!"))
+	if sizes := chunkSizes("f"); !reflect.DeepEqual(sizes, []int{4, 4, 4, 1}) {
+		t.Error("Wrong chunking on store", sizes)
+	}
+	alice0018.AppendFile("f", []byte("abc"))
+	if sizes := chunkSizes("f"); !reflect.DeepEqual(sizes, []int{4, 4, 4, 4}) {
+		t.Error("Append didn't fill the last chunk", sizes)
+	}
+	alice0018.AppendFile("f", []byte("0123456789"))
+	if sizes := chunkSizes("f"); !reflect.DeepEqual(sizes, []int{4, 4, 4, 4, 4, 4, 2}) {
+		t.Error("Wrong chunking on append", sizes)
+	}
+	data, _ := alice0018.LoadFile("f")
+	if string(data) != "hello world!!abc0123456789" {
+		t.Error("Wrong contents", string(data))
+	}
+
+	// a file keeps the chunk size it was created with
+	if alice0018.SetChunkSize(0) == nil || alice0018.SetChunkSize(-4) == nil {
+		t.Error("Accepted an invalid chunk size")
+	}
+	alice0018.SetChunkSize(8)
+	alice0018, _ = GetUser("alice0018", "password")
+	if alice0018.ChunkSize != 8 {
+		t.Error("The chunk size wasn't kept in the user record", alice0018.ChunkSize)
+	}
+	alice0018.AppendFile("f", []byte("xyz"))
+	if sizes := chunkSizes("f"); !reflect.DeepEqual(sizes, []int{4, 4, 4, 4, 4, 4, 4, 1}) {
+		t.Error("Chunk size changed for an existing file", sizes)
+	}
+	data, _ = alice0018.LoadFileRange("f", 20, 8)
+	if string(data) != "456789xy" {
+		t.Error("Wrong range", string(data))
+	}
+	alice0018.StoreFile("g", []byte("0123456789"))
+	if sizes := chunkSizes("g"); !reflect.DeepEqual(sizes, []int{8, 2}) {
+		t.Error("New file didn't use the new chunk size", sizes)
+	}
+	alice0018.StoreFile("empty", nil)
+	data, err = alice0018.LoadFile("empty")
+	if err != nil || len(data) != 0 || len(chunkSizes("empty")) != 0 {
+		t.Error("Empty file should have no chunks", err)
+	}
+
+	// so does a file someone else writes with a writer
+	magic_string, _ := alice0018.ShareFile("g", "bob0018")
+	bob0018.ReceiveFile("g", "alice0018", magic_string)
+	writer, err := bob0018.OpenWriter("g")
+	if err != nil {
+		t.Error("Failed to open a writer on a shared file", err)
+		return
+	}
+	writer.Write([]byte(strings.Repeat("x", 20)))
+	writer.Close()
+	if sizes := chunkSizes("g"); !reflect.DeepEqual(sizes, []int{8, 8, 4}) {
+		t.Error("A writer changed the chunk size of someone else's file", sizes)
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	alice0019, err := InitUser("alice0019", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0019", err)
+		return
+	}
+	bob0019, _ := InitUser("bob0019", "password")
+	alice0019.SetChunkSize(4)
+	alice0019.StoreFile("f", []byte("aaaabbbbccccdd"))
+	magic_string, _ := alice0019.ShareFile("f", "bob0019")
+	err = bob0019.ReceiveFile("f", "alice0019", magic_string)
+	if err != nil {
+		t.Error("Failed to receive file", err)
+		return
+	}
+
+	handle, _ := alice0019.locate("f")
+	chunkLocations := func() []uuid.UUID {
+		entry := loadHeader(handle)
+		var locations []uuid.UUID
+		for _, ref := range entry.Chunks {
+			locations = append(locations, ref.Location)
+		}
+		return locations
+	}
+	before := chunkLocations()
+
+	// spans the boundary between the second and third chunks
+	err = alice0019.WriteAt("f", 6, []byte("XXXX"))
+	if err != nil {
+		t.Error("Failed to write", err)
+	}
+	data, _ := bob0019.LoadFile("f")
+	if string(data) != "aaaabbXXXXccdd" {
+		t.Error("Wrong contents after write", string(data))
+	}
+	after := chunkLocations()
+	if after[0] != before[0] || after[3] != before[3] || after[1] == before[1] || after[2] == before[2] {
+		t.Error("Write re-encrypted chunks it didn't touch")
+	}
+
+	// runs past the end
+	err = bob0019.WriteAt("f", 12, []byte("YYYYYY"))
+	if err != nil {
+		t.Error("Failed to write past the end", err)
+	}
+	data, _ = alice0019.LoadFile("f")
+	if string(data) != "aaaabbXXXXccYYYYYY" {
+		t.Error("Wrong contents after writing past the end", string(data))
+	}
+
+	// starts past the end, leaving a gap of zeros
+	err = alice0019.WriteAt("f", 20, []byte("Z"))
+	if err != nil {
+		t.Error("Failed to write after a gap", err)
+	}
+	data, _ = bob0019.LoadFile("f")
+	if !reflect.DeepEqual(data, []byte("aaaabbXXXXccYYYYYY\x00\x00Z")) {
+		t.Error("Wrong contents after writing after a gap", data)
+	}
+	err = alice0019.WriteAt("f", -1, []byte("Z"))
+	if err == nil {
+		t.Error("Wrote at a negative offset")
+	}
+	if alice0019.WriteAt("f", maxFileSize, []byte("Z")) == nil || alice0019.WriteAt("f", maxFileSize-1, []byte("ZZ")) == nil {
+		t.Error("Wrote past the largest a file can be")
+	}
+
+	// a long gap is cut into chunks like any other data
+	alice0019.StoreFile("g", []byte("abc"))
+	if err := alice0019.WriteAt("g", 30, []byte("end")); err != nil {
+		t.Error("Failed to write after a long gap", err)
+	}
+	gap, _ := alice0019.locate("g")
+	entry := loadHeader(gap)
+	for _, ref := range entry.Chunks[:len(entry.Chunks)-1] {
+		if ref.Size != 4 {
+			t.Error("Zeros weren't cut into whole chunks", ref.Size)
+		}
+	}
+	if data, _ := alice0019.LoadFile("g"); !reflect.DeepEqual(data, append(append([]byte("abc"), make([]byte, 27)...), "end"...)) {
+		t.Error("Wrong contents after writing after a long gap", data)
+	}
+
+	// a write or append that fails partway leaves the file as it was, and
+	// nothing it wrote behind
+	want, _ := alice0019.LoadFile("f")
+	refs := chunkLocations()
+	tampered, _ := userlib.DatastoreGet(refs[2])
+	userlib.DatastoreSet(refs[2], []byte("tampered"))
+	stored := len(userlib.DatastoreGetMap())
+	if alice0019.WriteAt("f", 0, []byte("############")) == nil {
+		t.Error("Wrote over a tampered chunk")
+	}
+	if len(userlib.DatastoreGetMap()) != stored {
+		t.Error("A failed write left chunks behind", len(userlib.DatastoreGetMap()), stored)
+	}
+	userlib.DatastoreSet(refs[2], tampered)
+	if data, err := bob0019.LoadFile("f"); err != nil || !reflect.DeepEqual(data, want) {
+		t.Error("A failed write changed the file", data, err)
+	}
+	last := refs[len(refs)-1]
+	tampered, _ = userlib.DatastoreGet(last)
+	userlib.DatastoreSet(last, []byte("tampered"))
+	if alice0019.AppendFile("f", []byte("more")) == nil {
+		t.Error("Appended after a tampered chunk")
+	}
+	if len(userlib.DatastoreGetMap()) != stored {
+		t.Error("A failed append left chunks behind", len(userlib.DatastoreGetMap()), stored)
+	}
+	userlib.DatastoreSet(last, tampered)
+	if data, err := bob0019.LoadFile("f"); err != nil || !reflect.DeepEqual(data, want) {
+		t.Error("A failed append changed the file", data, err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	alice0020, err := InitUser("alice0020", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0020", err)
+		return
+	}
+	bob0020, _ := InitUser("bob0020", "password")
+	alice0020.SetChunkSize(4)
+	// without history, dropped chunks are deleted straight away
+	alice0020.SetKeepVersions(0)
+	alice0020.StoreFile("f", []byte("aaaabbbbccccdd"))
+	magic_string, _ := alice0020.ShareFile("f", "bob0020")
+	err = bob0020.ReceiveFile("f", "alice0020", magic_string)
+	if err != nil {
+		t.Error("Failed to receive file", err)
+		return
+	}
+
+	handle, _ := alice0020.locate("f")
+	entry := loadHeader(handle)
+
+	err = alice0020.Truncate("f", 6)
+	if err != nil {
+		t.Error("Failed to truncate", err)
+	}
+	data, err := bob0020.LoadFile("f")
+	if err != nil || string(data) != "aaaabb" {
+		t.Error("Wrong contents after truncating", string(data), err)
+	}
+	for _, ref := range entry.Chunks[1:] {
+		if _, ok := userlib.DatastoreGet(ref.Location); ok {
+			t.Error("Dropped chunk is still in the datastore")
+		}
+	}
+	if _, ok := userlib.DatastoreGet(entry.Chunks[0].Location); !ok {
+		t.Error("Truncate rewrote a chunk it didn't need to")
+	}
+
+	// the file can still be appended to after the shorter chunk
+	bob0020.AppendFile("f", []byte("cccc"))
+	data, _ = alice0020.LoadFile("f")
+	if string(data) != "aaaabbcccc" {
+		t.Error("Wrong contents after appending to a truncated file", string(data))
+	}
+
+	err = bob0020.Truncate("f", 12)
+	if err != nil {
+		t.Error("Failed to grow file", err)
+	}
+	data, _ = alice0020.LoadFile("f")
+	if !reflect.DeepEqual(data, []byte("aaaabbcccc\x00\x00")) {
+		t.Error("Growing didn't fill with zeros", data)
+	}
+	alice0020.Truncate("f", 0)
+	data, err = bob0020.LoadFile("f")
+	if err != nil || len(data) != 0 {
+		t.Error("Failed to truncate to nothing", data, err)
+	}
+	if alice0020.Truncate("f", -1) == nil {
+		t.Error("Truncated to a negative size")
+	}
+	if alice0020.Truncate("f", maxFileSize+1) == nil {
+		t.Error("Grew a file past the largest it can be")
+	}
+
+	// growing a long way writes whole chunks of zeros
+	alice0020.StoreFile("g", []byte("abcdef"))
+	if err := alice0020.Truncate("g", 41); err != nil {
+		t.Error("Failed to grow a file a long way", err)
+	}
+	grown, _ := alice0020.locate("g")
+	entry = loadHeader(grown)
+	chunks := entry.Chunks
+	for _, ref := range chunks[:len(chunks)-1] {
+		if ref.Size != 4 {
+			t.Error("Zeros weren't cut into whole chunks", ref.Size)
+		}
+	}
+	if data, _ := alice0020.LoadFile("g"); !reflect.DeepEqual(data, append([]byte("abcdef"), make([]byte, 35)...)) {
+		t.Error("Growing a long way didn't fill with zeros", data)
+	}
+
+	// growing from a tampered chunk fails, and leaves the file as it was
+	tail := chunks[len(chunks)-1].Location
+	tampered, _ := userlib.DatastoreGet(tail)
+	userlib.DatastoreSet(tail, []byte("tampered"))
+	stored := len(userlib.DatastoreGetMap())
+	if alice0020.Truncate("g", 100) == nil {
+		t.Error("Grew a file from a tampered chunk")
+	}
+	if len(userlib.DatastoreGetMap()) != stored {
+		t.Error("A failed truncate left chunks behind")
+	}
+	userlib.DatastoreSet(tail, tampered)
+	if data, err := alice0020.LoadFile("g"); err != nil || len(data) != 41 {
+		t.Error("A failed truncate changed the file", len(data), err)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	alice0021, err := InitUser("alice0021", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0021", err)
+		return
+	}
+	bob0021, _ := InitUser("bob0021", "password")
+	alice0021.SetChunkSize(4)
+	bob0021.SetChunkSize(4)
+	bob0021.StoreFile("f", []byte("aaaabbbbcc"))
+	magic_string, _ := bob0021.ShareFile("f", "alice0021")
+	alice0021.ReceiveFile("f", "bob0021", magic_string)
+
+	err = alice0021.CopyFile("f", "g")
+	if err != nil {
+		t.Error("Failed to copy file", err)
+		return
+	}
+	data, _ := alice0021.LoadFile("g")
+	if string(data) != "aaaabbbbcc" {
+		t.Error("Copy has the wrong contents", string(data))
+	}
+
+	// the copy is alice's own and independent of the original
+	files, _ := alice0021.ListFiles()
+	for _, info := range files {
+		if info.Name == "g" && (!info.Owned || info.Chunks != 3) {
+			t.Error("Copy isn't an owned three-chunk file", info)
+		}
+	}
+	source, _ := alice0021.locate("f")
+	target, _ := alice0021.locate("g")
+	if reflect.DeepEqual(source.Keys, target.Keys) {
+		t.Error("Copy shares keys with the original")
+	}
+	bob0021.AppendFile("f", []byte("dd"))
+	alice0021.WriteAt("g", 0, []byte("xx"))
+	data, _ = alice0021.LoadFile("g")
+	if string(data) != "xxaabbbbcc" {
+		t.Error("Copy changed with the original", string(data))
+	}
+	data, _ = bob0021.LoadFile("f")
+	if string(data) != "aaaabbbbccdd" {
+		t.Error("Original changed with the copy", string(data))
+	}
+
+	if alice0021.CopyFile("f", "g") == nil {
+		t.Error("Copied over an existing file")
+	}
+	if alice0021.CopyFile("missing", "h") == nil {
+		t.Error("Copied a file that doesn't exist")
+	}
+	alice0021.Mkdir("d")
+	err = alice0021.CopyFile("g", "d/g")
+	if err != nil {
+		t.Error("Failed to copy into a directory", err)
+	}
+	data, _ = alice0021.LoadFile("d/g")
+	if string(data) != "xxaabbbbcc" {
+		t.Error("Copy into a directory has the wrong contents", string(data))
+	}
+
+	// a copy that fails partway leaves neither the new file nor any of
+	// the chunks it wrote
+	entry := loadHeader(source)
+	refs := entry.Chunks
+	tampered, _ := userlib.DatastoreGet(refs[2].Location)
+	userlib.DatastoreSet(refs[2].Location, []byte("tampered"))
+	stored := len(userlib.DatastoreGetMap())
+	for _, dst := range []string{"h", "d/h"} {
+		if alice0021.CopyFile("f", dst) == nil {
+			t.Error("Copied a tampered file")
+		}
+		if _, err := alice0021.locate(dst); err == nil {
+			t.Error("A failed copy left the new file behind", dst)
+		}
+	}
+	if len(userlib.DatastoreGetMap()) != stored {
+		t.Error("A failed copy left chunks behind", len(userlib.DatastoreGetMap()), stored)
+	}
+	userlib.DatastoreSet(refs[2].Location, tampered)
+}
+
+func TestVersions(t *testing.T) {
+	alice0022, err := InitUser("alice0022", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0022", err)
+		return
+	}
+	bob0022, _ := InitUser("bob0022", "password")
+	alice0022.SetChunkSize(4)
+	if alice0022.SetKeepVersions(-1) == nil || alice0022.SetKeepVersions(maxKeepVersions+1) == nil {
+		t.Error("Accepted an invalid number of versions to keep")
+	}
+	alice0022.SetKeepVersions(3)
+	if reloaded, _ := GetUser("alice0022", "password"); reloaded == nil || reloaded.KeepVersions != 3 {
+		t.Error("Number of versions to keep wasn't stored")
+	}
+	// the file keeps as many as alice chose, whatever its writers keep
+	bob0022.SetKeepVersions(0)
+	alice0022.StoreFile("f", []byte("aaaabb"))
+	magic_string, _ := alice0022.ShareFile("f", "bob0022")
+	bob0022.ReceiveFile("f", "alice0022", magic_string)
+	handle, _ := alice0022.locate("f")
+	first := loadHeader(handle)
+
+	bob0022.AppendFile("f", []byte("cc"))
+	entry := loadHeader(handle)
+	if len(entry.History) != 1 {
+		t.Error("A writer's setting trimmed the file's history", len(entry.History))
+		return
+	}
+	record := entry.History[0].Record.Location
+	alice0022.WriteAt("f", 0, []byte("xx"))
+	alice0022.Truncate("f", 3)
+	versions, err := bob0022.ListVersions("f")
+	if err != nil || len(versions) != 4 {
+		t.Error("Wrong versions listed", versions, err)
+		return
+	}
+	want := []string{"aaaabb", "aaaabbcc", "xxaabbcc", "xxa"}
+	for i, version := range versions {
+		if version.Version != i || version.Size != len(want[i]) || version.Current != (i == 3) {
+			t.Error("Wrong version info", version)
+		}
+		data, err := alice0022.LoadFileVersion("f", version.Version)
+		if err != nil || string(data) != want[i] {
+			t.Error("Wrong contents for version", i, string(data), err)
+		}
+	}
+
+	// restoring is a new change and keeps what it replaced
+	err = bob0022.RestoreVersion("f", 1)
+	if err != nil {
+		t.Error("Failed to restore version", err)
+	}
+	data, _ := alice0022.LoadFile("f")
+	if string(data) != "aaaabbcc" {
+		t.Error("Restore didn't bring back the old contents", string(data))
+	}
+	data, _ = alice0022.LoadFileVersion("f", 3)
+	if string(data) != "xxa" {
+		t.Error("Restore lost the version it replaced", string(data))
+	}
+
+	// only as many earlier versions as the file keeps are kept, and the
+	// record and chunks only the dropped version used are deleted
+	entry = loadHeader(handle)
+	if len(entry.History) != 3 || entry.History[0].Version != 1 {
+		t.Error("History wasn't pruned", len(entry.History))
+	}
+	if _, err := alice0022.LoadFileVersion("f", 0); err == nil {
+		t.Error("Loaded a version that should have been dropped")
+	}
+	if _, ok := userlib.DatastoreGet(record); ok {
+		t.Error("Dropped version's record left behind")
+	}
+	if _, ok := userlib.DatastoreGet(first.Chunks[1].Location); ok {
+		t.Error("Chunk only a dropped version used left behind")
+	}
+	if _, ok := userlib.DatastoreGet(first.Chunks[0].Location); !ok {
+		t.Error("Deleted a chunk a kept version still uses")
+	}
+
+	// versions are records of their own, so the header doesn't grow with
+	// the chunk count for each one kept
+	alice0022.StoreFile("big", make([]byte, 4*200))
+	big, _ := alice0022.locate("big")
+	before, _ := userlib.DatastoreGet(big.Location)
+	for i := 0; i < 5; i++ {
+		alice0022.AppendFile("big", []byte("x"))
+	}
+	after, _ := userlib.DatastoreGet(big.Location)
+	if len(after) > len(before)+len(before)/2 {
+		t.Error("Header grew with its history", len(before), len(after))
+	}
+
+	// history survives revocation, re-encrypted under the new keys
+	alice0022.RevokeFile("f")
+	data, err = alice0022.LoadFileVersion("f", 2)
+	if err != nil || string(data) != "xxaabbcc" {
+		t.Error("History lost on revoke", string(data), err)
+	}
+	if _, err := bob0022.ListVersions("f"); err == nil {
+		t.Error("Revoked user still lists versions")
+	}
+	if _, ok := userlib.DatastoreGet(entry.History[0].Record.Location); ok {
+		t.Error("Old version records left behind after revoke")
+	}
+	if _, ok := userlib.DatastoreGet(first.Chunks[0].Location); ok {
+		t.Error("Old chunks left behind after revoke")
+	}
+
+	// a tampered version is caught
+	handle, _ = alice0022.locate("f")
+	entry = loadHeader(handle)
+	tampered, _ := userlib.DatastoreGet(entry.History[0].Record.Location)
+	tampered[len(tampered)-1] ^= 1
+	userlib.DatastoreSet(entry.History[0].Record.Location, tampered)
+	if _, err := alice0022.LoadFileVersion("f", 1); err == nil {
+		t.Error("Failed to detect a tampered version")
+	}
+	if _, err := alice0022.ListVersions("f"); err == nil {
+		t.Error("Listed versions with a tampered record")
+	}
+	// even sealed with the file's keys, versions out of order are refused
+	entry.History[1].Version = 1
+	storeFileEntry(handle.Keys[0:16], handle.Keys[16:32], handle.Location, &entry)
+	if _, err := alice0022.LoadFileVersion("f", 2); err == nil {
+		t.Error("Failed to detect a tampered version number")
+	}
+	if alice0022.RestoreVersion("f", 42) == nil {
+		t.Error("Restored a version that doesn't exist")
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	alice0023, err := InitUser("alice0023", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0023", err)
+		return
+	}
+	bob0023, _ := InitUser("bob0023", "password")
+	for _, user := range []*User{alice0023, bob0023} {
+		user.SetChunkSize(4)
+		user.SetKeepVersions(0)
+	}
+	alice0023.StoreFile("f", []byte("aaaabbbb"))
+	alice0023.Mkdir("d")
+	alice0023.StoreFile("d/g", []byte("gggg"))
+	bob0023.StoreFile("h", []byte("hhhh"))
+	magic_string, _ := bob0023.ShareFile("h", "alice0023")
+	alice0023.ReceiveFile("h", "bob0023", magic_string)
+
+	err = alice0023.CreateSnapshot("before")
+	if err != nil {
+		t.Error("Failed to create snapshot", err)
+		return
+	}
+	// only the owner's files are pinned; bob's is copied
+	for path, pins := range map[string]int{"h": 0, "f": 1} {
+		handle, _ := alice0023.locate(path)
+		entry := loadHeader(handle)
+		if len(entry.Pins) != pins {
+			t.Error("Wrong pins for", path, entry.Pins)
+		}
+	}
+	if alice0023.CreateSnapshot("before") == nil {
+		t.Error("Created two snapshots with the same label")
+	}
+	alice0023.CreateSnapshot("also")
+
+	// the risky batch job
+	alice0023.WriteAt("f", 2, []byte("xxxx"))
+	alice0023.DeleteFile("d/g")
+	bob0023.Truncate("h", 1)
+	alice0023.RevokeFile("f")
+
+	want := map[string]string{"f": "aaaabbbb", "d/g": "gggg", "h": "hhhh"}
+	for path, contents := range want {
+		data, err := alice0023.LoadFileAtSnapshot("before", path)
+		if err != nil || string(data) != contents {
+			t.Error("Wrong contents in snapshot", path, string(data), err)
+		}
+	}
+	data, _ := alice0023.LoadFile("f")
+	if string(data) != "aaxxxxbb" {
+		t.Error("Snapshot changed the live file", string(data))
+	}
+	if _, err := alice0023.LoadFileAtSnapshot("before", "missing"); err == nil {
+		t.Error("Loaded a file that isn't in the snapshot")
+	}
+	if _, err := bob0023.LoadFileAtSnapshot("before", "f"); err == nil {
+		t.Error("Loaded another user's snapshot")
+	}
+
+	snapshots, err := alice0023.ListSnapshots()
+	if err != nil || len(snapshots) != 2 || snapshots[1].Files != 3 {
+		t.Error("Wrong snapshots listed", snapshots, err)
+	}
+
+	// deleting one snapshot leaves the other whole
+	err = alice0023.DeleteSnapshot("before")
+	if err != nil {
+		t.Error("Failed to delete snapshot", err)
+	}
+	for path, contents := range want {
+		data, err := alice0023.LoadFileAtSnapshot("also", path)
+		if err != nil || string(data) != contents {
+			t.Error("Deleting a snapshot broke another", path, string(data), err)
+		}
+	}
+	if _, err := alice0023.LoadFileAtSnapshot("before", "f"); err == nil {
+		t.Error("Loaded a deleted snapshot")
+	}
+
+	// once the last snapshot is gone, so are the chunks only it held
+	before := len(userlib.DatastoreGetMap())
+	alice0023.DeleteSnapshot("also")
+	if after := len(userlib.DatastoreGetMap()); after >= before {
+		t.Error("Deleting the last snapshot freed nothing", before, after)
+	}
+	snapshots, _ = alice0023.ListSnapshots()
+	if len(snapshots) != 0 {
+		t.Error("Deleted snapshots still listed", snapshots)
+	}
+	data, _ = bob0023.LoadFile("h")
+	if string(data) != "h" {
+		t.Error("Deleting snapshots broke a live file", string(data))
+	}
+	// a copy outlives the owner deleting the file
+	alice0023.CreateSnapshot("late")
+	bob0023.DeleteFile("h")
+	data, err = alice0023.LoadFileAtSnapshot("late", "h")
+	if err != nil || string(data) != "h" {
+		t.Error("Lost a copied file", string(data), err)
+	}
+	before = len(userlib.DatastoreGetMap())
+	alice0023.DeleteSnapshot("late")
+	if after := len(userlib.DatastoreGetMap()); after >= before {
+		t.Error("Deleting a snapshot left its copies", before, after)
+	}
+}
+
+// loadHeader opens the header of a file, for tests that look inside it.
+func loadHeader(handle fileHandle) FileEntry {
+	fileMarshal, _ := userlib.DatastoreGet(handle.Location)
+	entry, _ := openHeader(handle.Keys[0:16], handle.Keys[16:32], handle.Location, fileMarshal)
+	return entry
+}
+
+func TestRecords(t *testing.T) {
+	macKey := userlib.RandomBytes(16)
+	encKey := userlib.RandomBytes(16)
+	location := uuid.New()
+	ad := recordAD(recordChunk, location[:])
+
+	for _, size := range []int{0, 1, 15, 16, 17, 100} {
+		plaintext := userlib.RandomBytes(size)
+		record := sealRecord(macKey, encKey, ad, plaintext)
+		if len(record) != userlib.AESBlockSize+size+userlib.HashSize {
+			t.Error("Record isn't exactly the plaintext plus IV and tag", size, len(record))
+		}
+		opened, err := openRecord(macKey, encKey, ad, record)
+		if err != nil || len(opened) != size || (size > 0 && !reflect.DeepEqual(opened, plaintext)) {
+			t.Error("Record didn't round trip", size, err)
+		}
+	}
+
+	record := sealRecord(macKey, encKey, ad, []byte("hello"))
+	other := uuid.New()
+	if _, err := openRecord(macKey, encKey, recordAD(recordChunk, other[:]), record); err == nil {
+		t.Error("Opened a record for another UUID")
+	}
+	if _, err := openRecord(macKey, encKey, recordAD(recordNode, location[:]), record); err == nil {
+		t.Error("Opened a record as another kind of object")
+	}
+	for i := range record {
+		tampered := append([]byte{}, record...)
+		tampered[i] ^= 1
+		if _, err := openRecord(macKey, encKey, ad, tampered); err == nil {
+			t.Error("Failed to detect a tampered byte", i)
+		}
+	}
+	for _, short := range [][]byte{nil, {}, record[:userlib.HashSize], record[:len(record)-1]} {
+		if _, err := openRecord(macKey, encKey, ad, short); err == nil {
+			t.Error("Opened a truncated record", len(short))
+		}
+	}
+
+	// a sealed object moved to another UUID is rejected
+	alice0024, err := InitUser("alice0024", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0024", err)
+		return
+	}
+	alice0024.CreateGroup("team")
+	alice0024.CreateGroup("other")
+	teamUUID, _, _ := alice0024.groupLocation("team")
+	otherUUID, _, _ := alice0024.groupLocation("other")
+	team, _ := userlib.DatastoreGet(teamUUID)
+	userlib.DatastoreSet(otherUUID, team)
+	if _, err := alice0024.loadGroup("other"); err == nil {
+		t.Error("Loaded a group record moved from another UUID")
+	}
+
+	// a file header is a sealed record like any other: nothing in it is
+	// readable, and it opens only as the header at its own UUID
+	alice0024.StoreFile("f", []byte("header contents"))
+	alice0024.StoreFile("g", []byte("header contents"))
+	handle, _ := alice0024.locate("f")
+	moved, _ := alice0024.locate("g")
+	header, _ := userlib.DatastoreGet(handle.Location)
+	for _, plain := range []string{"header contents", `"Size":`, `"Chunks":`, "Size", "Chunks"} {
+		if strings.Contains(string(header), plain) {
+			t.Error("File header isn't opaque", plain)
+		}
+	}
+	if _, err := openRecord(handle.Keys[0:16], handle.Keys[16:32], recordAD(recordHeader, handle.Location[:]), header); err != nil {
+		t.Error("File header isn't a sealed record", err)
+	}
+	if _, err := openRecord(handle.Keys[0:16], handle.Keys[16:32], recordAD(recordChunk, handle.Location[:]), header); err == nil {
+		t.Error("Opened a file header as a chunk")
+	}
+	userlib.DatastoreSet(moved.Location, header)
+	if _, err := alice0024.LoadFile("g"); err == nil {
+		t.Error("Loaded a file header moved from another UUID")
+	}
+
+	// the user entry is a record too, and garbage is an error, not a panic
+	userlib.DatastoreSet(alice0024.UserUUID, []byte{1})
+	if _, err := GetUser("alice0024", "password"); err == nil {
+		t.Error("Loaded a corrupted user")
+	}
+}
+
+func TestPadding(t *testing.T) {
+	alice0035, err := InitUser("alice0035", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0035", err)
+		return
+	}
+	bob0035, _ := InitUser("bob0035", "password")
+	alice0035.SetChunkSize(16)
+	bob0035.SetChunkSize(16)
+	overhead := userlib.AESBlockSize + userlib.HashSize
+	storedSizes := func(filename string) (int, []int) {
+		handle, _ := alice0035.locate(filename)
+		header, _ := userlib.DatastoreGet(handle.Location)
+		var chunks []int
+		for _, ref := range loadHeader(handle).Chunks {
+			value, _ := userlib.DatastoreGet(ref.Location)
+			chunks = append(chunks, len(value)-overhead)
+		}
+		return len(header) - overhead, chunks
+	}
+
+	if alice0035.SetPadding(Padding(42)) == nil {
+		t.Error("Set an unknown padding")
+	}
+	err = alice0035.SetPadding(PadPowersOfTwo)
+	if err != nil {
+		t.Error("Failed to set padding", err)
+	}
+
+	// one store and many appends of the same bytes look the same
+	alice0035.StoreFile("once", []byte("abcdefghijklmnopqrs"))
+	alice0035.StoreFile("appended", []byte("a"))
+	for _, c := range "bcdefghijklmnopqrs" {
+		alice0035.AppendFile("appended", []byte(string(c)))
+	}
+	onceHeader, onceChunks := storedSizes("once")
+	appendedHeader, appendedChunks := storedSizes("appended")
+	if !reflect.DeepEqual(onceChunks, []int{16, 4}) || !reflect.DeepEqual(appendedChunks, onceChunks) {
+		t.Error("Chunks not padded to powers of two", onceChunks, appendedChunks)
+	}
+	if onceHeader&(onceHeader-1) != 0 || appendedHeader != onceHeader {
+		t.Error("Headers not padded to the same bucket", onceHeader, appendedHeader)
+	}
+	handle, _ := alice0035.locate("appended")
+	if header := loadHeader(handle); len(header.History) != defaultKeepVersions || header.Keep != defaultKeepVersions {
+		t.Error("Appends not kept as versions", len(header.History), header.Keep)
+	}
+	// a header is padded for the versions the file keeps, not those it has
+	alice0035.AppendFile("once", []byte(""))
+	handle, _ = alice0035.locate("once")
+	if header, _ := storedSizes("once"); header != onceHeader || len(loadHeader(handle).History) != 1 {
+		t.Error("A version grew the padded header", onceHeader, header)
+	}
+
+	// the padding belongs to the file, whoever writes it
+	magic_string, _ := alice0035.ShareFile("once", "bob0035")
+	bob0035.ReceiveFile("once", "alice0035", magic_string)
+	bob0035.AppendFile("once", []byte("tuvwx"))
+	if _, chunks := storedSizes("once"); !reflect.DeepEqual(chunks, []int{16, 8}) {
+		t.Error("Appending didn't keep the file's padding", chunks)
+	}
+	bob0035.WriteAt("once", 2, []byte("XY"))
+	bob0035.Truncate("once", 17)
+	data, err := alice0035.LoadFile("once")
+	if err != nil || string(data) != "abXYefghijklmnopq" {
+		t.Error("Padded file has the wrong contents", string(data), err)
+	}
+	data, _ = alice0035.LoadFileRange("once", 15, 2)
+	if string(data) != "pq" {
+		t.Error("Ranged read of a padded file failed", string(data))
+	}
+	if _, chunks := storedSizes("once"); !reflect.DeepEqual(chunks, []int{16, 1}) {
+		t.Error("Truncating didn't keep the file's padding", chunks)
+	}
+	if data, err := alice0035.LoadFileVersion("once", 0); err != nil || string(data) != "abcdefghijklmnopqrs" {
+		t.Error("Padded version has the wrong contents", string(data), err)
+	}
+
+	alice0035.SetPadding(PadFullChunks)
+	alice0035.StoreFile("full", []byte("abc"))
+	header, chunks := storedSizes("full")
+	if header%headerTier != 0 || !reflect.DeepEqual(chunks, []int{16}) {
+		t.Error("Wrong sizes with full chunks", header, chunks)
+	}
+	writer, _ := alice0035.OpenWriter("full")
+	writer.Write([]byte("a longer replacement"))
+	writer.Close()
+	if _, chunks := storedSizes("full"); !reflect.DeepEqual(chunks, []int{16, 16}) {
+		t.Error("Writer didn't keep the file's padding", chunks)
+	}
+	data, _ = alice0035.LoadFile("full")
+	if string(data) != "a longer replacement" {
+		t.Error("Writer wrote the wrong contents", string(data))
+	}
+
+	// files already stored keep their padding, and new ones are stored at
+	// their exact length
+	alice0035.SetPadding(PadNone)
+	alice0035.AppendFile("full", []byte("!"))
+	if _, chunks := storedSizes("full"); !reflect.DeepEqual(chunks, []int{16, 16}) {
+		t.Error("Existing file lost its padding", chunks)
+	}
+	alice0035.StoreFile("plain", []byte("abc"))
+	handle, _ = alice0035.locate("plain")
+	plain := loadHeader(handle)
+	headerMarshal := encodeObject(recordHeader, &plain)
+	if header, chunks := storedSizes("plain"); header != len(headerMarshal) || !reflect.DeepEqual(chunks, []int{3}) {
+		t.Error("New file padded after padding was turned off", header, chunks)
+	}
+}
+
+func TestHeaderLimit(t *testing.T) {
+	keys := userlib.RandomBytes(32)
+	location := uuid.New()
+	handle := fileHandle{Location: location, Keys: keys}
+	defer userlib.DatastoreDelete(location)
+
+	// a header of one-byte chunks, as many as it takes to reach the limit
+	sigma := make([]byte, userlib.HashSize)
+	chunks := make([]chunkRef, maxObjectSize/50)
+	for i := range chunks {
+		chunks[i] = chunkRef{Location: uuid.New(), Size: 1, Sigma: sigma}
+	}
+	overhead := len(sealRecord(keys[0:16], keys[16:32], recordAD(recordHeader, location[:]), nil))
+	sealedSize := func(n int) int {
+		headerMarshal := encodeObject(recordHeader, &FileEntry{Chunks: chunks[:n], ChunkSize: 1, Size: n})
+		return overhead + len(headerMarshal)
+	}
+	n := (maxObjectSize - sealedSize(0)) / (sealedSize(2) - sealedSize(1))
+	for sealedSize(n) > maxObjectSize {
+		n--
+	}
+	for sealedSize(n+1) <= maxObjectSize {
+		n++
+	}
+
+	fits := FileEntry{Chunks: chunks[:n], ChunkSize: 1, Size: n}
+	if err := storeFileEntry(keys[0:16], keys[16:32], location, &fits); err != nil {
+		t.Error("Failed to store a header at the size limit", err)
+		return
+	}
+	stored, _ := userlib.DatastoreGet(location)
+	if entry := loadHeader(handle); entry.Size != n || len(stored) > maxObjectSize {
+		t.Error("Header at the size limit doesn't open", entry.Size, len(stored))
+	}
+
+	// one chunk more is refused, and the header already there is kept
+	tooLarge := FileEntry{Chunks: chunks[:n+1], ChunkSize: 1, Size: n + 1}
+	if storeFileEntry(keys[0:16], keys[16:32], location, &tooLarge) == nil {
+		t.Error("Stored a header over the size limit")
+	}
+	if current, _ := userlib.DatastoreGet(location); !reflect.DeepEqual(current, stored) {
+		t.Error("A refused header replaced the stored one")
+	}
+}
+
+func TestObjectLimits(t *testing.T) {
+	alice0036, err := InitUser("alice0036", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0036", err)
+		return
+	}
+	if alice0036.SetChunkSize(maxChunkSize+1) == nil {
+		t.Error("Set a chunk size whose chunks can't be read back")
+	}
+
+	// the largest chunk, padded to full size, seals to exactly the
+	// largest record and reads back
+	err = alice0036.SetChunkSize(maxChunkSize)
+	if err != nil {
+		t.Error("Failed to set the largest chunk size", err)
+	}
+	alice0036.SetPadding(PadFullChunks)
+	alice0036.StoreFile("f", []byte("x"))
+	handle, _ := alice0036.locate("f")
+	chunks := loadHeader(handle).Chunks
+	if len(chunks) != 1 {
+		t.Error("Expected one chunk", len(chunks))
+		return
+	}
+	if record, _ := userlib.DatastoreGet(chunks[0].Location); len(record) != maxObjectSize {
+		t.Error("Full chunk isn't the largest record", len(record))
+	}
+	if data, err := alice0036.LoadFile("f"); err != nil || string(data) != "x" {
+		t.Error("Failed to load a file of the largest chunk", err)
+	}
+	userlib.DatastoreDelete(chunks[0].Location)
+
+	// anything larger isn't even opened
+	oversized := make([]byte, maxObjectSize+1)
+	if _, err := openRecord(handle.Keys[0:16], handle.Keys[16:32], recordAD(recordChunk, uuid.Nil[:]), oversized); err == nil {
+		t.Error("Opened an oversized record")
+	}
+	if decodeJSON(append([]byte(`"`), append(oversized, '"')...), new(string)) == nil {
+		t.Error("Decoded an oversized object")
+	}
+
+	// decoding is strict about the shape of what it's given
+	var dir directory
+	for _, bad := range []string{`{"Children":{}} {}`, `{"Children":{},"Extra":1}`, `{"Children":{"a/b":{"Keys":null}}}`, `[`} {
+		if decodeJSON([]byte(bad), &dir) == nil {
+			t.Error("Decoded a malformed directory", bad)
+		}
+	}
+	var decoded directory
+	if err := decodeJSON([]byte(` {"Version":1,"Children":{}} `), &decoded); err != nil || decoded.Version != 1 {
+		t.Error("Failed to decode a directory", err)
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	alice0037, err := InitUser("alice0037", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0037", err)
+		return
+	}
+	alice0037.StoreFile("file1", []byte("contents"))
+	alice0037.CreateGroup("team")
+	userAD := recordAD(recordUser, alice0037.UserUUID[:])
+
+	// everything is written in an envelope naming its kind and schema
+	marshal, _ := userlib.DatastoreGet(alice0037.UserUUID)
+	opened, _ := openRecord(alice0037.HmacKey, alice0037.SymKey, userAD, marshal)
+	object, rest := readStoredObject(opened)
+	if object.Kind != recordUser || object.Schema != currentSchema(recordUser) || len(rest) != 0 {
+		t.Error("User entry isn't in a versioned envelope", object.Kind, object.Schema)
+	}
+
+	// objects written before there were envelopes, or while they were
+	// JSON, are still read
+	bare, _ := json.Marshal(alice0037)
+	enveloped, _ := json.Marshal(storedObject{recordUser, 1, bare})
+	for _, old := range [][]byte{bare, enveloped} {
+		userlib.DatastoreSet(alice0037.UserUUID, sealRecord(alice0037.HmacKey, alice0037.SymKey, userAD, old))
+		alice, err := GetUser("alice0037", "password")
+		if err != nil {
+			t.Error("Failed to read an old user entry", err)
+			return
+		}
+		if data, err := alice.LoadFile("file1"); err != nil || string(data) != "contents" {
+			t.Error("Failed to load a file after reading an old user entry", err)
+		}
+	}
+	alice, _ := GetUser("alice0037", "password")
+	handle, _ := alice.locate("file1")
+	header := loadHeader(handle)
+	bare, _ = json.Marshal(header)
+	userlib.DatastoreSet(handle.Location, sealRecord(handle.Keys[0:16], handle.Keys[16:32], recordAD(recordHeader, handle.Location[:]), bare))
+	if data, err := alice.LoadFile("file1"); err != nil || string(data) != "contents" {
+		t.Error("Failed to load a file with a header without an envelope", err)
+	}
+
+	// a new step upgrades old groups as they are read, and they are written
+	// back in the new schema
+	steps := migrations[recordGroup]
+	defer func() { migrations[recordGroup] = steps }()
+	migrations[recordGroup] = append(steps[:len(steps):len(steps)], func(body []byte) ([]byte, error) {
+		var group Group
+		d := decoder{data: body}
+		group.decode(&d)
+		if err := d.finish(); err != nil {
+			return nil, err
+		}
+		group.Members = append(group.Members, "migrated")
+		var e encoder
+		group.encode(&e)
+		return e.buf, nil
+	})
+	group, err := alice.loadGroup("team")
+	if err != nil || !reflect.DeepEqual(group.Members, []string{"migrated"}) {
+		t.Error("Group wasn't migrated on read", group, err)
+		return
+	}
+	alice.storeGroup(group)
+	group, err = alice.loadGroup("team")
+	if err != nil || !reflect.DeepEqual(group.Members, []string{"migrated"}) {
+		t.Error("Group was migrated twice", group, err)
+	}
+	groupUUID, groupMacKey, groupEncKey := alice.groupLocation("team")
+	marshal, _ = userlib.DatastoreGet(groupUUID)
+	opened, _ = openEntry(groupMacKey, groupEncKey, recordGroup, groupUUID, marshal)
+	if object, _ := readStoredObject(opened); object.Schema != firstBinarySchema+len(steps)+1 {
+		t.Error("Group wasn't written back in the new schema", object.Schema)
+	}
+
+	// an object from a newer version, or of another kind, is refused
+	newer := encodeObject(recordGroup, group)
+	newer[1+4+len(recordGroup)+3]++
+	for _, forged := range [][]byte{newer, encodeObject(recordSnapshot, group)} {
+		userlib.DatastoreSet(groupUUID, sealEntry(groupMacKey, groupEncKey, recordGroup, groupUUID, forged))
+		if _, err := alice.loadGroup("team"); err == nil {
+			t.Error("Loaded a group that isn't in a schema we know")
+		}
+	}
+}
+
+func TestBinaryEncoding(t *testing.T) {
+	alice0038, err := InitUser("alice0038", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0038", err)
+		return
+	}
+	bob0038, _ := InitUser("bob0038", "password")
+	alice0038.StoreFile("file1", []byte("contents"))
+	alice0038.AppendFile("file1", []byte(" and more"))
+	alice0038.Mkdir("dir")
+	alice0038.StoreFile("dir/file2", []byte("nested"))
+	alice0038.CreateSnapshot("snap")
+	magic_string, _ := alice0038.ShareFile("file1", "bob0038")
+	bob0038.ReceiveFile("file1", "alice0038", magic_string)
+
+	// what is decoded is what was encoded
+	user, _ := GetUser("alice0038", "password")
+	handle, _ := user.locate("file1")
+	header := loadHeader(handle)
+	snap, _ := user.loadSnapshot("snap")
+	dirHandle, _ := user.locate("dir")
+	dirData, _ := dirHandle.load()
+	var dir directory
+	if err := decodeObject(objectDirectory, dirData, &dir); err != nil || len(dir.Children) != 1 {
+		t.Error("Failed to decode a directory", err)
+	}
+	objects := map[string]binaryObject{recordUser: user, recordHeader: &header, recordSnapshot: snap, objectDirectory: &dir}
+	decoded := map[string]binaryObject{recordUser: &User{}, recordHeader: &FileEntry{}, recordSnapshot: &snapshot{}, objectDirectory: &directory{}}
+	for kind, v := range objects {
+		encoded := encodeObject(kind, v)
+		if err := decodeObject(kind, encoded, decoded[kind]); err != nil || !reflect.DeepEqual(encodeObject(kind, decoded[kind]), encoded) {
+			t.Error("Object didn't round trip", kind, err)
+		}
+		// the same value always encodes the same way
+		for i := 0; i < 10; i++ {
+			if !reflect.DeepEqual(encodeObject(kind, v), encoded) {
+				t.Error("Object encoded two ways", kind)
+				break
+			}
+		}
+		// and every truncation or extension of it is an error
+		for i := 0; i < len(encoded); i++ {
+			if decodeObject(kind, encoded[:i], decoded[kind]) == nil {
+				t.Error("Decoded a truncated object", kind, i)
+				break
+			}
+		}
+		if decodeObject(kind, append(encoded, 0), decoded[kind]) == nil {
+			t.Error("Decoded an object with trailing data", kind)
+		}
+	}
+
+	// the binary encoding is well under what JSON took
+	jsonHeader, _ := json.Marshal(header)
+	if binaryHeader := encodeObject(recordHeader, &header); len(binaryHeader)*3 > len(jsonHeader)*2 {
+		t.Error("Binary header isn't well under JSON", len(binaryHeader), len(jsonHeader))
+	}
+
+	// maps are written in key order, and a decoder refuses any other
+	reordered := directory{Children: map[string]fileHandle{"a": newFileHandle(false), "b": newFileHandle(false)}}
+	var e encoder
+	reordered.encode(&e)
+	swapped := encoder{}
+	swapped.writeUint(reordered.Version, 8)
+	swapped.writeStrings([]string{"b", "a"})
+	for _, name := range []string{"b", "a"} {
+		child := reordered.Children[name]
+		swapped.writeBool(child.Dir)
+		swapped.writeUUID(child.Location)
+		swapped.writeBytes(child.Keys)
+	}
+	d := decoder{data: e.buf}
+	dir.decode(&d)
+	if d.finish() != nil {
+		t.Error("Failed to decode a directory in key order")
+	}
+	d = decoder{data: swapped.buf}
+	dir.decode(&d)
+	if d.finish() == nil {
+		t.Error("Decoded a directory out of key order")
+	}
+
+	// a count larger than the data left is refused before anything is
+	// allocated for it
+	huge := encoder{}
+	huge.writeCount(1 << 30)
+	d = decoder{data: huge.buf}
+	if d.readStrings() != nil || d.finish() == nil {
+		t.Error("Decoded a forged count")
+	}
+
+	// nodes signed before the binary encoding still verify
+	node := bob0038.SharedFiles["file1"]
+	nodeMarshal, _ := userlib.DatastoreGet(node.Node)
+	contentMarshal, _ := openEntry(node.NodeKeys[0:16], node.NodeKeys[16:32], recordNode, node.Node, nodeMarshal)
+	var content accessNode
+	decodeObject(recordNode, contentMarshal, &content)
+	content.Sigma, _ = userlib.DSSign(alice0038.DsSk, legacyAccessNodeSigned(node.Node, content))
+	contentMarshal, _ = json.Marshal(content)
+	userlib.DatastoreSet(node.Node, sealEntry(node.NodeKeys[0:16], node.NodeKeys[16:32], recordNode, node.Node, contentMarshal))
+	if data, err := bob0038.LoadFile("file1"); err != nil || string(data) != "contents and more" {
+		t.Error("Failed to load a file through a node signed as JSON", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	inputs := [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("abcabcabcabcabcabcabcabcabcabc"),
+		[]byte(strings.Repeat("x", 1000)),
+		[]byte(strings.Repeat(`{"level":"info","msg":"request served","status":200}`+"\n", 200)),
+		userlib.RandomBytes(5000),
+		append(userlib.RandomBytes(300), userlib.RandomBytes(300)...),
+	}
+	for _, data := range inputs {
+		compressed := compressLZ(data)
+		expanded, err := expandLZ(compressed, len(data))
+		if err != nil || string(expanded) != string(data) {
+			t.Error("Data didn't survive compression", len(data), err)
+		}
+		// what follows a chunk is padding, and ignored
+		expanded, err = expandLZ(append(compressed, 0, 0, 0), len(data))
+		if err != nil || string(expanded) != string(data) {
+			t.Error("Padding after compressed data was read", len(data), err)
+		}
+		// a cut stream can end the chunk early, but never differently
+		for i := 0; i < len(compressed) && len(data) > 0; i++ {
+			if out, err := expandLZ(compressed[:i], len(data)); err == nil && string(out) != string(data) {
+				t.Error("Expanded truncated data", len(data), i)
+				break
+			}
+		}
+	}
+	logs := inputs[4]
+	if compressed := compressLZ(logs); len(compressed)*10 > len(logs) {
+		t.Error("Repetitive logs didn't compress", len(compressed), len(logs))
+	}
+	for _, forged := range [][]byte{
+		{0x04, 0, 0},           // copy from before the start
+		{0x10, 'a', 0, 0},      // copy from distance zero
+		{0x10, 'a', 0, 2},      // copy from before the start
+		{0x1f, 'a', 0, 1, 255}, // length runs off the end
+		{0x0f},                 // copy with nothing to copy from
+	} {
+		if _, err := expandLZ(forged, 100); err == nil {
+			t.Error("Expanded forged data", forged)
+		}
+	}
+	if _, err := expandLZ(compressLZ(logs), len(logs)-1); err == nil {
+		t.Error("Expanded past the size of the chunk")
+	}
+
+	alice0039, err := InitUser("alice0039", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0039", err)
+		return
+	}
+	alice0039.SetChunkSize(4096)
+	bob0039, _ := InitUser("bob0039", "password")
+	if alice0039.SetCompression(Compression(7)) == nil {
+		t.Error("Accepted an unknown compression")
+	}
+	alice0039.StoreFile("plain", logs)
+	alice0039.SetCompression(CompressLZ)
+	alice0039.StoreFile("logs", logs)
+	alice0039.StoreFile("random", inputs[5])
+
+	plain, _ := alice0039.locate("plain")
+	compressed, _ := alice0039.locate("logs")
+	if loadHeader(plain).Compression != CompressNone || loadHeader(compressed).Compression != CompressLZ {
+		t.Error("Files don't keep the compression they were created with")
+	}
+	stored := 0
+	for _, ref := range loadHeader(compressed).Chunks {
+		record, _ := userlib.DatastoreGet(ref.Location)
+		stored += len(record) - userlib.AESBlockSize - userlib.HashSize
+	}
+	if stored*5 > len(logs) {
+		t.Error("Compressed file isn't stored compressed", stored, len(logs))
+	}
+	random, _ := alice0039.locate("random")
+	for _, ref := range loadHeader(random).Chunks {
+		record, _ := userlib.DatastoreGet(ref.Location)
+		if len(record) > userlib.AESBlockSize+4096+1+userlib.HashSize {
+			t.Error("Incompressible chunk grew by more than a byte", len(record))
+		}
+	}
+	for _, name := range []string{"plain", "logs", "random"} {
+		data, err := alice0039.LoadFile(name)
+		want := logs
+		if name == "random" {
+			want = inputs[5]
+		}
+		if err != nil || string(data) != string(want) {
+			t.Error("Failed to load file", name, err)
+		}
+	}
+
+	// everyone who writes to a file compresses it the way it was created
+	magic_string, _ := alice0039.ShareFile("logs", "bob0039")
+	bob0039.ReceiveFile("logs", "alice0039", magic_string)
+	bob0039.AppendFile("logs", logs)
+	bob0039.WriteAt("logs", 10, []byte("overwritten"))
+	want := append(append([]byte{}, logs...), logs...)
+	copy(want[10:], "overwritten")
+	for _, user := range []*User{alice0039, bob0039} {
+		if data, err := user.LoadFile("logs"); err != nil || string(data) != string(want) {
+			t.Error("Failed to load a compressed file after writes", user.Username, err)
+		}
+	}
+	if loadHeader(compressed).Compression != CompressLZ {
+		t.Error("Another user's write changed the file's compression")
+	}
+	if data, _ := alice0039.LoadFileRange("logs", 5000, 100); string(data) != string(want[5000:5100]) {
+		t.Error("Range of a compressed file is wrong")
+	}
+	reader, _ := alice0039.OpenReader("logs")
+	if data, err := readAll(reader); err != nil || string(data) != string(want) {
+		t.Error("Streamed compressed file is wrong", err)
+	}
+	if data, err := alice0039.LoadFileVersion("logs", 0); err != nil || string(data) != string(logs) {
+		t.Error("Earlier version of a compressed file is wrong", err)
+	}
+	alice0039.CreateSnapshot("snap")
+	alice0039.Truncate("logs", 3)
+	if data, err := alice0039.LoadFileAtSnapshot("snap", "logs"); err != nil || string(data) != string(want) {
+		t.Error("Snapshot of a compressed file is wrong", err)
+	}
+
+	// copies take the copier's compression
+	bob0039.CopyFile("logs", "copy")
+	copied, _ := bob0039.locate("copy")
+	if data, err := bob0039.LoadFile("copy"); err != nil || string(data) != string(want[:3]) || loadHeader(copied).Compression != CompressNone {
+		t.Error("Copy of a compressed file is wrong", string(data), err)
+	}
+
+	// a tampered flag on a chunk is caught
+	handle, _ := alice0039.locate("random")
+	header := loadHeader(handle)
+	ref := header.Chunks[0]
+	record, _ := userlib.DatastoreGet(ref.Location)
+	data, _ := openRecord(handle.Keys[0:16], handle.Keys[16:32], recordAD(recordChunk, ref.Location[:]), record)
+	data[0] = 9
+	record = sealRecord(handle.Keys[0:16], handle.Keys[16:32], recordAD(recordChunk, ref.Location[:]), data)
+	userlib.DatastoreSet(ref.Location, record)
+	header.Chunks[0].Sigma = recordTag(record)
+	storeFileEntry(handle.Keys[0:16], handle.Keys[16:32], handle.Location, &header)
+	if _, err := alice0039.LoadFile("random"); err == nil {
+		t.Error("Loaded a chunk with an unknown compression flag")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	alice0040, err := InitUser("alice0040", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0040", err)
+		return
+	}
+	bob0040, _ := InitUser("bob0040", "password")
+	alice0040.SetChunkSize(4096)
+	bob0040.SetChunkSize(4096)
+	alice0040.SetDedup(true)
+	base := userlib.RandomBytes(64 * 1024)
+	edited := append(append(append([]byte{}, base[:30000]...), "a small insertion"...), base[30000:]...)
+
+	// every chunk a file lists, now or in a version it keeps
+	chunkRefs := func(handle fileHandle) map[uuid.UUID]chunkRef {
+		header := loadHeader(handle)
+		refs := make(map[uuid.UUID]chunkRef)
+		for _, ref := range header.Chunks {
+			refs[ref.Location] = ref
+		}
+		for _, versionRef := range header.History {
+			version, _ := header.loadVersion(handle.Keys[16:32], handle.Keys[0:16], versionRef)
+			for _, ref := range version.Chunks {
+				refs[ref.Location] = ref
+			}
+		}
+		return refs
+	}
+	// every chunk any of alice's files has used, to check they all go
+	used := make(map[uuid.UUID]chunkRef)
+	track := func(name string) FileEntry {
+		handle, _ := alice0040.locate(name)
+		for location, ref := range chunkRefs(handle) {
+			used[location] = ref
+		}
+		return loadHeader(handle)
+	}
+
+	before := len(userlib.DatastoreGetMap())
+	alice0040.StoreFile("base", base)
+	stored := len(userlib.DatastoreGetMap()) - before
+	alice0040.StoreFile("edited", edited)
+	if added := len(userlib.DatastoreGetMap()) - before - stored; added*4 > stored {
+		t.Error("An edited copy didn't share chunks with the original", added, stored)
+	}
+	for name, want := range map[string][]byte{"base": base, "edited": edited} {
+		if data, err := alice0040.LoadFile(name); err != nil || string(data) != string(want) {
+			t.Error("Failed to load a deduplicated file", name, err)
+		}
+	}
+	header := track("edited")
+	cut := false
+	for _, ref := range header.Chunks[:len(header.Chunks)-1] {
+		cut = cut || ref.Size != header.ChunkSize
+	}
+	if !header.Dedup || !cut {
+		t.Error("Deduplicated file isn't cut by its contents")
+	}
+
+	// chunks are named with the writer's own keys, so nobody else can find
+	// them from the contents
+	bob0040.SetDedup(true)
+	bob0040.StoreFile("base", base)
+	bobBase, _ := bob0040.locate("base")
+	aliceHandle, _ := alice0040.locate("base")
+	aliceBase := track("base")
+	aliceRefs := chunkRefs(aliceHandle)
+	for location := range chunkRefs(bobBase) {
+		if _, ok := aliceRefs[location]; ok {
+			t.Error("Two users' chunks share a name")
+			break
+		}
+	}
+	if ref := aliceBase.Chunks[0]; ref.Location == bytesToUUID(userlib.Hash(base[:ref.Size])) {
+		t.Error("Chunk is named by its hash alone")
+	}
+
+	// a chunk repeated within a file is stored once
+	repeated := []byte(strings.Repeat(string(userlib.RandomBytes(4096)), 16))
+	alice0040.StoreFile("repeated", repeated)
+	repeatedHandle, _ := alice0040.locate("repeated")
+	if header := track("repeated"); len(chunkRefs(repeatedHandle))*2 > len(header.Chunks) {
+		t.Error("Repeated chunks were stored more than once", len(chunkRefs(repeatedHandle)), len(header.Chunks))
+	}
+
+	// a copy, and a file written through a writer, are cut the same way
+	alice0040.CopyFile("base", "copy")
+	writer, _ := alice0040.OpenWriter("written")
+	for i := 0; i < len(base); i += 1000 {
+		end := i + 1000
+		if end > len(base) {
+			end = len(base)
+		}
+		writer.Write(base[i:end])
+	}
+	writer.Close()
+	for _, name := range []string{"copy", "written"} {
+		if header := track(name); !reflect.DeepEqual(header.Chunks, aliceBase.Chunks) {
+			t.Error("File with the same contents doesn't share its chunks", name)
+		}
+		if data, err := alice0040.LoadFile(name); err != nil || string(data) != string(base) {
+			t.Error("Failed to load a deduplicated file", name, err)
+		}
+	}
+
+	// a file padded differently doesn't share chunks stored at another length
+	alice0040.SetPadding(PadFullChunks)
+	alice0040.StoreFile("padded", base)
+	alice0040.SetPadding(PadNone)
+	padded, _ := alice0040.locate("padded")
+	for _, ref := range loadHeader(padded).Chunks {
+		if _, ok := aliceRefs[ref.Location]; ok {
+			t.Error("A padded file shares a chunk stored at its exact length")
+			break
+		}
+		if record, _ := userlib.DatastoreGet(ref.Location); len(record) != userlib.AESBlockSize+4096+1+userlib.HashSize {
+			t.Error("A padded file's chunk isn't padded", len(record))
+			break
+		}
+	}
+	if data, err := alice0040.LoadFile("padded"); err != nil || string(data) != string(base) {
+		t.Error("Failed to load a padded deduplicated file", err)
+	}
+	alice0040.DeleteFile("padded")
+
+	// edits keep the file's contents right, whatever chunks they fall in
+	want := append([]byte{}, edited...)
+	alice0040.WriteAt("edited", 5000, []byte("patched across a boundary, maybe"))
+	copy(want[5000:], "patched across a boundary, maybe")
+	alice0040.AppendFile("edited", base[:10000])
+	want = append(want, base[:10000]...)
+	alice0040.Truncate("edited", 70000)
+	want = want[:70000]
+	alice0040.WriteAt("edited", 69990, []byte("past the end"))
+	want = append(want[:69990], "past the end"...)
+	magic_string, _ := alice0040.ShareFile("edited", "bob0040")
+	bob0040.ReceiveFile("edited", "alice0040", magic_string)
+	bob0040.AppendFile("edited", []byte("from bob"))
+	want = append(want, "from bob"...)
+	track("edited")
+	for _, user := range []*User{alice0040, bob0040} {
+		if data, err := user.LoadFile("edited"); err != nil || string(data) != string(want) {
+			t.Error("Failed to load a deduplicated file after edits", user.Username, err)
+		}
+	}
+	if data, err := alice0040.LoadFileRange("edited", 12345, 20000); err != nil || string(data) != string(want[12345:32345]) {
+		t.Error("Range of a deduplicated file is wrong", err)
+	}
+	reader, _ := alice0040.OpenReader("edited")
+	if data, err := readAll(reader); err != nil || string(data) != string(want) {
+		t.Error("Streamed deduplicated file is wrong", err)
+	}
+	if data, err := alice0040.LoadFileVersion("edited", 0); err != nil || string(data) != string(edited) {
+		t.Error("Earlier version of a deduplicated file is wrong", err)
+	}
+
+	// versions dropped as soon as they're made release what they held
+	alice0040.SetKeepVersions(0)
+	alice0040.StoreFile("unkept", base[:16000])
+	for i := 1; i < 4; i++ {
+		alice0040.AppendFile("unkept", base[16000*i:16000*(i+1)])
+		track("unkept")
+	}
+	alice0040.SetKeepVersions(defaultKeepVersions)
+	if data, err := alice0040.LoadFile("unkept"); err != nil || string(data) != string(base[:64000]) {
+		t.Error("A file that keeps no versions lost chunks it uses", err)
+	}
+
+	// a chunk goes only when nothing uses it any more
+	alice0040.CreateSnapshot("snap")
+	alice0040.DeleteFile("base")
+	alice0040.DeleteFile("copy")
+	alice0040.StoreFile("edited-again", edited)
+	track("edited-again")
+	for _, name := range []string{"written", "edited-again"} {
+		if _, err := alice0040.LoadFile(name); err != nil {
+			t.Error("Deleting a file took chunks another one uses", name, err)
+		}
+	}
+	alice0040.DeleteFile("written")
+	if data, err := alice0040.LoadFileAtSnapshot("snap", "base"); err != nil || string(data) != string(base) {
+		t.Error("Deleting a file took chunks a snapshot uses", err)
+	}
+	alice0040.RevokeFile("edited")
+	track("edited")
+	if data, err := alice0040.LoadFile("edited"); err != nil || string(data) != string(want) {
+		t.Error("Failed to load a deduplicated file after revoking", err)
+	}
+	if data, err := alice0040.LoadFileVersion("edited", 0); err != nil || string(data) != string(edited) {
+		t.Error("Earlier version of a deduplicated file is wrong after revoking", err)
+	}
+
+	// a count that doesn't open leaves its chunk alone
+	kept := track("edited-again").Chunks[0]
+	countUUID, _, _ := countLocation(kept)
+	count, _ := userlib.DatastoreGet(countUUID)
+	userlib.DatastoreSet(countUUID, []byte("tampered"))
+	alice0040.DeleteFile("edited-again")
+	if _, ok := userlib.DatastoreGet(kept.Location); !ok {
+		t.Error("Deleted a chunk whose count was tampered with")
+	}
+	userlib.DatastoreSet(countUUID, count)
+
+	// once every file and snapshot is gone, so is every chunk and count
+	for _, name := range []string{"edited", "repeated", "unkept"} {
+		alice0040.DeleteFile(name)
+	}
+	alice0040.DeleteSnapshot("snap")
+	for location, ref := range used {
+		countUUID, _, _ := countLocation(ref)
+		_, chunk := userlib.DatastoreGet(location)
+		if _, counted := userlib.DatastoreGet(countUUID); chunk || counted {
+			if location != kept.Location {
+				t.Error("Chunk outlived every file that used it", chunk, counted)
+				break
+			}
+		}
+	}
+	if data, err := bob0040.LoadFile("base"); err != nil || string(data) != string(base) {
+		t.Error("Another user's copy of the same contents went with alice's", err)
+	}
+
+	// headers and snapshots written before chunk references had keys
+	// still load
+	alice0040.SetDedup(false)
+	alice0040.StoreFile("old", []byte("old contents"))
+	alice0040.CreateSnapshot("old")
+	handle, _ := alice0040.locate("old")
+	header = loadHeader(handle)
+	ref := header.Chunks[0]
+	var e encoder
+	e.writeCount(1)
+	e.writeUUID(ref.Location)
+	e.writeInt(int64(ref.Size))
+	e.writeBytes(ref.Sigma)
+	e.writeInt(int64(header.ChunkSize))
+	e.writeInt(int64(header.Size))
+	e.writeInt(header.Modified)
+	e.writeInt(int64(header.Version))
+	e.writeInt(int64(header.Keep))
+	e.writeCount(0)
+	e.writeCount(0)
+	e.writeBool(false)
+	e.writeUint(uint64(header.Padding), 1)
+	e.writeBytes(nil)
+	e.writeUint(uint64(header.Compression), 1)
+	var envelope encoder
+	envelope.writeUint(binaryMarker, 1)
+	envelope.writeString(recordHeader)
+	envelope.writeUint(keyedHeaderSchema-1, 4)
+	envelope.writeBytes(e.buf)
+	userlib.DatastoreSet(handle.Location, sealRecord(handle.Keys[0:16], handle.Keys[16:32], recordAD(recordHeader, handle.Location[:]), envelope.buf))
+	snap, _ := alice0040.loadSnapshot("old")
+	e = encoder{}
+	e.writeUUID(snap.ID)
+	e.writeString(snap.Label)
+	e.writeInt(snap.Created)
+	e.writeStrings([]string{"old"})
+	e.writeUUID(handle.Location)
+	e.writeBytes(handle.Keys)
+	e.writeCount(1)
+	e.writeUUID(ref.Location)
+	e.writeInt(int64(ref.Size))
+	e.writeBytes(ref.Sigma)
+	e.writeInt(int64(ref.Size))
+	envelope = encoder{}
+	envelope.writeUint(binaryMarker, 1)
+	envelope.writeString(recordSnapshot)
+	envelope.writeUint(keyedSnapshotSchema-1, 4)
+	envelope.writeBytes(e.buf)
+	snapUUID, snapMacKey, snapEncKey := alice0040.snapshotLocation("old")
+	userlib.DatastoreSet(snapUUID, sealEntry(snapMacKey, snapEncKey, recordSnapshot, snapUUID, envelope.buf))
+	if data, err := alice0040.LoadFile("old"); err != nil || string(data) != "old contents" {
+		t.Error("Failed to load a header from before chunk keys", err)
+	}
+	if data, err := alice0040.LoadFileAtSnapshot("old", "old"); err != nil || string(data) != "old contents" {
+		t.Error("Failed to load a snapshot from before chunk keys", err)
+	}
+	alice0040.AppendFile("old", []byte(" and new"))
+	record, _ := userlib.DatastoreGet(handle.Location)
+	opened, _ := openRecord(handle.Keys[0:16], handle.Keys[16:32], recordAD(recordHeader, handle.Location[:]), record)
+	if object, _ := readStoredObject(opened); object.Schema != currentSchema(recordHeader) {
+		t.Error("Header wasn't written back in the new schema", object.Schema)
+	}
+	if versions, err := alice0040.ListVersions("old"); err != nil || len(versions) != 2 {
+		t.Error("Version record of an upgraded header is wrong", err)
+	}
+	if data, err := alice0040.LoadFileVersion("old", 0); err != nil || string(data) != "old contents" {
+		t.Error("Failed to load a version of an upgraded header", err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	alice0041, err := InitUser("alice0041", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0041", err)
+		return
+	}
+	bob0041, _ := InitUser("bob0041", "password")
+	alice0041.SetChunkSize(16)
+	bob0041.SetChunkSize(16)
+	if garbage, err := alice0041.CollectGarbage(); err != nil || len(garbage) != 0 {
+		t.Error("Collected garbage for a user with nothing stored", garbage, err)
+	}
+
+	alice0041.StoreFile("file", []byte("the contents of a file spanning several chunks"))
+	alice0041.AppendFile("file", []byte(" and an append"))
+	alice0041.WriteAt("file", 0, []byte("THE"))
+	alice0041.Mkdir("docs")
+	alice0041.StoreFile("docs/inner", []byte("a file inside a directory"))
+	alice0041.StoreFile("gone", []byte("deleted but kept by a snapshot"))
+	alice0041.SetDedup(true)
+	deduped := userlib.RandomBytes(200)
+	alice0041.StoreFile("dedup", deduped)
+	alice0041.CreateSnapshot("snap")
+	alice0041.DeleteFile("gone")
+	magic, _ := alice0041.ShareFile("file", "bob0041")
+	bob0041.ReceiveFile("shared", "alice0041", magic)
+	bob0041.StoreFile("own", []byte("bob's own file"))
+	aliceJournal, _, _ := alice0041.journalLocation()
+	bobJournal, _, _ := bob0041.journalLocation()
+	for _, location := range []uuid.UUID{aliceJournal, bobJournal} {
+		if _, ok := userlib.DatastoreGet(location); ok {
+			t.Error("Finished operations were left in a journal")
+		}
+	}
+
+	// added is what was stored since before, other than the journals
+	added := func(before map[uuid.UUID][]byte) map[uuid.UUID]bool {
+		found := make(map[uuid.UUID]bool)
+		for location := range userlib.DatastoreGetMap() {
+			if _, ok := before[location]; !ok && location != aliceJournal && location != bobJournal {
+				found[location] = true
+			}
+		}
+		return found
+	}
+	sameSet := func(garbage []uuid.UUID, want map[uuid.UUID]bool) bool {
+		found := make(map[uuid.UUID]bool)
+		for _, location := range garbage {
+			found[location] = true
+		}
+		return reflect.DeepEqual(found, want)
+	}
+	checkFiles := func() {
+		for _, load := range []struct {
+			user *User
+			name string
+			want string
+		}{
+			{alice0041, "file", "THE contents of a file spanning several chunks and an append"},
+			{alice0041, "docs/inner", "a file inside a directory"},
+			{alice0041, "dedup", string(deduped)},
+			{bob0041, "shared", "THE contents of a file spanning several chunks and an append"},
+			{bob0041, "own", "bob's own file"},
+		} {
+			if data, err := load.user.LoadFile(load.name); err != nil || string(data) != load.want {
+				t.Error("Failed to load a file after collecting garbage", load.name, err)
+			}
+		}
+		if data, err := alice0041.LoadFileVersion("file", 0); err != nil || string(data) != "the contents of a file spanning several chunks" {
+			t.Error("Failed to load a kept version after collecting garbage", err)
+		}
+		if data, err := alice0041.LoadFileAtSnapshot("snap", "gone"); err != nil || string(data) != "deleted but kept by a snapshot" {
+			t.Error("Failed to load a deleted file from a snapshot after collecting garbage", err)
+		}
+		if data, err := alice0041.LoadFileAtSnapshot("snap", "file"); err != nil || string(data) != "THE contents of a file spanning several chunks and an append" {
+			t.Error("Failed to load a moved file from a snapshot after collecting garbage", err)
+		}
+	}
+
+	// writers that are never closed leave chunks no header points at,
+	// including one of bob's in alice's file, which is in bob's journal
+	stored := saveDatastore()
+	for _, open := range []struct {
+		user *User
+		name string
+	}{{alice0041, "file"}, {alice0041, "docs/inner"}, {bob0041, "shared"}} {
+		writer, err := open.user.OpenWriter(open.name)
+		if err != nil {
+			t.Error("Failed to open a writer", open.name, err)
+			return
+		}
+		writer.Write(make([]byte, 40))
+	}
+	leaked := added(stored)
+	if len(leaked) != 6 {
+		t.Error("Writers didn't leave the chunks expected", len(leaked))
+	}
+
+	aliceGarbage, err := alice0041.CollectGarbageDryRun()
+	if err != nil || len(aliceGarbage) != 4 {
+		t.Error("Dry run didn't report alice's leaked chunks", aliceGarbage, err)
+	}
+	for location := range leaked {
+		if _, ok := userlib.DatastoreGet(location); !ok {
+			t.Error("Dry run deleted a chunk")
+		}
+	}
+	bobGarbage, err := bob0041.CollectGarbage()
+	if err != nil || len(bobGarbage) != 2 || !sameSet(append(bobGarbage, aliceGarbage...), leaked) {
+		t.Error("Didn't collect bob's leaked chunks", bobGarbage, err)
+	}
+	if _, ok := userlib.DatastoreGet(bobJournal); ok {
+		t.Error("Collecting garbage left bob's journal")
+	}
+
+	kept := saveDatastore()
+	garbage, err := alice0041.CollectGarbage()
+	if err != nil || !reflect.DeepEqual(garbage, aliceGarbage) {
+		t.Error("Didn't collect the leaked chunks", garbage, err)
+	}
+	for location, value := range kept {
+		current, ok := userlib.DatastoreGet(location)
+		if (leaked[location] || location == aliceJournal) && ok {
+			t.Error("A leaked chunk is still stored")
+		} else if !leaked[location] && location != aliceJournal && (!ok || string(current) != string(value)) {
+			t.Error("Collecting garbage changed something in use")
+		}
+	}
+	checkFiles()
+	if garbage, err := alice0041.CollectGarbage(); err != nil || len(garbage) != 0 {
+		t.Error("Collected garbage twice", garbage, err)
+	}
+
+	// a writer on a deduplicated file stores chunks that have no count
+	// until the header holds them
+	stored = saveDatastore()
+	writer, _ := alice0041.OpenWriter("dedup")
+	writer.Write(userlib.RandomBytes(200))
+	leaked = added(stored)
+	if garbage, err := alice0041.CollectGarbage(); err != nil || len(leaked) == 0 || !sameSet(garbage, leaked) {
+		t.Error("Didn't collect the deduplicated chunks of a writer never closed", garbage, err)
+	}
+	checkFiles()
+
+	// a revoke that died after the user record was stored, but before the
+	// old copy of the file was deleted, leaves the old copy
+	stored = saveDatastore()
+	old, _ := alice0041.locate("file")
+	if err := alice0041.rekeyFile("file"); err != nil {
+		t.Error("Failed to re-key", err)
+	}
+	alice0041.storeUser()
+	left := make(map[uuid.UUID]bool)
+	for location, value := range stored {
+		if _, ok := userlib.DatastoreGet(location); !ok {
+			userlib.DatastoreSet(location, value)
+			left[location] = true
+		}
+	}
+	// the snapshot keeps the old header, retired, and the chunks it pins
+	userlib.DatastoreSet(old.Location, stored[old.Location])
+	alice0041.active = nil
+	if garbage, err := alice0041.CollectGarbage(); err != nil || len(left) == 0 || !sameSet(garbage, left) {
+		t.Error("Didn't collect the copy a re-key left", garbage, len(left), err)
+	}
+	checkFiles()
+
+	// one that died before the user record was stored leaves the new copy
+	// instead, which nothing reaches
+	stored = saveDatastore()
+	alice0041.rekeyFile("file")
+	leaked = added(stored)
+	for location, value := range stored {
+		userlib.DatastoreSet(location, value)
+	}
+	alice0041.active = nil
+	if garbage, err := alice0041.CollectGarbage(); err != nil || len(leaked) == 0 || !sameSet(garbage, leaked) {
+		t.Error("Didn't collect the copy an unfinished re-key stored", garbage, err)
+	}
+	checkFiles()
+
+	// and a share that died before the user record was stored leaves an
+	// access node nobody was given
+	stored = saveDatastore()
+	bobPk, _ := userlib.KeystoreGet("bob0041enc")
+	alice0041.shareFile("dedup", "bob0041", bobPk, nil, permAll)
+	leaked = added(stored)
+	userlib.DatastoreSet(alice0041.UserUUID, stored[alice0041.UserUUID])
+	alice0041.active = nil
+	if garbage, err := alice0041.CollectGarbage(); err != nil || len(leaked) != 1 || !sameSet(garbage, leaked) {
+		t.Error("Didn't collect an access node never handed out", garbage, err)
+	}
+	checkFiles()
+
+	// an append that died before its header was stored leaves its chunks
+	// and the version record of the old contents
+	stored = saveDatastore()
+	handle, _ := alice0041.locate("docs/inner")
+	fileMarshal, _ := userlib.DatastoreGet(handle.Location)
+	appendData(handle.Keys[0:16], handle.Keys[16:32], fileMarshal, []byte(" and more than a chunk more"), handle.Location, alice0041)
+	leaked = added(stored)
+	userlib.DatastoreSet(handle.Location, stored[handle.Location])
+	alice0041.active = nil
+	if garbage, err := alice0041.CollectGarbage(); err != nil || len(leaked) < 3 || !sameSet(garbage, leaked) {
+		t.Error("Didn't collect the chunks and version record of an unfinished append", garbage, err)
+	}
+	checkFiles()
+	for _, location := range []uuid.UUID{aliceJournal, bobJournal} {
+		if _, ok := userlib.DatastoreGet(location); ok {
+			t.Error("Collecting garbage left a journal")
+		}
+	}
+
+	// a journal that doesn't open is an error rather than a reason to
+	// delete anything
+	userlib.DatastoreSet(aliceJournal, []byte("garbage"))
+	if _, err := alice0041.CollectGarbage(); err == nil {
+		t.Error("Collected garbage with a corrupted journal")
+	}
+	userlib.DatastoreDelete(aliceJournal)
+}
+
+func TestCollectGarbageOpenWriter(t *testing.T) {
+	alice0042, err := InitUser("alice0042", "password")
+	if err != nil {
+		t.Error("Failed to initialize user alice0042", err)
+		return
+	}
+	alice0042.SetChunkSize(16)
+	alice0042.StoreFile("file", []byte("contents from before the writer"))
+	other, _ := GetUser("alice0042", "password")
+
+	// garbage collection can't tell an open writer from one that was
+	// abandoned, so it takes what the writer wrote and closing fails
+	stored := saveDatastore()
+	writer, _ := alice0042.OpenWriter("file")
+	writer.Write([]byte("new contents spanning a few chunks"))
+	if garbage, err := other.CollectGarbage(); err != nil || len(garbage) != 2 {
+		t.Error("Didn't collect the chunks of an open writer", garbage, err)
+	}
+	writer.Write([]byte(" and some written after"))
+	if err := writer.Close(); err == nil {
+		t.Error("Closed a writer whose chunks were collected")
+	}
+	if data, err := alice0042.LoadFile("file"); err != nil || string(data) != "contents from before the writer" {
+		t.Error("A writer whose chunks were collected changed the file", string(data), err)
+	}
+	journal, _, _ := alice0042.journalLocation()
+	for location := range userlib.DatastoreGetMap() {
+		if _, ok := stored[location]; !ok && location != journal {
+			t.Error("A writer whose chunks were collected left some behind")
+		}
+	}
+
+	// a writer opened after the collection is unaffected
+	writer, _ = alice0042.OpenWriter("file")
+	writer.Write([]byte("written by a later writer"))
+	if err := writer.Close(); err != nil {
+		t.Error("Failed to close a writer", err)
+	}
+	if data, err := other.LoadFile("file"); err != nil || string(data) != "written by a later writer" {
+		t.Error("Failed to load what a later writer wrote", string(data), err)
+	}
+	if garbage, err := other.CollectGarbageDryRun(); err != nil || len(garbage) != 0 {
+		t.Error("Collected garbage after a writer was closed", garbage, err)
+	}
+	if _, ok := userlib.DatastoreGet(journal); ok {
+		t.Error("A closed writer was left in the journal")
+	}
+}
+
+// readAll reads a Reader to the end, like io.ReadAll does for io.EOF.
+func readAll(reader Reader) ([]byte, error) {
+	var data []byte
+	buf := make([]byte, 1000)
+	for {
+		n, err := reader.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == EOF {
+			return data, nil
+		}
+		if err != nil {
+			return data, err
+		}
+	}
+}
+
+// saveDatastore copies the datastore so a fuzz iteration can put back
+// whatever it broke.
+func saveDatastore() map[uuid.UUID][]byte {
+	saved := make(map[uuid.UUID][]byte)
+	for key, value := range userlib.DatastoreGetMap() {
+		saved[key] = append([]byte{}, value...)
+	}
+	return saved
+}
+
+func restoreDatastore(saved map[uuid.UUID][]byte) {
+	userlib.DatastoreClear()
+	for key, value := range saved {
+		userlib.DatastoreSet(key, append([]byte{}, value...))
+	}
+}
+
+func FuzzOpenRecord(f *testing.F) {
+	macKey := userlib.RandomBytes(16)
+	encKey := userlib.RandomBytes(16)
+	ad := recordAD(recordChunk, uuid.Nil[:])
+	f.Add([]byte{})
+	f.Add(make([]byte, userlib.AESBlockSize+userlib.HashSize))
+	valid := sealRecord(macKey, encKey, ad, []byte("hello"))
+	f.Add(valid)
+	f.Fuzz(func(t *testing.T, record []byte) {
+		plaintext, err := openRecord(macKey, encKey, ad, record)
+		if string(record) == string(valid) {
+			if err != nil || string(plaintext) != "hello" {
+				t.Error("Failed to open the sealed record", err)
+			}
+		} else if err == nil {
+			t.Error("Opened a record that wasn't sealed with the keys")
+		}
+	})
+}
+
+func FuzzUserEntry(f *testing.F) {
+	alice, err := InitUser("fuzzuser", "password")
+	if err != nil {
+		f.Fatal(err)
+	}
+	valid, _ := userlib.DatastoreGet(alice.UserUUID)
+	f.Add([]byte{}, false)
+	f.Add(valid, false)
+	f.Add([]byte(`{"Username":"fuzzuser","SharedFiles":{"f":{}}}`), true)
+	f.Add([]byte(`{"Username":"fuzzuser","HmacKey":"AA==","SymKey":"AA=="}`), true)
+	f.Fuzz(func(t *testing.T, data []byte, sealed bool) {
+		saved := saveDatastore()
+		defer restoreDatastore(saved)
+		if sealed {
+			data = sealRecord(alice.HmacKey, alice.SymKey, recordAD(recordUser, alice.UserUUID[:]), data)
+		}
+		userlib.DatastoreSet(alice.UserUUID, data)
+		user, err := GetUser("fuzzuser", "password")
+		// the user's keys come from the password alone, so an entry sealed
+		// in another fuzzing process opens as well as this one's
+		if _, openErr := openRecord(alice.HmacKey, alice.SymKey, recordAD(recordUser, alice.UserUUID[:]), data); openErr != nil {
+			if err == nil {
+				t.Error("Loaded a user entry that wasn't sealed with the user's keys")
+			}
+			if _, err := alice.ListFiles(); err == nil {
+				t.Error("Synced from a user entry that wasn't sealed with the user's keys")
+			}
+		}
+		if err == nil {
+			user.LoadFile("f")
+			user.StoreFile("g", []byte("data"))
+			user.ListFiles()
+			user.ListSnapshots()
+		}
+		alice.LoadFile("f")
+		alice.ListFiles()
+	})
+}
+
+// FuzzFileObjects puts arbitrary bytes in place of each kind of object a
+// file is made of, both as they are and sealed under the right keys, the
+// way a malicious user the file is shared with could write them.
+func FuzzFileObjects(f *testing.F) {
+	alice, err := InitUser("fuzzfiles", "password")
+	if err != nil {
+		f.Fatal(err)
+	}
+	bob, _ := InitUser("fuzzfilesbob", "password")
+	alice.SetChunkSize(8)
+	bob.SetChunkSize(8)
+	alice.StoreFile("f", []byte("some data in a few chunks"))
+	alice.AppendFile("f", []byte("and an append"))
+	alice.Mkdir("d")
+	alice.StoreFile("d/g", []byte("nested"))
+	magic_string, _ := alice.ShareFile("f", "fuzzfilesbob")
+	bob.ReceiveFile("f", "fuzzfiles", magic_string)
+
+	file, _ := alice.locate("f")
+	dir, _ := alice.locate("d")
+	chunk := loadHeader(file).Chunks[0]
+	version := loadHeader(file).History[0]
+	node := bob.SharedFiles["f"]
+	header, _ := userlib.DatastoreGet(file.Location)
+	dirHeader, _ := userlib.DatastoreGet(dir.Location)
+	f.Add(uint8(0), header, false)
+	f.Add(uint8(0), []byte(`{"Chunks":null,"ChunkSize":0,"Size":0}`), true)
+	f.Add(uint8(0), []byte(`{"Chunks":[{"Size":1}],"ChunkSize":1,"Size":1,"History":[{"Version":-1}],"Version":1}`), true)
+	f.Add(uint8(1), []byte("chunk"), true)
+	f.Add(uint8(2), dirHeader, false)
+	f.Add(uint8(2), []byte(`{"Version":99,"Children":{"g":{"Keys":"AA=="}}}`), true)
+	f.Add(uint8(3), []byte(`{"Root":"AA==","Owners":["fuzzfiles"]}`), true)
+	f.Add(uint8(4), []byte(`{"Chunks":[{"Size":-1}],"ChunkSize":0,"Size":0}`), true)
+	f.Fuzz(func(t *testing.T, kind uint8, data []byte, sealed bool) {
+		saved := saveDatastore()
+		defer restoreDatastore(saved)
+		// the location tampered with, and who can no longer load what
+		tampered := map[uint8]uuid.UUID{0: file.Location, 1: chunk.Location, 2: dir.Location, 3: node.Node, 4: version.Record.Location}[kind%5]
+		original, _ := userlib.DatastoreGet(tampered)
+		switch kind % 5 {
+		case 0:
+			if sealed {
+				data = sealRecord(file.Keys[0:16], file.Keys[16:32], recordAD(recordHeader, file.Location[:]), data)
+			}
+			userlib.DatastoreSet(file.Location, data)
+		case 1:
+			if sealed {
+				data = sealRecord(file.Keys[0:16], file.Keys[16:32], recordAD(recordChunk, chunk.Location[:]), data)
+			}
+			userlib.DatastoreSet(chunk.Location, data)
+		case 2:
+			if sealed {
+				var filedata FileEntry
+				filedata.ChunkSize = 4096
+				filedata.appendChunks(dir.Keys[16:32], dir.Keys[0:16], data)
+				storeFileEntry(dir.Keys[0:16], dir.Keys[16:32], dir.Location, &filedata)
+			} else {
+				userlib.DatastoreSet(dir.Location, data)
+			}
+		case 3:
+			if sealed {
+				data = sealEntry(node.NodeKeys[0:16], node.NodeKeys[16:32], recordNode, node.Node, data)
+			}
+			userlib.DatastoreSet(node.Node, data)
+		case 4:
+			if sealed {
+				data = sealRecord(file.Keys[0:16], file.Keys[16:32], recordAD(recordChunk, version.Record.Location[:]), data)
+			}
+			userlib.DatastoreSet(version.Record.Location, data)
+		}
+		// anything but what a user with the keys could seal is rejected,
+		// and a chunk or version record can't be replaced even by them
+		if (!sealed || kind%5 == 1 || kind%5 == 4) && string(data) != string(original) {
+			checks := map[uint8]func() error{
+				0: func() error { _, err := alice.LoadFile("f"); return err },
+				1: func() error { _, err := bob.LoadFile("f"); return err },
+				2: func() error { _, err := alice.LoadFile("d/g"); return err },
+				3: func() error { _, err := bob.LoadFile("f"); return err },
+				4: func() error { _, err := bob.LoadFileVersion("f", version.Version); return err },
+			}
+			if checks[kind%5]() == nil {
+				t.Error("Loaded a file after tampering", kind%5)
+			}
+		}
+		for _, user := range []*User{alice, bob} {
+			user.LoadFile("f")
+			user.LoadFileRange("f", 3, 10)
+			user.ListFiles()
+			user.ListVersions("f")
+			user.LoadFileVersion("f", 0)
+			if reader, err := user.OpenReader("f"); err == nil {
+				readAll(reader)
+			}
+		}
+		alice.AppendFile("f", []byte("x"))
+		alice.WriteAt("f", 20, []byte("y"))
+		alice.Truncate("f", 5)
+		alice.RestoreVersion("f", 0)
+		alice.CopyFile("f", "copy")
+		alice.ReadDir("d")
+		alice.LoadFile("d/g")
+		alice.StoreFile("d/h", []byte("new"))
+		alice.CreateSnapshot("snap")
+		alice.DeleteSnapshot("snap")
+		alice.RevokeFile("f")
+	})
+}
+
+// FuzzSharingRecord hands ReceiveFile arbitrary records: raw bytes, a
+// payload the sender really signed, and a body really sealed for the
+// recipient.
+func FuzzSharingRecord(f *testing.F) {
+	alice, err := InitUser("fuzzsharer", "password")
+	if err != nil {
+		f.Fatal(err)
+	}
+	bob, _ := InitUser("fuzzreceiver", "password")
+	bobPk, _ := userlib.KeystoreGet("fuzzreceiver" + "enc")
+	alice.StoreFile("f", []byte("shared"))
+	magic_string, _ := alice.ShareFile("f", "fuzzreceiver")
+	f.Add(uint8(0), []byte(magic_string))
+	f.Add(uint8(1), []byte(`{"Sender":"fuzzsharer","Recipient":"fuzzreceiver","Nonce":"AA==","IssuedAt":1,"Body":{"WrappedKeys":"AA=="}}`))
+	f.Add(uint8(2), []byte(`{"NodeKeys":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=","Chain":[{}]}`))
+	f.Add(uint8(2), []byte(`{"NodeKeys":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=","Chain":null}`))
+	f.Fuzz(func(t *testing.T, kind uint8, data []byte) {
+		saved := saveDatastore()
+		defer restoreDatastore(saved)
+		record := data
+		switch kind % 3 {
+		case 1:
+			sigma, _ := userlib.DSSign(alice.DsSk, data)
+			record, _ = json.Marshal(sharingRecord{data, sigma})
+		case 2:
+			envelope, err := sealEnvelope(bobPk, data)
+			if err != nil {
+				return
+			}
+			payload, _ := json.Marshal(sharingPayload{Sender: "fuzzsharer", Recipient: "fuzzreceiver",
+				Body: envelope, Nonce: userlib.RandomBytes(16), IssuedAt: alice.Issued + 1})
+			sigma, _ := userlib.DSSign(alice.DsSk, payload)
+			record, _ = json.Marshal(sharingRecord{payload, sigma})
+		}
+		err := bob.ReceiveFile("f", "fuzzsharer", string(record))
+		if kind%3 == 0 && string(data) != magic_string && err == nil {
+			t.Error("Received a file from a record the sender didn't sign")
+		}
+		if err := bob.AcceptOwnership("g", "fuzzsharer", string(record)); kind%3 == 0 && err == nil {
+			t.Error("Accepted ownership from a record the sender didn't sign")
+		}
+		bob.LoadFile("f")
+		bob.ListFiles()
+	})
+}
+
+// FuzzUserObjects does the same for the objects a user keeps for itself.
+func FuzzUserObjects(f *testing.F) {
+	alice, err := InitUser("fuzzobjects", "password")
+	if err != nil {
+		f.Fatal(err)
+	}
+	alice.StoreFile("f", []byte("data"))
+	alice.CreateGroup("team")
+	alice.CreateSnapshot("snap")
+	groupUUID, groupMacKey, groupEncKey := alice.groupLocation("team")
+	snapUUID, snapMacKey, snapEncKey := alice.snapshotLocation("snap")
+	f.Add(uint8(0), []byte(`{"Name":"team","Members":null}`), true)
+	f.Add(uint8(1), []byte(`{"Label":"snap","Files":{"f":{"Keys":"AA==","Chunks":[{"Size":-1}]}}}`), true)
+	f.Add(uint8(1), []byte(`{"Label":"snap","Files":{"f":{"Keys":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=","Size":5}}}`), true)
+	f.Fuzz(func(t *testing.T, kind uint8, data []byte, sealed bool) {
+		saved := saveDatastore()
+		defer restoreDatastore(saved)
+		if kind%2 == 0 {
+			original, _ := userlib.DatastoreGet(groupUUID)
+			if sealed {
+				data = sealEntry(groupMacKey, groupEncKey, recordGroup, groupUUID, data)
+			}
+			userlib.DatastoreSet(groupUUID, data)
+			if _, err := alice.loadGroup("team"); !sealed && string(data) != string(original) && err == nil {
+				t.Error("Loaded a group that wasn't sealed with its keys")
+			}
+		} else {
+			original, _ := userlib.DatastoreGet(snapUUID)
+			if sealed {
+				data = sealEntry(snapMacKey, snapEncKey, recordSnapshot, snapUUID, data)
+			}
+			userlib.DatastoreSet(snapUUID, data)
+			if _, err := alice.LoadFileAtSnapshot("snap", "f"); !sealed && string(data) != string(original) && err == nil {
+				t.Error("Loaded a snapshot that wasn't sealed with its keys")
+			}
+		}
+		alice.AddMember("team", "fuzzobjects")
+		alice.RemoveMember("team", "fuzzobjects")
+		alice.ShareFile("f", "team")
+		alice.ListSnapshots()
+		alice.LoadFileAtSnapshot("snap", "f")
+		alice.DeleteSnapshot("snap")
+	})
+}
+
+// benchmarkHeader is a header for a file of 1000 chunks, each with its
+// tag, with a few versions kept.
+func benchmarkHeader() FileEntry {
+	header := FileEntry{ChunkSize: defaultChunkSize, Version: 4, Keep: defaultKeepVersions}
+	for i := 0; i < 1000; i++ {
+		header.Chunks = append(header.Chunks, chunkRef{Location: uuid.New(), Size: defaultChunkSize, Sigma: userlib.RandomBytes(userlib.HashSize)})
+	}
+	header.Size = len(header.Chunks) * defaultChunkSize
+	for v := 0; v < 4; v++ {
+		header.History = append(header.History, versionRef{v, chunkRef{Location: uuid.New(), Size: 100, Sigma: userlib.RandomBytes(userlib.HashSize)}})
+	}
+	return header
+}
+
+func BenchmarkEncodeHeaderJSON(b *testing.B) {
+	header := benchmarkHeader()
+	var encoded []byte
+	for i := 0; i < b.N; i++ {
+		encoded, _ = json.Marshal(header)
+	}
+	b.ReportMetric(float64(len(encoded)), "stored-bytes")
+}
+
+func BenchmarkEncodeHeaderBinary(b *testing.B) {
+	header := benchmarkHeader()
+	var encoded []byte
+	for i := 0; i < b.N; i++ {
+		encoded = encodeObject(recordHeader, &header)
+	}
+	b.ReportMetric(float64(len(encoded)), "stored-bytes")
+}
+
+func BenchmarkDecodeHeaderJSON(b *testing.B) {
+	header := benchmarkHeader()
+	encoded, _ := json.Marshal(header)
+	for i := 0; i < b.N; i++ {
+		var decoded FileEntry
+		if err := decodeJSON(encoded, &decoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeHeaderBinary(b *testing.B) {
+	header := benchmarkHeader()
+	encoded := encodeObject(recordHeader, &header)
+	for i := 0; i < b.N; i++ {
+		var decoded FileEntry
+		if err := decodeObject(recordHeader, encoded, &decoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// The MAC of a header is taken over its encoding, so this is what sealing
+// one costs end to end.
+func BenchmarkSealHeaderJSON(b *testing.B) {
+	header := benchmarkHeader()
+	macKey, encKey := userlib.RandomBytes(16), userlib.RandomBytes(16)
+	location := uuid.New()
+	for i := 0; i < b.N; i++ {
+		encoded, _ := json.Marshal(header)
+		sealRecord(macKey, encKey, recordAD(recordHeader, location[:]), encoded)
+	}
+}
+
+func BenchmarkSealHeaderBinary(b *testing.B) {
+	header := benchmarkHeader()
+	macKey, encKey := userlib.RandomBytes(16), userlib.RandomBytes(16)
+	location := uuid.New()
+	for i := 0; i < b.N; i++ {
+		sealRecord(macKey, encKey, recordAD(recordHeader, location[:]), encodeObject(recordHeader, &header))
+	}
+}
+
+func FuzzDecodeObject(f *testing.F) {
+	header := benchmarkHeader()
+	f.Add(uint8(0), encodeObject(recordHeader, &header))
+	f.Add(uint8(1), encodeObject(recordUser, &User{Username: "fuzz", SharedFiles: map[string]SharedFile{"f": {Root: make([]byte, 16)}}}))
+	f.Add(uint8(2), []byte{0, 0, 0, 0, 5, 'g', 'r', 'o', 'u', 'p', 0, 0, 0, 2, 0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, kind uint8, data []byte) {
+		objects := []func() binaryObject{
+			func() binaryObject { return &FileEntry{} },
+			func() binaryObject { return &User{} },
+			func() binaryObject { return &Group{} },
+			func() binaryObject { return &snapshot{} },
+			func() binaryObject { return &directory{} },
+			func() binaryObject { return &accessNode{} },
+			func() binaryObject { return &shareGrant{} },
+			func() binaryObject { return &sharingPayload{} },
+			func() binaryObject { return &sharingBody{} },
+			func() binaryObject { return &transferBody{} },
+			func() binaryObject { return &fileVersion{} },
+			func() binaryObject { return &journal{} },
+		}
+		kinds := []string{recordHeader, recordUser, recordGroup, recordSnapshot, objectDirectory,
+			recordNode, objectGrant, objectPayload, objectShare, objectTransfer, objectVersion, recordJournal}
+		i := int(kind) % len(kinds)
+		v := objects[i]()
+		if decodeObject(kinds[i], data, v) == nil {
+			// anything accepted encodes back to exactly what was read
+			again := objects[i]()
+			if err := decodeObject(kinds[i], encodeObject(kinds[i], v), again); err != nil {
+				t.Error("Accepted object doesn't round trip", err)
+			}
+		}
+	})
+}
+
+func FuzzExpandLZ(f *testing.F) {
+	f.Add(compressLZ([]byte(strings.Repeat("hello world ", 50))), 600)
+	f.Add([]byte{0x1f, 'a', 0, 1, 255, 255, 3}, 600)
+	f.Add([]byte{}, 0)
+	f.Fuzz(func(t *testing.T, data []byte, size int) {
+		if size < 0 || size > 1<<20 {
+			return
+		}
+		if out, err := expandLZ(data, size); err == nil && len(out) != size {
+			t.Error("Expanded to the wrong size", len(out), size)
+		}
+	})
+}
+
+func FuzzCompressLZ(f *testing.F) {
+	f.Add([]byte(strings.Repeat("abcd", 100)))
+	f.Add([]byte("a"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if out, err := expandLZ(compressLZ(data), len(data)); err != nil || string(out) != string(data) {
+			t.Error("Data didn't survive compression", err)
+		}
+	})
+}